@@ -106,6 +106,6 @@ func logOne(level Level, format string, a ...interface{}) {
     prefix0 := time.Now().UTC().Format("2006-01-02T15:04:05 ")
     prefix1 := fmt.Sprintf("%s:%d/%s  %s ", file, ln, funcName, level)
 
-    _, _ = fmt.Fprintf(os.Stdout,
+    _, _ = fmt.Fprint(os.Stdout,
         prefix0 + prefix1 + fmt.Sprintf(format, a...) + "\n")
 }
@@ -27,7 +27,7 @@ func Put64LE(n int, dst []byte, val uint64) []byte {
 }
 
 func Get64BE(n int, src []byte) (uint64, []byte, error) {
-	if len(src) < 0 {
+	if len(src) < n {
 		return 0, nil, io.EOF
 	}
 
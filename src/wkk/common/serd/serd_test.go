@@ -27,4 +27,13 @@ func Test1(t *testing.T)  {
 	misc.Assert(uint64(0x31) == actual1)
 	misc.Assert(uint64(0x310E0E) == actual3)
 	misc.Assert(uint64(0x310E0EDD47DB6F72) == actual8)
-}
\ No newline at end of file
+}
+
+func Test2(t *testing.T)  {
+	data := []byte{0x31, 0x0E}
+
+	_, _, err := Get64LE(3, data)
+	misc.Assert(err != nil)
+	_, _, err = Get64BE(3, data)
+	misc.Assert(err != nil)
+}
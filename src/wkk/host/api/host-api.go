@@ -1,9 +1,11 @@
 package api
 
+import "fmt"
+
 const (
 	WireMagic     = uint16(0x43bf)
 	PortDelta     = 1
-	SerializeSize = 1024
+	SerializeSize = 64 * 1024	// topologies ride in the payload
 )
 
 const (
@@ -18,7 +20,14 @@ const (
 	TagParticipantAddr = 0x06
 	TagParticipantPort = 0x07
 
-	TagOutcome = 0x10
+	TagTopologyVersion = 0x08
+
+	TagCapacity  = 0x09
+	TagUsed      = 0x0a
+	TagNReplicas = 0x0b
+
+	TagOutcome    = 0x10
+	TagPayloadCRC = 0x11	// and 0x12
 )
 
 const (
@@ -26,8 +35,31 @@ const (
 	KindCreateFirstReplica = uint64(0x11)
 	KindCreateExtraReplica = uint64(0x12)
 	KindRemoveReplica      = uint64(0x13)
+	KindGetTopology        = uint64(0x21)
+	KindListReplicas       = uint64(0x22)
+	KindGetStatus          = uint64(0x23)
 )
 
+// feature bits told in every header, on top of network.Version
+const (
+	FeatureTopology = 1 << 0	// KindGetTopology
+	FeatureAdmin    = 1 << 1	// KindRemoveReplica, KindListReplicas, KindGetStatus
+
+	Features = FeatureTopology | FeatureAdmin
+)
+
+// Needs tells the features a peer needs to serve kind
+func Needs(kind uint64) uint64 {
+	switch kind {
+	case KindGetTopology:
+		return FeatureTopology
+	case KindRemoveReplica, KindListReplicas, KindGetStatus:
+		return FeatureAdmin
+	default:
+		return 0
+	}
+}
+
 type Outcome uint64
 
 const (
@@ -44,6 +76,6 @@ func (oc Outcome) Error() string {
 	case NoSpace:	return "NoSpace"
 	case Inval:		return "Inval"
 	case Abort:		return "Abort"
-	default:		panic("UNREACHABLE")
+	default:		return fmt.Sprintf("Outcome(%d)", uint64(oc))	// of a newer host
 	}
 }
\ No newline at end of file
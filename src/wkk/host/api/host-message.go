@@ -4,16 +4,35 @@ import (
 	"errors"
 	"time"
 	"wkk/common/blob"
-	"wkk/common/misc"
+	"wkk/common/crc128"
 	"wkk/network"
 )
 
+const (
+	PayloadCRC_0 = 0x3b6c1e0f92d4a857
+	PayloadCRC_1 = 0xd1f0837a5e26c49b
+)
+
+var PayloadZero = blob.T{
+	Data: nil,
+	CRC:  crc128.MkCRC(PayloadCRC_0, PayloadCRC_1),
+}
+
+// ErrMissing is a response without a tag of its kind, e.g. of an older host
+var ErrMissing = errors.New("tag missing in response")
+
 type HostMessage struct {
-	hdr network.Nbuf
-	msg network.Nbuf
+	hdr     network.Nbuf
+	msg     network.Nbuf
+	payload blob.T
 }
 
 func (t *HostMessage) PutHdr(deadline time.Time, requestId, clientId uint64)  {
+	t.PutHdr1(deadline, requestId, clientId, network.Peer{Version: network.Version, Features: Features})
+}
+
+// PutHdr1 tells peer instead, nothing of Version 0, as older hosts
+func (t *HostMessage) PutHdr1(deadline time.Time, requestId, clientId uint64, peer network.Peer)  {
 	// remove 1 millis for RTT
 	allowance := (deadline.Sub(time.Now()) - time.Millisecond).Microseconds()
 	if allowance < 0 {
@@ -23,11 +42,24 @@ func (t *HostMessage) PutHdr(deadline time.Time, requestId, clientId uint64)  {
 	t.hdr.Put(network.TagClientID, clientId)
 	t.hdr.Put(network.TagRequestID, requestId)
 	t.hdr.Put(network.TagAllowance, uint64(allowance))
+	if peer.Version > 0 {
+		t.hdr.Put(network.TagVersion, peer.Version)
+		t.hdr.Put(network.TagFeatures, peer.Features)
+	}
+}
+
+func (t *HostMessage) Hdr(tag uint64) uint64 {
+	return t.hdr.Get(tag)
 }
 
 func (t *HostMessage) Serialize(dst []byte) []byte {
+	if len(t.payload.Data) > 0 {
+		t.Put(TagPayloadCRC + 0, t.payload.CRC.V[0])
+		t.Put(TagPayloadCRC + 1, t.payload.CRC.V[1])
+	}
+
 	return network.Serialize(dst,
-		WireMagic, []*network.Nbuf{&t.hdr, &t.msg}, [][]byte{})
+		WireMagic, []*network.Nbuf{&t.hdr, &t.msg}, [][]byte{t.payload.Data})
 }
 
 func (t *HostMessage) Deserialize(src []byte) error {
@@ -36,8 +68,21 @@ func (t *HostMessage) Deserialize(src []byte) error {
 
 	if err := network.Deserialize(src, nbufs, blobs); err != nil {
 		return err
-	} else if len(blobs[0]) != 0 {
-		return errors.New("bad message")
+	}
+
+	t.payload = PayloadZero
+
+	if len(blobs[0]) > 0 {
+		if !t.msg.Have(network.Bit(TagPayloadCRC) | network.Bit(TagPayloadCRC + 1)) {
+			return errors.New("bad payload")
+		}
+		t.payload = blob.T{Data: blobs[0], CRC: crc128.T{
+			V: [2]uint64{t.Get(TagPayloadCRC + 0), t.Get(TagPayloadCRC + 1)},
+		}}
+
+		if !blob.OK(t.payload, PayloadZero.CRC) {
+			return errors.New("bad payload")
+		}
 	}
 	return nil
 }
@@ -47,11 +92,19 @@ func (t *HostMessage) Reset(kind uint64)  {
 	t.msg.Reset()
 
 	t.msg.Put(TagKind, kind)
+	t.payload = PayloadZero
+}
+
+// SetPayload seals data as the payload, it is not copied
+func (t *HostMessage) SetPayload(data []byte)  {
+	t.payload = blob.Seal(data, PayloadZero.CRC)
 }
 
 func (t *HostMessage) Blob(i int) blob.T {
-	misc.Assert(false) // unreachable
-	return blob.T{}
+	switch i {
+	case 0:		return t.payload
+	default:	panic("UNREACHABLE")
+	}
 }
 
 func (t *HostMessage) Put(tag, payload uint64)  {
@@ -62,6 +115,14 @@ func (t *HostMessage) Get(tag uint64) uint64 {
 	return t.msg.Get(tag)
 }
 
+func (t *HostMessage) Has(tag uint64) bool {
+	return t.msg.Has(tag)
+}
+
+func (t *HostMessage) GetDefault(tag, payload uint64) uint64 {
+	return t.msg.GetDefault(tag, payload)
+}
+
 func (t *HostMessage) CreateFirstReplica(
 	clusterId, extentType, extentId uint64, ep network.Endpoint)  {
 	t.Reset(KindCreateFirstReplica)
@@ -81,4 +142,31 @@ func (t *HostMessage) CreateExtraReplica(
 	t.Put(TagExtentID, uint64(extentId))
 	t.Put(TagEcrow, ecrow)
 	t.Put(TagParticipantID, participantId)
-}
\ No newline at end of file
+}
+
+func (t *HostMessage) GetTopology(clusterId uint64)  {
+	t.Reset(KindGetTopology)
+	t.Put(TagClusterID, clusterId)
+}
+
+func (t *HostMessage) Ping()  {
+	t.Reset(KindPing)
+}
+
+func (t *HostMessage) RemoveReplica(
+	clusterId, extentType, extentId uint64, participantId uint64)  {
+	t.Reset(KindRemoveReplica)
+	t.Put(TagClusterID, clusterId)
+	t.Put(TagExtentType, extentType)
+	t.Put(TagExtentID, extentId)
+	t.Put(TagParticipantID, participantId)
+}
+
+func (t *HostMessage) ListReplicas(clusterId uint64)  {
+	t.Reset(KindListReplicas)
+	t.Put(TagClusterID, clusterId)
+}
+
+func (t *HostMessage) GetStatus()  {
+	t.Reset(KindGetStatus)
+}
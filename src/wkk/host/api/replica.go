@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"wkk/common/serd"
+)
+
+// Replica is one replica a host keeps
+type Replica struct {
+	ExtentType    uint64
+	ExtentId      uint64
+	Ecrow         uint64
+	ParticipantId uint64
+}
+
+var ErrReplicas = errors.New("bad replicas")
+
+// SerializeReplicas appends nreplicas3 | (extentType8 | extentId8 | ecrow8 | participantId8)...
+func SerializeReplicas(dst []byte, replicas []Replica) []byte {
+	dst = serd.Append24BE(dst, len(replicas))
+
+	for _, r := range replicas {
+		dst = serd.Append64BE(dst, r.ExtentType)
+		dst = serd.Append64BE(dst, r.ExtentId)
+		dst = serd.Append64BE(dst, r.Ecrow)
+		dst = serd.Append64BE(dst, r.ParticipantId)
+	}
+	return dst
+}
+
+func DeserializeReplicas(src []byte) ([]Replica, error) {
+	if len(src) < 3 {
+		return nil, ErrReplicas
+	}
+	n, src, _ := serd.Get64BE(3, src)
+
+	if uint64(len(src)) != n * 32 {
+		return nil, ErrReplicas
+	}
+
+	replicas := make([]Replica, n)
+	for i := range replicas {
+		r := &replicas[i]
+		r.ExtentType, src, _ = serd.Get64BE(8, src)
+		r.ExtentId, src, _ = serd.Get64BE(8, src)
+		r.Ecrow, src, _ = serd.Get64BE(8, src)
+		r.ParticipantId, src, _ = serd.Get64BE(8, src)
+	}
+	return replicas, nil
+}
+
+// Status of a host, space in bytes
+type Status struct {
+	ClusterId uint64
+	Capacity  uint64
+	Used      uint64
+	NReplicas int
+}
+
+func (s Status) Free() uint64 {
+	if s.Used > s.Capacity {
+		return 0
+	}
+	return s.Capacity - s.Used
+}
+
+// NoSpace tells the host has no room left, new replicas fail NoSpace
+func (s Status) NoSpace() bool {
+	return s.Free() == 0
+}
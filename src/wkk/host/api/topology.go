@@ -0,0 +1,113 @@
+package api
+
+import (
+	"errors"
+	"sort"
+	"wkk/common/misc"
+	"wkk/common/serd"
+	"wkk/network"
+)
+
+// Extent owns the hints from Low to High, both included, its replicas
+// serve them, Leader first.
+type Extent struct {
+	ExtentId uint64
+	Low      uint64
+	High     uint64
+	Leader   int
+	Replicas network.EndpointList
+}
+
+// Topology tells the extents of a cluster by Low, they do not overlap,
+// gaps are left to hashing. Version grows with every change.
+type Topology struct {
+	Version uint64
+	Extents []Extent
+}
+
+var ErrTopology = errors.New("bad topology")
+
+const MaxReplicas = 255
+
+// Serialize appends the extents,
+// nextents3 | (extentId8 | low8 | high8 | leader1 | nreplicas1 | (addr4 | port2)...)...
+func (t *Topology) Serialize(dst []byte) []byte {
+	dst = serd.Append24BE(dst, len(t.Extents))
+
+	for i := range t.Extents {
+		ext := &t.Extents[i]
+		misc.Assert(len(ext.Replicas) <= MaxReplicas)
+
+		dst = serd.Append64BE(dst, ext.ExtentId)
+		dst = serd.Append64BE(dst, ext.Low)
+		dst = serd.Append64BE(dst, ext.High)
+		dst = append(dst, byte(ext.Leader), byte(len(ext.Replicas)))
+
+		for _, ep := range ext.Replicas {
+			addr := ep.IpU32()
+			dst = append(dst, byte(addr >> 24), byte(addr >> 16), byte(addr >> 8), byte(addr),
+				byte(ep.Port >> 8), byte(ep.Port))
+		}
+	}
+	return dst
+}
+
+// DeserializeTopology undoes Serialize, it checks extents are sorted,
+// disjoint and led by one of their replicas
+func DeserializeTopology(version uint64, src []byte) (*Topology, error) {
+	t := &Topology{Version: version}
+
+	if len(src) < 3 {
+		return nil, ErrTopology
+	}
+	n, src, _ := serd.Get64BE(3, src)
+
+	for i := uint64(0); i < n; i += 1 {
+		if len(src) < 8 + 8 + 8 + 1 + 1 {
+			return nil, ErrTopology
+		}
+
+		var ext Extent
+		ext.ExtentId, src, _ = serd.Get64BE(8, src)
+		ext.Low, src, _ = serd.Get64BE(8, src)
+		ext.High, src, _ = serd.Get64BE(8, src)
+		ext.Leader = int(src[0])
+		nreplicas := int(src[1])
+		src = src[2:]
+
+		if len(src) < nreplicas * 6 {
+			return nil, ErrTopology
+		}
+		for k := 0; k < nreplicas; k += 1 {
+			addr, _, _ := serd.Get64BE(4, src)
+			port, _, _ := serd.Get64BE(2, src[4:])
+			ext.Replicas = append(ext.Replicas, network.MkEndpoint(uint32(addr), int(port)))
+			src = src[6:]
+		}
+
+		if ext.Low > ext.High || ext.Leader >= nreplicas {
+			return nil, ErrTopology
+		}
+		if k := len(t.Extents); k > 0 && t.Extents[k-1].High >= ext.Low {
+			return nil, ErrTopology
+		}
+		t.Extents = append(t.Extents, ext)
+	}
+
+	if len(src) != 0 {
+		return nil, ErrTopology
+	}
+	return t, nil
+}
+
+// Lookup finds the extent of hint, nil for none
+func (t *Topology) Lookup(hint uint64) *Extent {
+	i := sort.Search(len(t.Extents), func(i int) bool {
+		return t.Extents[i].High >= hint
+	})
+
+	if i < len(t.Extents) && t.Extents[i].Low <= hint {
+		return &t.Extents[i]
+	}
+	return nil
+}
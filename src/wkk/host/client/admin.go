@@ -0,0 +1,109 @@
+package client
+
+import (
+    "errors"
+    "fmt"
+    "sync"
+    "time"
+    "wkk/host/api"
+    "wkk/network"
+)
+
+var ErrWrongCluster = errors.New("wrong cluster")
+
+type PingResult struct {
+    ClusterId uint64
+    RTT       time.Duration
+}
+
+func (hcm *HostCM) Ping(deadline time.Time, ep network.Endpoint) (PingResult, error) {
+    hr := NewHostR()
+    hr.Ping(deadline)
+
+    start := time.Now()
+    if err := hcm.RPC(hr, ep); err != nil {
+        return PingResult{}, err
+    }
+    rtt := time.Since(start)
+
+    clusterId, err := hr.ClusterId()
+    if err != nil {
+        return PingResult{}, err
+    }
+    return PingResult{ClusterId: clusterId, RTT: rtt}, nil
+}
+
+// VerifyCluster fails ErrWrongCluster unless ep is a host of clusterId
+func (hcm *HostCM) VerifyCluster(deadline time.Time, ep network.Endpoint, clusterId uint64) error {
+    pr, err := hcm.Ping(deadline, ep)
+    if err != nil {
+        return err
+    }
+
+    if pr.ClusterId != clusterId {
+        return fmt.Errorf("%v is of cluster %d, not %d: %w", ep, pr.ClusterId, clusterId, ErrWrongCluster)
+    }
+    return nil
+}
+
+func (hcm *HostCM) CreateFirstReplica(deadline time.Time, ep network.Endpoint,
+    clusterId, extentType, extentId uint64, nominal network.Endpoint) error {
+    hr := NewHostR()
+    hr.CreateFirstReplica(deadline, clusterId, extentType, extentId, nominal)
+    return hcm.RPC(hr, ep)
+}
+
+func (hcm *HostCM) CreateExtraReplica(deadline time.Time, ep network.Endpoint,
+    clusterId, extentType, extentId uint64, ecrow, participantId uint64) error {
+    hr := NewHostR()
+    hr.CreateExtraReplica(deadline, clusterId, extentType, extentId, ecrow, participantId)
+    return hcm.RPC(hr, ep)
+}
+
+func (hcm *HostCM) RemoveReplica(deadline time.Time, ep network.Endpoint,
+    clusterId, extentType, extentId uint64, participantId uint64) error {
+    hr := NewHostR()
+    hr.RemoveReplica(deadline, clusterId, extentType, extentId, participantId)
+    return hcm.RPC(hr, ep)
+}
+
+func (hcm *HostCM) ListReplicas(deadline time.Time, ep network.Endpoint, clusterId uint64) ([]api.Replica, error) {
+    hr := NewHostR()
+    hr.ListReplicas(deadline, clusterId)
+
+    if err := hcm.RPC(hr, ep); err != nil {
+        return nil, err
+    }
+    return hr.Replicas()
+}
+
+func (hcm *HostCM) Status(deadline time.Time, ep network.Endpoint) (api.Status, error) {
+    hr := NewHostR()
+    hr.GetStatus(deadline)
+
+    if err := hcm.RPC(hr, ep); err != nil {
+        return api.Status{}, err
+    }
+    return hr.Status()
+}
+
+// FanOut calls fn for every host at once, results and errors are by host,
+// e.g. FanOut(hosts, func(ep network.Endpoint) (api.Status, error) {
+//     return hcm.Status(deadline, ep)
+// })
+func FanOut[T any](hosts network.EndpointList, fn func(ep network.Endpoint) (T, error)) ([]T, []error) {
+    results := make([]T, len(hosts))
+    errs := make([]error, len(hosts))
+
+    var wg sync.WaitGroup
+    for i, ep := range hosts {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            results[i], errs[i] = fn(ep)
+        }()
+    }
+    wg.Wait()
+
+    return results, errs
+}
@@ -0,0 +1,114 @@
+package client_test
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "time"
+    "wkk/common/misc"
+    "wkk/host/api"
+    "wkk/host/client"
+    "wkk/host/host-fake"
+    "wkk/network"
+)
+
+func Test0(t *testing.T) {
+    var hosts network.EndpointList
+    var servers []*host_fake.Server
+
+    for _, clusterId := range []uint64{7, 7, 8} {
+        server, err := host_fake.NewServer(clusterId)
+        misc.AssertNilError(err)
+        defer server.Close()
+
+        server.Capacity, server.ReplicaSize = 2 << 30, 1 << 30
+        hosts, servers = append(hosts, server.Endpoint()), append(servers, server)
+    }
+
+    hcm := client.NewHostCM()
+    deadline := time.Now().Add(time.Second)
+
+    pr, err := hcm.Ping(deadline, hosts[0])
+    misc.Assert(err == nil && pr.ClusterId == 7 && pr.RTT > 0 && pr.RTT < time.Second)
+
+    misc.AssertNilError(hcm.VerifyCluster(deadline, hosts[1], 7))
+    misc.Assert(errors.Is(hcm.VerifyCluster(deadline, hosts[2], 7), client.ErrWrongCluster))
+
+    // two replicas fit, the third does not
+    misc.AssertNilError(hcm.CreateFirstReplica(deadline, hosts[0], 7, 1, 100, hosts[0]))
+    misc.AssertNilError(hcm.CreateExtraReplica(deadline, hosts[0], 7, 1, 101, 3, 2))
+    misc.Assert(hcm.CreateExtraReplica(deadline, hosts[0], 7, 1, 101, 3, 2) == api.Inval)
+    misc.Assert(hcm.CreateExtraReplica(deadline, hosts[0], 7, 1, 102, 3, 2) == api.NoSpace)
+    misc.Assert(hcm.CreateFirstReplica(deadline, hosts[2], 7, 1, 100, hosts[2]) == api.Inval)
+
+    status, err := hcm.Status(deadline, hosts[0])
+    misc.Assert(err == nil && status.NReplicas == 2 && status.Used == 2 << 30 && status.NoSpace())
+
+    replicas, err := hcm.ListReplicas(deadline, hosts[0], 7)
+    misc.Assert(err == nil && len(replicas) == 2 && replicas[1] == api.Replica{
+        ExtentType: 1, ExtentId: 101, Ecrow: 3, ParticipantId: 2})
+
+    misc.Assert(hcm.RemoveReplica(deadline, hosts[0], 7, 1, 101, 1) == api.Inval)
+    misc.AssertNilError(hcm.RemoveReplica(deadline, hosts[0], 7, 1, 101, 2))
+    misc.Assert(len(servers[0].Replicas()) == 1)
+
+    status, err = hcm.Status(deadline, hosts[0])
+    misc.Assert(err == nil && status.Free() == 1 << 30 && !status.NoSpace())
+
+    // all hosts at once
+    statuses, errs := client.FanOut(hosts, func(ep network.Endpoint) (api.Status, error) {
+        return hcm.Status(deadline, ep)
+    })
+    for i := range hosts {
+        misc.AssertNilError(errs[i])
+    }
+    misc.Assert(statuses[0].NReplicas == 1 && statuses[1].NReplicas == 0 && statuses[2].ClusterId == 8)
+
+    servers[1].Close()
+    _, errs = client.FanOut(hosts, func(ep network.Endpoint) (client.PingResult, error) {
+        return hcm.Ping(time.Now().Add(100 * time.Millisecond), ep)
+    })
+    misc.Assert(errs[0] == nil && errs[1] != nil && errs[2] == nil)
+}
+
+func Test1(t *testing.T) {
+    server, err := host_fake.NewServer(7)
+    misc.AssertNilError(err)
+    defer server.Close()
+    server.SetPeer(network.Peer{})  // older, tells nothing
+
+    hcm := client.NewHostCM()
+    ep := server.Endpoint()
+    deadline := time.Now().Add(time.Second)
+
+    _, ok := hcm.Peer(ep)
+    misc.Assert(!ok)
+
+    _, err = hcm.Ping(deadline, ep)
+    misc.AssertNilError(err)
+    peer, ok := hcm.Peer(ep)
+    misc.Assert(ok && peer.Version == 0 && !peer.Has(api.FeatureAdmin))
+
+    // refused before sending
+    _, err = hcm.ListReplicas(deadline, ep, 7)
+    misc.Assert(errors.Is(err, network.ErrVersion) && server.NReq(api.KindListReplicas) == 0)
+    misc.Assert(strings.Contains(err.Error(), "misses 0x2"))
+
+    server.SetPeer(network.Peer{Version: network.Version, Features: api.Features})
+    _, err = hcm.Ping(deadline, ep)
+    misc.AssertNilError(err)
+    _, err = hcm.ListReplicas(deadline, ep, 7)
+    misc.AssertNilError(err)
+
+    // frames of newer versions that do not parse tell so
+    for _, version := range []uint64{network.Version, network.Version + 1} {
+        var msg, msg1 api.HostMessage
+        msg.Ping()
+        msg.PutHdr1(deadline, 1, 2, network.Peer{Version: version})
+
+        src := msg.Serialize(make([]byte, api.SerializeSize))
+        src[len(src)-1] ^= 0xff
+        err := msg1.Deserialize(src)
+        misc.Assert(err != nil && errors.Is(err, network.ErrVersion) == (version > network.Version))
+    }
+}
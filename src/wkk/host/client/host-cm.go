@@ -1,6 +1,7 @@
 package client
 
 import (
+	"fmt"
 	"time"
 	"wkk/common/misc"
 	"wkk/host/api"
@@ -17,7 +18,13 @@ func NewHostCM() *HostCM {
     }
 }
 
+// RPC fails a network.VersionError, before sending, to hosts known to
+// miss the features of the request
 func (hcm *HostCM) RPC(hr *HostR, ep network.Endpoint) error {
+    if err := network.Require(hcm.net, ep, api.Needs(hr.req.Get(api.TagKind))); err != nil {
+        return err
+    }
+
     if err := hcm.net.RPC(hr, ep); err != nil {
         return err
     }
@@ -92,4 +99,90 @@ func (r *HostR) CreateExtraReplica(deadline time.Time,
     r.deadline  = deadline
 
     r.req.CreateExtraReplica(clusterId, extentType, extentId, ecrow, participantId)
-}
\ No newline at end of file
+}
+
+func (r *HostR) GetTopology(deadline time.Time, clusterId uint64)  {
+    r.requestId = 0
+    r.deadline  = deadline
+
+    r.req.GetTopology(clusterId)
+}
+
+// Topology decodes the response of GetTopology
+func (r *HostR) Topology() (*api.Topology, error) {
+    if err := r.need(api.TagTopologyVersion); err != nil {
+        return nil, err
+    }
+    return api.DeserializeTopology(r.resp.Get(api.TagTopologyVersion), r.resp.Blob(0).Data)
+}
+
+func (r *HostR) Ping(deadline time.Time)  {
+    r.requestId = 0
+    r.deadline  = deadline
+
+    r.req.Ping()
+}
+
+func (r *HostR) RemoveReplica(deadline time.Time,
+    clusterId, extentType, extentId uint64, participantId uint64) {
+    r.requestId = 0
+    r.deadline  = deadline
+
+    r.req.RemoveReplica(clusterId, extentType, extentId, participantId)
+}
+
+func (r *HostR) ListReplicas(deadline time.Time, clusterId uint64)  {
+    r.requestId = 0
+    r.deadline  = deadline
+
+    r.req.ListReplicas(clusterId)
+}
+
+func (r *HostR) GetStatus(deadline time.Time)  {
+    r.requestId = 0
+    r.deadline  = deadline
+
+    r.req.GetStatus()
+}
+
+// ClusterId the host answered Ping or GetStatus with
+func (r *HostR) ClusterId() (uint64, error) {
+    if err := r.need(api.TagClusterID); err != nil {
+        return 0, err
+    }
+    return r.resp.Get(api.TagClusterID), nil
+}
+
+// Replicas decodes the response of ListReplicas
+func (r *HostR) Replicas() ([]api.Replica, error) {
+    return api.DeserializeReplicas(r.resp.Blob(0).Data)
+}
+
+// Status decodes the response of GetStatus
+func (r *HostR) Status() (api.Status, error) {
+    if err := r.need(api.TagClusterID, api.TagCapacity, api.TagUsed, api.TagNReplicas); err != nil {
+        return api.Status{}, err
+    }
+
+    return api.Status{
+        ClusterId: r.resp.Get(api.TagClusterID),
+        Capacity:  r.resp.Get(api.TagCapacity),
+        Used:      r.resp.Get(api.TagUsed),
+        NReplicas: int(r.resp.Get(api.TagNReplicas)),
+    }, nil
+}
+
+// need fails api.ErrMissing unless the response has all of tags
+func (r *HostR) need(tags ...uint64) error {
+    for _, tag := range tags {
+        if !r.resp.Has(tag) {
+            return fmt.Errorf("kind %#x tag %#x: %w", r.resp.GetDefault(api.TagKind, 0), tag, api.ErrMissing)
+        }
+    }
+    return nil
+}
+
+// Peer is what the host at ep told of itself, see network.CM
+func (hcm *HostCM) Peer(ep network.Endpoint) (network.Peer, bool) {
+    return hcm.net.Peer(ep)
+}
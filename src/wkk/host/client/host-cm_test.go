@@ -0,0 +1,31 @@
+package client
+
+import (
+    "errors"
+    "strings"
+    "testing"
+    "wkk/common/misc"
+    "wkk/host/api"
+    "wkk/network"
+)
+
+// responses of older hosts lacking tags fail typed, never panic
+func Test2(t *testing.T) {
+    hr := NewHostR()
+    hr.resp.Reset(api.KindPing | network.KindBitResponse)
+
+    _, err := hr.ClusterId()
+    misc.Assert(errors.Is(err, api.ErrMissing))
+    _, err = hr.Status()
+    misc.Assert(errors.Is(err, api.ErrMissing))
+    _, err = hr.Topology()
+    misc.Assert(errors.Is(err, api.ErrMissing))
+
+    hr.resp.Put(api.TagClusterID, 7)
+    clusterId, err := hr.ClusterId()
+    misc.Assert(err == nil && clusterId == 7)
+    _, err = hr.Status()
+    misc.Assert(errors.Is(err, api.ErrMissing) && strings.Contains(err.Error(), "tag 0x"))
+
+    misc.Assert(strings.Contains(api.Outcome(42).Error(), "42"))
+}
@@ -0,0 +1,425 @@
+package host_bootstrap
+
+import (
+    "cmp"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "slices"
+    "time"
+    "wkk/host/api"
+    "wkk/host/client"
+    "wkk/network"
+)
+
+// Spec declares a cluster, hosts by nominal endpoint. Every extent gets
+// Replication replicas unless it tells otherwise, on the hosts it pins
+// first, then on the least loaded hosts that meet the constraints.
+type Spec struct {
+    ClusterId   uint64       `json:"cluster"`
+    Hosts       []string     `json:"hosts"`
+    Replication int          `json:"replication"`
+    Extents     []ExtentSpec `json:"extents"`
+    Constraints Constraints  `json:"constraints"`
+}
+
+type ExtentSpec struct {
+    Type        uint64   `json:"type"`
+    Id          uint64   `json:"id"`
+    Replication int      `json:"replication,omitempty"`
+    Hosts       []string `json:"hosts,omitempty"`
+}
+
+type Constraints struct {
+    // replicas a host keeps at most, 0 for no bound
+    MaxPerHost int `json:"max_per_host,omitempty"`
+
+    // hosts taking no new replicas
+    Exclude []string `json:"exclude,omitempty"`
+
+    // zones by host, replicas of an extent go to distinct zones while
+    // there are any left
+    Zones map[string]string `json:"zones,omitempty"`
+}
+
+var (
+    ErrSpec        = errors.New("bad spec")
+    ErrUnplaceable = errors.New("unplaceable")
+)
+
+// LoadSpec reads a JSON spec, unknown fields are refused
+func LoadSpec(r io.Reader) (*Spec, error) {
+    var spec Spec
+
+    dec := json.NewDecoder(r)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&spec); err != nil {
+        return nil, fmt.Errorf("%v: %w", err, ErrSpec)
+    }
+    if err := spec.Validate(); err != nil {
+        return nil, err
+    }
+    return &spec, nil
+}
+
+func (s *Spec) Validate() error {
+    bad := func(format string, args ...any) error {
+        return fmt.Errorf(format + ": %w", append(args, ErrSpec)...)
+    }
+
+    if len(s.Hosts) == 0 || s.Replication < 1 {
+        return bad("no hosts or replication")
+    }
+
+    hosts := make(map[string]bool)
+    for _, h := range s.Hosts {
+        var ep network.Endpoint
+        if err := ep.Set(h); err != nil {
+            return bad("host %s: %v", h, err)
+        }
+        if hosts[h] {
+            return bad("host %s twice", h)
+        }
+        hosts[h] = true
+    }
+
+    known := func(what string, hs []string) error {
+        for _, h := range hs {
+            if !hosts[h] {
+                return bad("%s host %s is not of hosts", what, h)
+            }
+        }
+        return nil
+    }
+    if err := known("excluded", s.Constraints.Exclude); err != nil {
+        return err
+    }
+    for h := range s.Constraints.Zones {
+        if err := known("zoned", []string{h}); err != nil {
+            return err
+        }
+    }
+
+    usable := len(s.Hosts) - len(s.Constraints.Exclude)
+    extents := make(map[[2]uint64]bool)
+    for _, ext := range s.Extents {
+        if extents[[2]uint64{ext.Type, ext.Id}] {
+            return bad("extent %d/%d twice", ext.Type, ext.Id)
+        }
+        extents[[2]uint64{ext.Type, ext.Id}] = true
+
+        if err := known(fmt.Sprintf("extent %d/%d", ext.Type, ext.Id), ext.Hosts); err != nil {
+            return err
+        }
+        for _, h := range ext.Hosts {
+            if slices.Contains(s.Constraints.Exclude, h) {
+                return bad("extent %d/%d pins excluded host %s", ext.Type, ext.Id, h)
+            }
+        }
+
+        if n := s.replication(ext); n < len(ext.Hosts) || n > usable {
+            return bad("extent %d/%d takes %d replicas, pins %d, %d hosts usable",
+                ext.Type, ext.Id, n, len(ext.Hosts), usable)
+        }
+    }
+    return nil
+}
+
+func (s *Spec) replication(ext ExtentSpec) int {
+    if ext.Replication > 0 {
+        return ext.Replication
+    }
+    return s.Replication
+}
+
+const (
+    CreateFirst = "create-first"
+    CreateExtra = "create-extra"
+    Remove      = "remove"
+)
+
+// Action is one host request, Host is the nominal endpoint of the spec
+type Action struct {
+    Kind          string `json:"kind"`
+    Host          string `json:"host"`
+    ExtentType    uint64 `json:"type"`
+    ExtentId      uint64 `json:"extent"`
+    Ecrow         uint64 `json:"ecrow"`
+    ParticipantId uint64 `json:"participant"`
+}
+
+// Reconciler brings the hosts of Spec to it. Live replicas stay where
+// they are, missing ones are created, an extra as the participant after
+// the highest, at the ecrow of the same number. Replicas beyond the spec
+// are removed only with Prune.
+type Reconciler struct {
+    HCM  *client.HostCM
+    Spec *Spec
+
+    Prune    bool
+    Deadline time.Duration	// of every request
+    Attempts int
+    Backoff  time.Duration	// doubles every attempt
+}
+
+func NewReconciler(hcm *client.HostCM, spec *Spec) *Reconciler {
+    return &Reconciler{
+        HCM:      hcm,
+        Spec:     spec,
+        Deadline: time.Second,
+        Attempts: 5,
+        Backoff:  10 * time.Millisecond,
+    }
+}
+
+func (r *Reconciler) endpoints() network.EndpointList {
+    var epl network.EndpointList
+
+    for _, h := range r.Spec.Hosts {
+        var ep network.Endpoint
+        _ = ep.Set(h)
+        epl = append(epl, ep)
+    }
+    return epl.Delta(api.PortDelta)
+}
+
+// Live lists the replicas of the cluster by host, every host must be of
+// the cluster and answer
+func (r *Reconciler) Live() ([][]api.Replica, error) {
+    epl := r.endpoints()
+    deadline := time.Now().Add(r.Deadline)
+
+    _, errs := client.FanOut(epl, func(ep network.Endpoint) (struct{}, error) {
+        return struct{}{}, r.HCM.VerifyCluster(deadline, ep, r.Spec.ClusterId)
+    })
+    lists, errs1 := client.FanOut(epl, func(ep network.Endpoint) ([]api.Replica, error) {
+        return r.HCM.ListReplicas(deadline, ep, r.Spec.ClusterId)
+    })
+
+    for i := range epl {
+        if err := errors.Join(errs[i], errs1[i]); err != nil {
+            return nil, fmt.Errorf("%s: %w", r.Spec.Hosts[i], err)
+        }
+    }
+    return lists, nil
+}
+
+// Plan tells the actions to take, in order, nothing once reconciled
+func (r *Reconciler) Plan() ([]Action, error) {
+    live, err := r.Live()
+    if err != nil {
+        return nil, err
+    }
+    return plan(r.Spec, live, r.Prune)
+}
+
+type holder struct {
+    host          int
+    participantId uint64
+}
+
+func plan(spec *Spec, live [][]api.Replica, prune bool) ([]Action, error) {
+    var actions []Action
+    load := make([]int, len(spec.Hosts))
+    holders := make(map[[2]uint64][]holder)
+
+    for i, replicas := range live {
+        load[i] = len(replicas)
+        for _, rep := range replicas {
+            key := [2]uint64{rep.ExtentType, rep.ExtentId}
+            holders[key] = append(holders[key], holder{i, rep.ParticipantId})
+        }
+    }
+
+    remove := func(key [2]uint64, hs []holder) {
+        for _, h := range hs {
+            actions = append(actions, Action{Kind: Remove, Host: spec.Hosts[h.host],
+                ExtentType: key[0], ExtentId: key[1], ParticipantId: h.participantId})
+            load[h.host] -= 1
+        }
+    }
+
+    for _, ext := range spec.Extents {
+        key := [2]uint64{ext.Type, ext.Id}
+        have, want := holders[key], spec.replication(ext)
+        delete(holders, key)
+
+        // surplus, the latest participants go
+        slices.SortFunc(have, func(a, b holder) int {
+            return cmp.Compare(a.participantId, b.participantId)
+        })
+        if len(have) > want {
+            if prune {
+                remove(key, have[want:])
+            }
+            continue
+        }
+
+        next := uint64(0)
+        if len(have) > 0 {
+            next = have[len(have)-1].participantId + 1
+        }
+
+        for len(have) < want {
+            i := choose(spec, ext, have, load)
+            if i < 0 {
+                return nil, fmt.Errorf("extent %d/%d: %w", ext.Type, ext.Id, ErrUnplaceable)
+            }
+
+            kind := CreateExtra
+            if len(have) == 0 {
+                kind = CreateFirst
+            }
+            actions = append(actions, Action{Kind: kind, Host: spec.Hosts[i],
+                ExtentType: ext.Type, ExtentId: ext.Id, Ecrow: next, ParticipantId: next})
+
+            have, load[i], next = append(have, holder{i, next}), load[i] + 1, next + 1
+        }
+    }
+
+    // extents out of the spec
+    if prune {
+        for _, ext := range sortedKeys(holders) {
+            remove(ext, holders[ext])
+        }
+    }
+    return actions, nil
+}
+
+func sortedKeys(m map[[2]uint64][]holder) [][2]uint64 {
+    var keys [][2]uint64
+    for k := range m {
+        keys = append(keys, k)
+    }
+    slices.SortFunc(keys, func(a, b [2]uint64) int {
+        return cmp.Or(cmp.Compare(a[0], b[0]), cmp.Compare(a[1], b[1]))
+    })
+    return keys
+}
+
+// choose picks the host of the next replica of ext, pinned hosts first,
+// then the least loaded in a zone new to ext, then in any zone, -1 for
+// none left
+func choose(spec *Spec, ext ExtentSpec, have []holder, load []int) int {
+    zones := spec.Constraints.Zones
+    used := make(map[string]bool)
+    taken := make([]bool, len(spec.Hosts))
+
+    for _, h := range have {
+        taken[h.host] = true
+        if zone, ok := zones[spec.Hosts[h.host]]; ok {
+            used[zone] = true
+        }
+    }
+
+    eligible := func(i int) bool {
+        max := spec.Constraints.MaxPerHost
+        return !taken[i] && !slices.Contains(spec.Constraints.Exclude, spec.Hosts[i]) &&
+            (max == 0 || load[i] < max)
+    }
+
+    for _, h := range ext.Hosts {
+        if i := slices.Index(spec.Hosts, h); eligible(i) {
+            return i
+        }
+    }
+
+    for _, spread := range []bool{true, false} {
+        best := -1
+        for i := range spec.Hosts {
+            zone, ok := zones[spec.Hosts[i]]
+            if !eligible(i) || (spread && ok && used[zone]) {
+                continue
+            }
+            if best < 0 || load[i] < load[best] {
+                best = i
+            }
+        }
+        if best >= 0 {
+            return best
+        }
+    }
+    return -1
+}
+
+// Apply takes the actions in order, each retried on timeouts and broken
+// connections. Inval after a retry is taken for done when the hosts
+// tell so, the attempt before it made it.
+func (r *Reconciler) Apply(actions []Action) error {
+    for _, a := range actions {
+        if err := r.apply(a); err != nil {
+            return fmt.Errorf("%s %d/%d on %s: %w", a.Kind, a.ExtentType, a.ExtentId, a.Host, err)
+        }
+    }
+    return nil
+}
+
+// Reconcile plans and applies, running it again plans nothing
+func (r *Reconciler) Reconcile() ([]Action, error) {
+    actions, err := r.Plan()
+    if err != nil {
+        return nil, err
+    }
+    return actions, r.Apply(actions)
+}
+
+func (r *Reconciler) apply(a Action) error {
+    var ep network.Endpoint
+    if err := ep.Set(a.Host); err != nil {
+        return err
+    }
+    nominal, ep := ep, ep.Delta(api.PortDelta)
+
+    var err error
+    backoff := r.Backoff
+
+    for k := 0; k < r.Attempts; k += 1 {
+        if k > 0 {
+            time.Sleep(backoff)
+            backoff *= 2
+        }
+
+        deadline := time.Now().Add(r.Deadline)
+        switch a.Kind {
+        case CreateFirst:
+            err = r.HCM.CreateFirstReplica(deadline, ep, r.Spec.ClusterId, a.ExtentType, a.ExtentId, nominal)
+        case CreateExtra:
+            err = r.HCM.CreateExtraReplica(deadline, ep, r.Spec.ClusterId, a.ExtentType, a.ExtentId,
+                a.Ecrow, a.ParticipantId)
+        case Remove:
+            err = r.HCM.RemoveReplica(deadline, ep, r.Spec.ClusterId, a.ExtentType, a.ExtentId, a.ParticipantId)
+        default:
+            return fmt.Errorf("action %q: %w", a.Kind, ErrSpec)
+        }
+
+        switch {
+        case err == nil:
+            return nil
+        case err == api.Inval && k > 0:
+            if done, err1 := r.done(ep, a); err1 == nil && done {
+                return nil
+            }
+            return err
+        case err == api.Timeout:
+        case errors.As(err, new(api.Outcome)):
+            return err
+        }
+    }
+    return err
+}
+
+// done tells whether the host keeps, or for Remove does not keep, the
+// replica of a
+func (r *Reconciler) done(ep network.Endpoint, a Action) (bool, error) {
+    replicas, err := r.HCM.ListReplicas(time.Now().Add(r.Deadline), ep, r.Spec.ClusterId)
+    if err != nil {
+        return false, err
+    }
+
+    keeps := slices.ContainsFunc(replicas, func(rep api.Replica) bool {
+        return rep.ExtentType == a.ExtentType && rep.ExtentId == a.ExtentId &&
+            rep.ParticipantId == a.ParticipantId
+    })
+    return keeps == (a.Kind != Remove), nil
+}
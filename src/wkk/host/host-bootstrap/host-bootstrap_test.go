@@ -0,0 +1,128 @@
+package host_bootstrap_test
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+    "wkk/common/misc"
+    "wkk/host/api"
+    "wkk/host/client"
+    "wkk/host/host-bootstrap"
+    "wkk/host/host-fake"
+)
+
+func Test0(t *testing.T) {
+    var servers []*host_fake.Server
+    var hosts []string
+
+    for i := 0; i < 4; i += 1 {
+        server, err := host_fake.NewServer(9)
+        misc.AssertNilError(err)
+        defer server.Close()
+        servers, hosts = append(servers, server), append(hosts, server.Endpoint().Delta(-api.PortDelta).String())
+    }
+    hcm := client.NewHostCM()
+    deadline := time.Now().Add(time.Second)
+
+    // 1/101 made by hand, 1/999 is not of the spec
+    misc.AssertNilError(hcm.CreateFirstReplica(deadline, servers[1].Endpoint(), 9, 1, 101, servers[1].Endpoint()))
+    misc.AssertNilError(hcm.CreateFirstReplica(deadline, servers[1].Endpoint(), 9, 1, 999, servers[1].Endpoint()))
+
+    spec, err := host_bootstrap.LoadSpec(strings.NewReader(fmt.Sprintf(`{
+        "cluster": 9,
+        "hosts": ["%s", "%s", "%s", "%s"],
+        "replication": 2,
+        "extents": [
+            {"type": 1, "id": 100, "hosts": ["%s"]},
+            {"type": 1, "id": 101},
+            {"type": 1, "id": 102},
+            {"type": 1, "id": 103, "replication": 3}
+        ],
+        "constraints": {
+            "max_per_host": 3,
+            "zones": {"%s": "a", "%s": "a", "%s": "b", "%s": "b"}
+        }
+    }`, hosts[0], hosts[1], hosts[2], hosts[3], hosts[3], hosts[0], hosts[1], hosts[2], hosts[3])))
+    misc.AssertNilError(err)
+
+    r := host_bootstrap.NewReconciler(hcm, spec)
+    actions, err := r.Plan()
+    misc.AssertNilError(err)
+    misc.Assert(len(actions) == 8)
+    misc.Assert(actions[0] == host_bootstrap.Action{Kind: host_bootstrap.CreateFirst, Host: hosts[3],
+        ExtentType: 1, ExtentId: 100})
+    misc.Assert(actions[1] == host_bootstrap.Action{Kind: host_bootstrap.CreateExtra, Host: hosts[0],
+        ExtentType: 1, ExtentId: 100, Ecrow: 1, ParticipantId: 1})
+    misc.Assert(actions[2].ExtentId == 101 && actions[2].ParticipantId == 1 && actions[2].Host == hosts[2])
+
+    // the first create on host 2 is served but its response lost
+    lost := 1
+    servers[2].Inject(func(kind uint64) (api.Outcome, bool) {
+        if kind == api.KindCreateExtraReplica && lost > 0 {
+            lost -= 1
+            return api.Timeout, true
+        }
+        return api.OK, true
+    })
+    _, err = r.Reconcile()
+    misc.AssertNilError(err)
+
+    // replicas of an extent in distinct zones, 3 per host at most
+    zone := map[int]string{0: "a", 1: "a", 2: "b", 3: "b"}
+    zones := make(map[uint64]map[string]int)
+    for i, server := range servers {
+        misc.Assert(len(server.Replicas()) <= 3)
+        for _, rep := range server.Replicas() {
+            if zones[rep.ExtentId] == nil {
+                zones[rep.ExtentId] = make(map[string]int)
+            }
+            zones[rep.ExtentId][zone[i]] += 1
+        }
+    }
+    for _, extentId := range []uint64{100, 101, 102} {
+        misc.Assert(zones[extentId]["a"] == 1 && zones[extentId]["b"] == 1)
+    }
+    misc.Assert(zones[103]["a"] + zones[103]["b"] == 3)
+
+    // idempotent, 1/999 goes with Prune only
+    actions, err = r.Plan()
+    misc.Assert(err == nil && len(actions) == 0)
+
+    r.Prune = true
+    actions, err = r.Reconcile()
+    misc.Assert(err == nil && len(actions) == 1 && actions[0].Kind == host_bootstrap.Remove && actions[0].ExtentId == 999)
+    actions, err = r.Plan()
+    misc.Assert(err == nil && len(actions) == 0)
+
+    // fewer replicas, the latest participant goes
+    spec.Extents[3].Replication = 2
+    actions, err = r.Plan()
+    misc.Assert(err == nil && len(actions) == 1 && actions[0].ExtentId == 103 && actions[0].ParticipantId == 2)
+
+    // no room left
+    for extentId := uint64(104); extentId < 107; extentId += 1 {
+        spec.Extents = append(spec.Extents, host_bootstrap.ExtentSpec{Type: 1, Id: extentId})
+    }
+    _, err = r.Plan()
+    misc.Assert(errors.Is(err, host_bootstrap.ErrUnplaceable))
+
+    // bad specs
+    for _, s := range []string{
+        `{"cluster": 9, "hosts": ["127.0.0.1:1"], "replication": 1, "zone": {}}`,
+        `{"cluster": 9, "hosts": ["127.0.0.1:1"], "replication": 0}`,
+        `{"cluster": 9, "hosts": ["127.0.0.1:1", "127.0.0.1:1"], "replication": 1}`,
+        `{"cluster": 9, "hosts": ["127.0.0.1:1"], "replication": 2, "extents": [{"type": 1, "id": 1}]}`,
+        `{"cluster": 9, "hosts": ["127.0.0.1:1", "127.0.0.1:2"], "replication": 1,
+          "extents": [{"type": 1, "id": 1, "hosts": ["127.0.0.1:2"]}], "constraints": {"exclude": ["127.0.0.1:2"]}}`,
+    } {
+        _, err := host_bootstrap.LoadSpec(strings.NewReader(s))
+        misc.Assert(errors.Is(err, host_bootstrap.ErrSpec))
+    }
+
+    // another cluster
+    spec.ClusterId = 10
+    _, err = r.Plan()
+    misc.Assert(errors.Is(err, client.ErrWrongCluster))
+}
@@ -0,0 +1,258 @@
+package host_fake
+
+import (
+    "net"
+    "sync"
+    "time"
+    "wkk/host/api"
+    "wkk/network"
+)
+
+// Server answers host messages for tests. Every replica takes
+// ReplicaSize of Capacity, replicas beyond fail NoSpace.
+type Server struct {
+    ClusterId   uint64
+    Capacity    uint64
+    ReplicaSize uint64
+
+    listener net.Listener
+    mtx      sync.Mutex
+    topology *api.Topology
+    replicas []api.Replica
+    nreq     map[uint64]int
+    conns    map[net.Conn]struct{}
+    inject   func(kind uint64) (api.Outcome, bool)
+    peer     network.Peer
+}
+
+func NewServer(clusterId uint64) (*Server, error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+
+    s := &Server{
+        ClusterId:   clusterId,
+        Capacity:    1 << 40,
+        ReplicaSize: 1 << 30,
+        peer:        network.Peer{Version: network.Version, Features: api.Features},
+        listener:    listener,
+        topology:    &api.Topology{},
+        nreq:        make(map[uint64]int),
+        conns:       make(map[net.Conn]struct{}),
+    }
+    go s.accept()
+    return s, nil
+}
+
+func (s *Server) Endpoint() network.Endpoint {
+    return network.Endpoint(*s.listener.Addr().(*net.TCPAddr))
+}
+
+// Close stops listening and drops the connections, as a host down
+func (s *Server) Close() {
+    _ = s.listener.Close()
+
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    for conn := range s.conns {
+        _ = conn.Close()
+    }
+}
+
+// SetTopology is what GetTopology tells from now on
+func (s *Server) SetTopology(topology *api.Topology) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.topology = topology
+}
+
+// SetPeer is told in every response from now on, Version 0 for an
+// older host
+func (s *Server) SetPeer(peer network.Peer) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.peer = peer
+}
+
+// Inject is consulted on every request, an outcome other than OK to
+// answer with, and whether to serve the request all the same, as if the
+// response got lost.
+func (s *Server) Inject(inject func(kind uint64) (api.Outcome, bool)) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.inject = inject
+}
+
+// Replicas kept, in order of creation
+func (s *Server) Replicas() []api.Replica {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return append([]api.Replica{}, s.replicas...)
+}
+
+// NReq counts the requests received of kind
+func (s *Server) NReq(kind uint64) int {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.nreq[kind]
+}
+
+func (s *Server) accept() {
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+        go s.serve(conn)
+    }
+}
+
+func (s *Server) serve(conn net.Conn) {
+    s.mtx.Lock()
+    s.conns[conn] = struct{}{}
+    s.mtx.Unlock()
+
+    defer func() {
+        s.mtx.Lock()
+        delete(s.conns, conn)
+        s.mtx.Unlock()
+        _ = conn.Close()
+    }()
+
+    data := make([]byte, 2 * api.SerializeSize)
+
+    for avail := 0; ; {
+        n, err := conn.Read(data[avail:])
+        if err != nil {
+            return
+        }
+        avail += n
+
+        for {
+            n, _, _ := network.Consumable(data[:avail], api.WireMagic)
+            if n < 0 {
+                return
+            } else if n == 0 {
+                break
+            }
+
+            resp := s.handle(data[:n])
+            copy(data, data[n:avail])
+            avail -= n
+
+            if resp != nil {
+                if _, err := conn.Write(resp); err != nil {
+                    return
+                }
+            }
+        }
+    }
+}
+
+func (s *Server) handle(src []byte) []byte {
+    var req, resp api.HostMessage
+
+    if err := req.Deserialize(src); err != nil {
+        return nil
+    }
+    kind := req.Get(api.TagKind)
+
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.nreq[kind] += 1
+
+    resp.Reset(kind | network.KindBitResponse)
+
+    oc := api.OK
+    if s.inject != nil {
+        var serve bool
+        if oc, serve = s.inject(kind); oc != api.OK && serve {
+            _ = s.apply(&req, &resp, kind)
+        }
+    }
+    if oc == api.OK {
+        oc = s.apply(&req, &resp, kind)
+    }
+
+    resp.Put(api.TagOutcome, uint64(oc))
+    resp.PutHdr1(time.Now().Add(time.Second),
+        req.Hdr(network.TagRequestID), req.Hdr(network.TagClientID), s.peer)
+
+    return resp.Serialize(make([]byte, api.SerializeSize))
+}
+
+func (s *Server) apply(req, resp *api.HostMessage, kind uint64) api.Outcome {
+    switch kind {
+    case api.KindPing, api.KindGetStatus:
+        resp.Put(api.TagClusterID, s.ClusterId)
+        resp.Put(api.TagCapacity, s.Capacity)
+        resp.Put(api.TagUsed, s.used())
+        resp.Put(api.TagNReplicas, uint64(len(s.replicas)))
+
+    case api.KindGetTopology:
+        if req.Get(api.TagClusterID) != s.ClusterId {
+            return api.Inval
+        }
+        resp.Put(api.TagTopologyVersion, s.topology.Version)
+        resp.SetPayload(s.topology.Serialize(nil))
+
+    case api.KindListReplicas:
+        if req.Get(api.TagClusterID) != s.ClusterId {
+            return api.Inval
+        }
+        resp.SetPayload(api.SerializeReplicas(nil, s.replicas))
+
+    case api.KindCreateFirstReplica, api.KindCreateExtraReplica:
+        return s.create(req)
+
+    case api.KindRemoveReplica:
+        return s.remove(req)
+
+    default:
+        return api.Inval
+    }
+    return api.OK
+}
+
+func (s *Server) used() uint64 {
+    return uint64(len(s.replicas)) * s.ReplicaSize
+}
+
+func (s *Server) find(extentType, extentId uint64) int {
+    for i, r := range s.replicas {
+        if r.ExtentType == extentType && r.ExtentId == extentId {
+            return i
+        }
+    }
+    return -1
+}
+
+func (s *Server) create(req *api.HostMessage) api.Outcome {
+    r := api.Replica{
+        ExtentType:    req.Get(api.TagExtentType),
+        ExtentId:      req.Get(api.TagExtentID),
+        Ecrow:         req.GetDefault(api.TagEcrow, 0),
+        ParticipantId: req.GetDefault(api.TagParticipantID, 0),
+    }
+
+    if req.Get(api.TagClusterID) != s.ClusterId || s.find(r.ExtentType, r.ExtentId) >= 0 {
+        return api.Inval
+    }
+    if s.used() + s.ReplicaSize > s.Capacity {
+        return api.NoSpace
+    }
+    s.replicas = append(s.replicas, r)
+    return api.OK
+}
+
+func (s *Server) remove(req *api.HostMessage) api.Outcome {
+    i := s.find(req.Get(api.TagExtentType), req.Get(api.TagExtentID))
+
+    if req.Get(api.TagClusterID) != s.ClusterId || i < 0 ||
+        s.replicas[i].ParticipantId != req.Get(api.TagParticipantID) {
+        return api.Inval
+    }
+    s.replicas = append(s.replicas[:i], s.replicas[i+1:]...)
+    return api.OK
+}
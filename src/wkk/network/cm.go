@@ -1,10 +1,12 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 	"wkk/common/log"
 	"wkk/common/misc"
@@ -19,6 +21,10 @@ type CM interface {
 	WaitForCompletion(req GenericR) error
 
 	RPC(req GenericR, ep Endpoint) error
+
+	// Peer is what ep told of itself last, false before its first response
+	// on the current connection
+	Peer(ep Endpoint) (Peer, bool)
 }
 
 func NewCM(tag string, timeout error, magic uint16, bufsz int) CM {
@@ -30,6 +36,7 @@ func NewCM(tag string, timeout error, magic uint16, bufsz int) CM {
 		bufsz:   bufsz,
 		wmap:    make(map[string]*wire),
 		rmap:    make(map[uint64]GenericR),
+		rerr:    make(map[uint64]error),
 	}
 }
 
@@ -44,14 +51,16 @@ type genericCM struct {
 	mtx  sync.Mutex
 	wmap map[string]*wire		// wire by address
 	rmap map[uint64]GenericR 	// request by requestId
+	rerr map[uint64]error		// of responses that failed to deserialize
 }
 
 type wire struct {
 	addr  string
 	magic uint16
-	conn  net.Conn
+	conn  atomic.Pointer[net.Conn]	// set by Submit, holding que
 	data  []byte
 	que   chan struct{}
+	peer  atomic.Pointer[Peer]
 }
 
 func (cm *genericCM) Submit(req GenericR, ep Endpoint) error {
@@ -69,7 +78,7 @@ func (cm *genericCM) Submit(req GenericR, ep Endpoint) error {
 	case <- time.After(deadline.Sub(time.Now())):
 		return cm.timeout
 	}
-	conn := w.conn
+	conn := w.conn.Load()
 	serialized := req.Serialize(requestId, cm.clntId)
 
 	err := w.send(serialized, deadline)
@@ -81,14 +90,14 @@ func (cm *genericCM) Submit(req GenericR, ep Endpoint) error {
 	cm.rmap[requestId] = req
 	cm.mtx.Unlock()
 
-	// new connection
-	if conn != w.conn {
-		go cm.poll(w)
+	// new connection, unless gone already
+	if current := w.conn.Load(); current != conn && current != nil {
+		go cm.poll(w, current)
 	}
 
 out:
 	if err != nil {
-		w.disconnect(fmt.Sprintf("%v", err))
+		w.disconnect(w.conn.Load(), fmt.Sprintf("%v", err))
 	}
 	w.que <- struct{}{}
 	return err
@@ -107,7 +116,11 @@ func (cm *genericCM) WaitForCompletion(req GenericR) error {
 	cm.mtx.Lock()
 	defer cm.mtx.Unlock()
 
+	if rerr, ok := cm.rerr[req.RequestId()]; ok && err == nil {
+		err = rerr
+	}
 	delete(cm.rmap, req.RequestId())
+	delete(cm.rerr, req.RequestId())
 	return err
 }
 
@@ -118,12 +131,25 @@ func (cm *genericCM) RPC(req GenericR, ep Endpoint) error {
 	return cm.WaitForCompletion(req)
 }
 
+func (cm *genericCM) Peer(ep Endpoint) (Peer, bool) {
+	cm.mtx.Lock()
+	w, ok := cm.wmap[ep.String()]
+	cm.mtx.Unlock()
+
+	if !ok {
+		return Peer{}, false
+	}
+	if peer := w.peer.Load(); peer != nil {
+		return *peer, true
+	}
+	return Peer{}, false
+}
+
 func (cm *genericCM) ensure(addr string) *wire {
 	if _, ok := cm.wmap[addr]; !ok {
 		w := &wire{
 			addr:  addr,
 			magic: cm.magic,
-			conn:  nil,
 			data:  make([]byte, cm.bufsz),
 			que:   make(chan struct{}, 1),
 		}
@@ -135,16 +161,16 @@ func (cm *genericCM) ensure(addr string) *wire {
 	return cm.wmap[addr]
 }
 
-func (cm *genericCM) poll(w *wire) {
-	conn, data, addr := w.conn, w.data, w.addr
+func (cm *genericCM) poll(w *wire, conn *net.Conn) {
+	data, addr := w.data, w.addr
 
 	// poll all the way until connection is down
-	for avail := 0; w.conn == conn; {
-		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	for avail := 0; w.conn.Load() == conn; {
+		_ = (*conn).SetReadDeadline(time.Now().Add(10 * time.Millisecond))
 
-		if produced, err := conn.Read(data[avail:]); err != nil {
+		if produced, err := (*conn).Read(data[avail:]); err != nil {
 			if err, ok := err.(net.Error); !ok || !err.Timeout() {
-				w.disconnect(fmt.Sprintf("err=%v", err))
+				w.disconnect(conn, fmt.Sprintf("err=%v", err))
 				break
 			}
 		} else {
@@ -152,12 +178,22 @@ func (cm *genericCM) poll(w *wire) {
 		}
 
 		n, requestId, clientId := Consumable(data[:avail], cm.magic)
-		if n > 0 {
+		if n < 0 || n == 0 && avail == len(data) {
+			w.disconnect(conn, "malformed message received")
+			break
+		} else if n > 0 {
 			if clientId != cm.clntId {
 				log.Warn("mall formed response message, teardown connection!!")
+				w.disconnect(conn, "response of another client")
 				break
 			}
 
+			// the header nbuf comes first
+			var hdr Nbuf
+			if _, err := hdr.Deserialize(data[min(hdrSize, n):n]); err == nil {
+				peer := PeerOf(&hdr)
+				w.peer.Store(&peer)
+			}
 			cm.wakeup(requestId, data[:n], addr)
 
 			if avail > n {
@@ -178,17 +214,24 @@ func (cm *genericCM) wakeup(requestId uint64, src []byte, addr string)  {
 	if req, ok := cm.rmap[requestId]; ok {
 		if err := req.Deserialize(src); err != nil {
 			if w, ok := cm.wmap[addr]; ok {
-				w.disconnect("malformed message received")
+				w.disconnect(w.conn.Load(), fmt.Sprintf("malformed message received, err=%v", err))
+			}
+
+			var verr *VersionError
+			if errors.As(err, &verr) {
+				verr.Addr = addr
 			}
+			cm.rerr[requestId] = err
 		}
 		req.Wakeup() <- struct{}{}
 	}
 }
 
-func (w *wire) disconnect(what string) {
-	if w.conn != nil {
-		_ = w.conn.Close()
-		w.conn = nil
+// disconnect closes conn unless replaced already
+func (w *wire) disconnect(conn *net.Conn, what string) {
+	if conn != nil && w.conn.CompareAndSwap(conn, nil) {
+		_ = (*conn).Close()
+		w.peer.Store(nil)
 
 		log.Info("end of connection to %s: %s", w.addr, what)
 	}
@@ -196,18 +239,20 @@ func (w *wire) disconnect(what string) {
 
 func (w *wire) send(src []byte, deadline time.Time) error {
 	// ensure connection
-	if w.conn == nil {
-		conn, err := net.DialTimeout("tcp", w.addr, ConnAllowance)
+	conn := w.conn.Load()
+	if conn == nil {
+		dialed, err := net.DialTimeout("tcp", w.addr, ConnAllowance)
 		if err != nil {
 			log.Warn("err=%v", err)
 			return err
 		}
-		w.conn = conn
+		conn = &dialed
+		w.conn.Store(conn)
 	}
 
-	_ = w.conn.SetWriteDeadline(deadline)
+	_ = (*conn).SetWriteDeadline(deadline)
 	for len(src) > 0 {
-		if n, err := w.conn.Write(src); err != nil {
+		if n, err := (*conn).Write(src); err != nil {
 			return err
 		} else {
 			src = src[n:]
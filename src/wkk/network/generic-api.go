@@ -6,6 +6,8 @@ const (
 	TagAllowance     = 0x02
 	TagServiceTime = 0x03
 	TagECN         = 0x04
+	TagVersion     = 0x05
+	TagFeatures    = 0x06
 
 	KindBitResponse = 0x100
 )
@@ -0,0 +1,67 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Version of the framing, bumped on changes older peers cannot parse.
+// Peers tell theirs in the header of every message, along with the
+// feature bits of their protocol, header tags unknown to a peer are
+// skipped, so both roll out safely.
+const Version = 1
+
+// Peer is what the other end told of itself, Version 0 for peers that
+// tell nothing
+type Peer struct {
+	Version  uint64
+	Features uint64
+}
+
+func (p Peer) Has(features uint64) bool {
+	return p.Features & features == features
+}
+
+var ErrVersion = errors.New("version mismatch")
+
+type VersionError struct {
+	Addr    string
+	Peer    Peer
+	Missing uint64	// features
+}
+
+func (e *VersionError) Error() string {
+	if e.Missing != 0 {
+		return fmt.Sprintf("%s speaks version %d, features %#x, misses %#x",
+			e.Addr, e.Peer.Version, e.Peer.Features, e.Missing)
+	}
+	return fmt.Sprintf("%s speaks version %d, this end %d", e.Addr, e.Peer.Version, Version)
+}
+
+func (e *VersionError) Is(target error) bool {
+	return target == ErrVersion
+}
+
+// PutVersion tells Version and features in hdr
+func PutVersion(hdr *Nbuf, features uint64)  {
+	hdr.Put(TagVersion, Version)
+	hdr.Put(TagFeatures, features)
+}
+
+func PeerOf(hdr *Nbuf) Peer {
+	return Peer{
+		Version:  hdr.GetDefault(TagVersion, 0),
+		Features: hdr.GetDefault(TagFeatures, 0),
+	}
+}
+
+// Require fails a VersionError if the peer at ep is known to miss any of
+// features. Peers are known after their first response on a connection,
+// till it ends.
+func Require(cm CM, ep Endpoint, features uint64) error {
+	peer, ok := cm.Peer(ep)
+	if !ok || peer.Has(features) {
+		return nil
+	}
+	return &VersionError{Addr: ep.String(), Peer: peer, Missing: features &^ peer.Features}
+}
@@ -9,6 +9,11 @@ import (
 
 const EOMMagic = 0x69e1
 
+// magic, length and nbuf/blob counts
+const hdrSize = 2 + 3 + 1 + 1
+
+var ErrFrame = errors.New("bad message")
+
 func Serialize(dst []byte, magic uint16, nbufs []*Nbuf, blobs [][]byte) []byte {
     mark := dst
     dst = serd.Put64LE(2, dst, uint64(magic))
@@ -45,10 +50,29 @@ func Serialize(dst []byte, magic uint16, nbufs []*Nbuf, blobs [][]byte) []byte {
     return mark[:mlen]
 }
 
+// Deserialize fails a VersionError instead when the header tells of a
+// newer Version.
 func Deserialize(src []byte, nbufs []*Nbuf, blobs [][]byte) error {
+    for _, nb := range nbufs {
+        nb.Reset()
+    }
+    err := deserialize(src, nbufs, blobs)
+
+    if err != nil && len(nbufs) > 0 {
+        if peer := PeerOf(nbufs[0]); peer.Version > Version {
+            return &VersionError{Peer: peer}
+        }
+    }
+    return err
+}
+
+func deserialize(src []byte, nbufs []*Nbuf, blobs [][]byte) error {
     var err error
     var mlen, countN, countB, bi, blen, magic uint64
 
+    if len(src) < hdrSize {
+        return ErrFrame
+    }
     src = src[2:]   // skip magic which has been checked by Consumable
 
     mlen, src, err = serd.Get64LE(3, src)
@@ -56,7 +80,7 @@ func Deserialize(src []byte, nbufs []*Nbuf, blobs [][]byte) error {
         return err
     }
     if int(mlen) != len(src) + 2 + 3 {
-        return errors.New("bad message")
+        return ErrFrame
     }
 
     countN, src, err = serd.Get64LE(1, src)
@@ -64,12 +88,15 @@ func Deserialize(src []byte, nbufs []*Nbuf, blobs [][]byte) error {
         return err
     }
     if int(countN) != len(nbufs) {
-        return errors.New("bad message")
+        return ErrFrame
     }
 
     countB, src, err = serd.Get64LE(1, src)
+    if err != nil {
+        return err
+    }
     if int(countB) > len(blobs) {
-        return errors.New("bad message")
+        return ErrFrame
     }
 
     for i := 0; i < int(countN); i += 1 {
@@ -83,13 +110,15 @@ func Deserialize(src []byte, nbufs []*Nbuf, blobs [][]byte) error {
         bi, src, err = serd.Get64LE(1, src)
         if err != nil {
             return err
+        } else if int(bi) >= len(blobs) || blobs[bi] != nil {
+            return ErrFrame
         }
 
         blen, src, err = serd.Get64LE(3, src)
         if err != nil {
             return err
-        } else if len(src) < int(blen) {
-            return errors.New("bad message")
+        } else if blen == 0 || len(src) < int(blen) {
+            return ErrFrame
         }
         blobs[bi], src = src[:blen], src[blen:]
     }
@@ -98,10 +127,14 @@ func Deserialize(src []byte, nbufs []*Nbuf, blobs [][]byte) error {
         return err
     } else if magic != EOMMagic {
         return errors.New("bad magic")
+    } else if len(src) != 0 {
+        return ErrFrame
     }
     return nil
 }
 
+// Consumable tells the length of the frame at the head of src, 0 when more
+// bytes are needed and -1 when src can never make a frame.
 func Consumable(src []byte, magic uint16) (int, uint64, uint64) {
     var mmagic, mlen uint64
     var nb Nbuf
@@ -122,11 +155,14 @@ func Consumable(src []byte, magic uint16) (int, uint64, uint64) {
     }
 
     mlen, src, _ = serd.Get64LE(3, src)
-    if int(mlen) > 2 + 3 + len(src) {
+    if mlen < hdrSize + 8 + 2 {
+        log.Info("bad length!")
+        return -1, 0, 0
+    } else if int(mlen) > 2 + 3 + len(src) {
         return 0, 0, 0   // not enough bytes, not error
     }
 
-    _, err = nb.Deserialize(src[2:])    // [2:] to skip nbuf/blob count
+    _, err = nb.Deserialize(src[2:mlen-2-3])    // [2:] to skip nbuf/blob count
     if err != nil || !nb.Have(Bit(TagRequestID) |
                               Bit(TagClientID)) {
         log.Info("bad request!")
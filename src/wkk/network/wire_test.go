@@ -0,0 +1,109 @@
+package network_test
+
+import (
+	"bytes"
+	"testing"
+	"wkk/common/misc"
+	"wkk/network"
+)
+
+const (
+	magic   = 0x7a3c
+	tagKind = 0x10
+)
+
+func frame(blob []byte) []byte {
+	var hdr, msg network.Nbuf
+	hdr.Put(network.TagRequestID, 1)
+	hdr.Put(network.TagClientID, 2)
+	msg.Put(tagKind, 3)
+
+	dst := make([]byte, 256)
+	return network.Serialize(dst, magic, []*network.Nbuf{&hdr, &msg}, [][]byte{blob})
+}
+
+func deserialize(src []byte) ([]*network.Nbuf, [][]byte, error) {
+	nbufs := []*network.Nbuf{{}, {}}
+	blobs := [][]byte{nil}
+	return nbufs, blobs, network.Deserialize(src, nbufs, blobs)
+}
+
+func Test0(t *testing.T) {
+	src := frame([]byte("payload"))
+
+	n, requestId, clientId := network.Consumable(src, magic)
+	misc.Assert(n == len(src) && requestId == 1 && clientId == 2)
+
+	nbufs, blobs, err := deserialize(src)
+	misc.AssertNilError(err)
+	misc.Assert(nbufs[1].Get(tagKind) == 3 && string(blobs[0]) == "payload")
+
+	// partial frames need more bytes, broken ones never make a frame
+	for i := 0; i < len(src); i += 1 {
+		n, _, _ := network.Consumable(src[:i], magic)
+		misc.Assert(n == 0)
+	}
+	n, _, _ = network.Consumable(src, magic + 1)
+	misc.Assert(n == -1)
+	n, _, _ = network.Consumable([]byte{0x3c, 0x7a, 0, 0, 0, 0, 0}, magic)
+	misc.Assert(n == -1)
+
+	// blob index out of range, blob count cut short, no counts at all
+	bad := append([]byte{}, src...)
+	bad[len(src) - 2 - len("payload") - 3 - 1] = 7
+	_, _, err = deserialize(bad)
+	misc.Assert(err != nil)
+
+	_, _, err = deserialize([]byte{0x3c, 0x7a, 6, 0, 0, 2})
+	misc.Assert(err != nil)
+	_, _, err = deserialize(src[:1])
+	misc.Assert(err != nil)
+}
+
+func FuzzConsumable(f *testing.F) {
+	f.Add(frame(nil), uint16(magic))
+	f.Add(frame([]byte("payload")), uint16(magic))
+	f.Add([]byte{0x3c, 0x7a, 0, 0, 0, 0, 0}, uint16(magic))
+
+	f.Fuzz(func(t *testing.T, src []byte, magic uint16) {
+		n, _, _ := network.Consumable(src, magic)
+		misc.Assert(n >= -1 && n <= len(src))
+	})
+}
+
+func FuzzDeserialize(f *testing.F) {
+	f.Add(frame(nil))
+	f.Add(frame([]byte("payload")))
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		nbufs, blobs, err := deserialize(src)
+		if err != nil {
+			return
+		}
+
+		// what parses serializes back to the same bytes
+		dst := make([]byte, len(src) + 1)
+		misc.Assert(bytes.Equal(src, network.Serialize(dst, uint16(src[0]) | uint16(src[1]) << 8, nbufs, blobs)))
+	})
+}
+
+func FuzzNbufDeserialize(f *testing.F) {
+	var nb network.Nbuf
+	for _, tag := range []uint64{network.TagRequestID, network.TagClientID} {
+		dst := make([]byte, 24)
+		f.Add(dst[:len(dst) - len(nb.Serialize(dst))])
+		nb.Put(tag, tag + 1)
+	}
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		var nb network.Nbuf
+		rest, err := nb.Deserialize(src)
+		if err != nil {
+			return
+		}
+
+		// Serialize leaves what is past the nbuf
+		dst := make([]byte, len(src) - len(rest))
+		misc.Assert(len(nb.Serialize(dst)) == 0 && bytes.Equal(src[:len(dst)], dst))
+	})
+}
@@ -43,6 +43,14 @@ const (
 	STALE   = Outcome(3)
 	NONEXT  = Outcome(4)
 	EIO     = Outcome(5)
+	MOVED   = Outcome(6)	// the replica does not serve the key (anymore)
+)
+
+// feature bits told in every header, on top of network.Version
+const (
+	FeatureMoved = 1 << 0	// MOVED for keys of extents elsewhere
+
+	Features = FeatureMoved
 )
 
 const (
@@ -124,6 +132,11 @@ func DeserializeKKS(src []byte) ([]RubiksKK, error) {
 	return result, nil
 }
 
+// SerializedSize is what a pair takes in a commit, see MaxCommitSize.
+func SerializedSize(kk RubiksKK, vv RubiksVV) int {
+	return 8 + 3 + 3 + len(kk.Key) + len(vv.Val)
+}
+
 func SerializeKVS(dst []byte, kks []RubiksKK, vvs []RubiksVV) []byte {
 	mark := dst
 
@@ -181,15 +194,17 @@ func DeserializeKVS(src []byte) ([] RubiksKK, []RubiksVV, error) {
 
 func (oc Outcome) Error() string {
 	switch oc {
+	case OK:		return "RUBIKS_OK"
 	case TIMEOUT:	return "RUBIKS_TIMEOUT"
 	case INVAL:		return "RUBIKS_INVAL"
 	case STALE:		return "RUBIKS_STALE"
 	case NONEXT:	return "RUBIKS_NONEXT"
 	case EIO:		return "RUBIKS_EIO"
-	default:		panic("UNREACHABLE")
+	case MOVED:		return "RUBIKS_MOVED"
+	default:		return fmt.Sprintf("RUBIKS_OUTCOME(%d)", uint64(oc))	// of a newer server
 	}
 }
 
 func (oc Outcome) Retryable() bool {
-	return oc == EIO
+	return oc == EIO || oc == MOVED
 }
@@ -0,0 +1,51 @@
+package api_test
+
+import (
+	"bytes"
+	"testing"
+	"wkk/common/misc"
+	"wkk/rubiks/api"
+)
+
+func Test0(t *testing.T) {
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("k0")}, {Table: 2, Key: []byte{}}}
+	vvs := []api.RubiksVV{{Val: []byte("v0")}, {Val: []byte("v1")}}
+
+	src := api.SerializeKVS(make([]byte, 64), kks, vvs)
+	kks1, vvs1, err := api.DeserializeKVS(src)
+	misc.Assert(err == nil && len(kks1) == 2 && string(vvs1[1].Val) == "v1")
+
+	_, _, err = api.DeserializeKVS(src[:len(src) - 1])
+	misc.Assert(err != nil)
+	_, err = api.DeserializeKKS(api.SerializeKKS(make([]byte, 64), kks)[:9])
+	misc.Assert(err != nil)
+}
+
+func FuzzDeserializeKKS(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(api.SerializeKKS(make([]byte, 64), []api.RubiksKK{{Table: 1, Key: []byte("k0")}, {Table: 2}}))
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		kks, err := api.DeserializeKKS(src)
+		if err != nil {
+			return
+		}
+		misc.Assert(bytes.Equal(src, api.SerializeKKS(make([]byte, len(src)), kks)))
+	})
+}
+
+func FuzzDeserializeKVS(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(api.SerializeKVS(make([]byte, 64),
+		[]api.RubiksKK{{Table: 1, Key: []byte("k0")}, {Table: 2}},
+		[]api.RubiksVV{{Val: []byte("v0")}, {}}))
+
+	f.Fuzz(func(t *testing.T, src []byte) {
+		kks, vvs, err := api.DeserializeKVS(src)
+		if err != nil {
+			return
+		}
+		misc.Assert(len(kks) == len(vvs))
+		misc.Assert(bytes.Equal(src, api.SerializeKVS(make([]byte, len(src)), kks, vvs)))
+	})
+}
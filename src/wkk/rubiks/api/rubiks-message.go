@@ -25,6 +25,11 @@ var PayloadZero = blob.T{
 }
 
 func (t *RubiksMessage) PutHdr(deadline time.Time, requestId, clientId uint64)  {
+	t.PutHdr1(deadline, requestId, clientId, network.Peer{Version: network.Version, Features: Features})
+}
+
+// PutHdr1 tells peer instead, nothing of Version 0, as older servers
+func (t *RubiksMessage) PutHdr1(deadline time.Time, requestId, clientId uint64, peer network.Peer)  {
 	allowance := deadline.Sub(time.Now()).Microseconds()
 	if allowance < 0 {
 		allowance = 0
@@ -33,6 +38,10 @@ func (t *RubiksMessage) PutHdr(deadline time.Time, requestId, clientId uint64)
 	t.hdr.Put(network.TagClientID, clientId)
 	t.hdr.Put(network.TagRequestID, requestId)
 	t.hdr.Put(network.TagAllowance, uint64(allowance))
+	if peer.Version > 0 {
+		t.hdr.Put(network.TagVersion, peer.Version)
+		t.hdr.Put(network.TagFeatures, peer.Features)
+	}
 }
 
 func (t *RubiksMessage) Hdr(tag uint64) uint64 {
@@ -71,6 +80,9 @@ func (t *RubiksMessage) Deserialize(src []byte) error {
 	t.payload = PayloadZero
 
 	if len(blobs[0]) > 0 {
+		if !t.msg.Have(network.Bit(TagPayloadCRC) | network.Bit(TagPayloadCRC + 1)) {
+			return EIO
+		}
 		t.payload = blob.T{Data: blobs[0], CRC: t.GetCRC(TagPayloadCRC)}
 
 		if !blob.OK(t.payload, PayloadZero.CRC) {
@@ -104,6 +116,14 @@ func (t *RubiksMessage) Get(tag uint64) uint64 {
 	return t.msg.Get(tag)
 }
 
+func (t *RubiksMessage) Has(tag uint64) bool {
+	return t.msg.Has(tag)
+}
+
+func (t *RubiksMessage) GetDefault(tag, payload uint64) uint64 {
+	return t.msg.GetDefault(tag, payload)
+}
+
 func (t *RubiksMessage) GetSeqnum(i int) Seqnum {
 	return Seqnum(t.Get(TagSeqnum + (uint64(i))))
 }
@@ -0,0 +1,266 @@
+package client
+
+import (
+	"reflect"
+	"sync"
+	"time"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+// Future of an async call, Wait for it as often as needed or select on
+// Done. Every future must be waited for, it holds a RubiksR till then.
+type Future[T any] struct {
+	wait     func() (T, error)
+	once     sync.Once
+	val      T
+	err      error
+
+	doneOnce sync.Once
+	done     chan struct{}
+}
+
+func newFuture[T any](wait func() (T, error)) *Future[T] {
+	return &Future[T]{wait: wait}
+}
+
+func failedFuture[T any](err error) *Future[T] {
+	return newFuture(func() (T, error) {
+		var zero T
+		return zero, err
+	})
+}
+
+func (f *Future[T]) Wait() (T, error) {
+	f.once.Do(func() {
+		f.val, f.err = f.wait()
+	})
+	return f.val, f.err
+}
+
+// Done is closed once the result is in, it takes a goroutine to wait.
+func (f *Future[T]) Done() <-chan struct{} {
+	f.doneOnce.Do(func() {
+		f.done = make(chan struct{})
+		go func() {
+			f.Wait()
+			close(f.done)
+		}()
+	})
+	return f.done
+}
+
+// WaitAll waits for all the futures, the first failure of them is returned.
+func WaitAll[T any](futures ...*Future[T]) error {
+	var result error
+
+	for _, f := range futures {
+		if _, err := f.Wait(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// WaitAny waits for one of the futures and tells which, the others are
+// still to be waited for.
+func WaitAny[T any](futures ...*Future[T]) int {
+	cases := make([]reflect.SelectCase, len(futures))
+
+	for i, f := range futures {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(f.Done())}
+	}
+
+	chosen, _, _ := reflect.Select(cases)
+	return chosen
+}
+
+type IterateResult struct {
+	KKs []api.RubiksKK
+	VVs []api.RubiksVV
+}
+
+// AsyncRubiks submits without waiting, any number of requests go out from
+// one goroutine. Retries are the ones of the sync calls, taken at Wait.
+// Results are copied out of the RubiksR, which goes back to the pool.
+type AsyncRubiks interface {
+	Rubiks
+
+	GetAsync(deadline time.Time, kks []api.RubiksKK) *Future[[]api.RubiksVV]
+
+	CommitAsync(deadline time.Time, kks []api.RubiksKK, vvs []api.RubiksVV) *Future[[]api.RubiksVV]
+
+	ConfirmAsync(deadline time.Time, kks []api.RubiksKK, vvs []api.RubiksVV) *Future[struct{}]
+
+	IterateAsync(deadline time.Time, cursor api.RubiksKK, npairs int,
+		hint api.IterateHint) *Future[IterateResult]
+}
+
+func NewAsyncRubiksClient(epl network.EndpointList, config *Config) AsyncRubiks {
+	return NewRubiksClient2(epl, config).(*rubiksClient)
+}
+
+func (client *rubiksClient) GetAsync(deadline time.Time, kks []api.RubiksKK) *Future[[]api.RubiksVV] {
+	return submitAsync(client, deadline, client.hintFn(kks[0]), func(rbr *RubiksR) error {
+		rbr.req.MkGET(kks, rbr.payload)
+		return nil
+	}, func(rbr *RubiksR) ([]api.RubiksVV, error) {
+		vvs, err := decodeGet(rbr)
+		return CloneVVs(vvs), err
+	})
+}
+
+func (client *rubiksClient) CommitAsync(deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) *Future[[]api.RubiksVV] {
+
+	return submitAsync(client, deadline, client.hintFn(kks[0]), func(rbr *RubiksR) error {
+		return mkCommit(rbr, kks, vvs)
+	}, func(rbr *RubiksR) ([]api.RubiksVV, error) {
+		return decodeCommit(rbr, vvs), nil
+	})
+}
+
+func (client *rubiksClient) ConfirmAsync(deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) *Future[struct{}] {
+
+	return submitAsync(client, deadline, client.hintFn(kks[0]), func(rbr *RubiksR) error {
+		rbr.req.MkCONFIRM(kks, vvs, rbr.payload)
+		return nil
+	}, func(rbr *RubiksR) (struct{}, error) {
+		return struct{}{}, nil
+	})
+}
+
+func (client *rubiksClient) IterateAsync(deadline time.Time, cursor api.RubiksKK,
+	npairs int, hint api.IterateHint) *Future[IterateResult] {
+
+	return submitAsync(client, deadline, client.hintFn(cursor), func(rbr *RubiksR) error {
+		rbr.req.MkITERATE(cursor, hint, npairs, rbr.payload)
+		return nil
+	}, func(rbr *RubiksR) (IterateResult, error) {
+		kks, vvs, err := decodeIterate(rbr, hint)
+		return IterateResult{KKs: CloneKKs(kks), VVs: CloneVVs(vvs)}, err
+	})
+}
+
+// submitAsync submits right away and leaves waiting, and retrying, to the
+// future. With Config.MaxInFlight requests in flight already, the oldest
+// is waited for first.
+func submitAsync[T any](client *rubiksClient, deadline time.Time, hint uint64,
+	mk func(rbr *RubiksR) error, decode func(rbr *RubiksR) (T, error)) *Future[T] {
+
+	client.inflight.reserve()
+	if !time.Now().Before(deadline) {
+		client.inflight.cancel()
+		return failedFuture[T](api.TIMEOUT)
+	}
+
+	rbr := AcquireRubiksR()
+	submit := func() error {
+		rbr.Begin(deadline)
+		if err := mk(rbr); err != nil {
+			return err
+		}
+		return client.cm.Submit(rbr, hint)
+	}
+	submitted := submit()
+
+	var f *Future[T]
+	f = newFuture(func() (T, error) {
+		defer func() {
+			ReleaseRubiksR(rbr)
+			client.inflight.remove(f)
+		}()
+
+		attempt := 0
+		err := client.retry.Fn(func() error {
+			if attempt += 1; attempt > 1 {
+				submitted = submit()
+			}
+			if submitted != nil {
+				return submitted
+			}
+			return client.cm.WaitForCompletion(rbr)
+		})
+
+		if err != nil {
+			var zero T
+			return zero, err
+		}
+		return decode(rbr)
+	})
+
+	client.inflight.add(f)
+	return f
+}
+
+type waiter interface {
+	waitAny()
+}
+
+func (f *Future[T]) waitAny()  {
+	f.Wait()
+}
+
+// inflight tracks the futures not waited for yet, oldest first, and the
+// slots reserved for futures to come
+type inflight struct {
+	mtx      sync.Mutex
+	max      int
+	futures  []waiter
+	reserved int
+	added    *sync.Cond		// on add or cancel of a reserved slot
+}
+
+// reserve takes a slot, checked and taken under one lock, to be filled
+// by add or given back by cancel
+func (in *inflight) reserve()  {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+
+	if in.added == nil {
+		in.added = sync.NewCond(&in.mtx)
+	}
+
+	for in.max > 0 && len(in.futures) + in.reserved >= in.max {
+		if len(in.futures) == 0 {
+			in.added.Wait()
+			continue
+		}
+
+		oldest := in.futures[0]
+		in.mtx.Unlock()
+		oldest.waitAny()
+		in.mtx.Lock()
+	}
+	in.reserved += 1
+}
+
+func (in *inflight) add(f waiter)  {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+
+	in.reserved -= 1
+	in.futures = append(in.futures, f)
+	in.added.Broadcast()
+}
+
+func (in *inflight) cancel()  {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+
+	in.reserved -= 1
+	in.added.Broadcast()
+}
+
+func (in *inflight) remove(f waiter)  {
+	in.mtx.Lock()
+	defer in.mtx.Unlock()
+
+	for i, f0 := range in.futures {
+		if f0 == f {
+			in.futures = append(in.futures[:i], in.futures[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package client_test
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+func Test4(t *testing.T)  {
+	server, err := rubiks_fake.NewServer(rubiks_fake.New())
+	misc.AssertNilError(err)
+	defer server.Close()
+
+	config := *client.FavoredConfig
+	config.MaxInFlight = 4
+	rubiks := client.NewAsyncRubiksClient(network.EndpointList{server.Endpoint()}, &config)
+	deadline := time.Now().Add(time.Second)
+
+	var kks []api.RubiksKK
+	var commits []*client.Future[[]api.RubiksVV]
+	for i := 0; i < 50; i += 1 {
+		kk := api.RubiksKK{Table: 1, Key: []byte(fmt.Sprintf("key%02d", i))}
+		kks = append(kks, kk)
+		commits = append(commits, rubiks.CommitAsync(deadline, []api.RubiksKK{kk},
+			[]api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: kk.Key}}))
+	}
+	misc.AssertNilError(client.WaitAll(commits...))
+
+	var gets []*client.Future[[]api.RubiksVV]
+	for _, kk := range kks {
+		gets = append(gets, rubiks.GetAsync(deadline, []api.RubiksKK{kk}))
+	}
+	for i, f := range gets {
+		vvs, err := f.Wait()
+		misc.Assert(err == nil && vvs[0].Present && vvs[0].Seqnum == 1 && string(vvs[0].Val) == string(kks[i].Key))
+	}
+
+	// stale confirm, the slow one loses
+	server.Inject(func(kind uint64) (time.Duration, api.Outcome) {
+		if kind == api.KindIterate {
+			return 100 * time.Millisecond, api.OK
+		}
+		return 0, api.OK
+	})
+	iter := rubiks.IterateAsync(deadline, api.RubiksKK{Table: 1}, api.MaxNPairs, api.IterateHintAll)
+	confirm := rubiks.ConfirmAsync(deadline, kks[:1], []api.RubiksVV{{Seqnum: 7}})
+
+	select {
+	case <- confirm.Done():
+	case <- iter.Done():
+		misc.Assert(false)
+	}
+	_, err = confirm.Wait()
+	misc.Assert(err == api.STALE)
+
+	res, err := iter.Wait()
+	misc.Assert(err == nil && len(res.KKs) == api.MaxNPairs && string(res.VVs[0].Val) == "key00")
+
+	// retried the same as the sync calls
+	nfail := 2
+	server.Inject(func(kind uint64) (time.Duration, api.Outcome) {
+		if nfail > 0 {
+			nfail -= 1
+			return 0, api.EIO
+		}
+		return 0, api.OK
+	})
+	nreq := server.NReq()
+	vvs, err := rubiks.GetAsync(deadline, kks[:1]).Wait()
+	misc.Assert(err == nil && vvs[0].Present && server.NReq() == nreq + 3)
+
+	futures := []*client.Future[[]api.RubiksVV]{
+		rubiks.GetAsync(deadline, kks[:1]),
+		rubiks.GetAsync(time.Now(), kks[:1]),
+	}
+	misc.Assert(client.WaitAny(futures...) >= 0)
+	_, err = futures[1].Wait()
+	misc.Assert(err == api.TIMEOUT)
+	misc.Assert(client.WaitAll(futures...) == api.TIMEOUT)
+}
+
+// submitters racing for the last slot don't go over MaxInFlight
+func Test13(t *testing.T)  {
+	server, err := rubiks_fake.NewServer(rubiks_fake.New())
+	misc.AssertNilError(err)
+	defer server.Close()
+
+	var serving, most atomic.Int32
+	server.Inject(func(kind uint64) (time.Duration, api.Outcome) {
+		n := serving.Add(1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(5 * time.Millisecond)
+		serving.Add(-1)
+		return 0, api.OK
+	})
+
+	config := *client.FavoredConfig
+	config.MaxInFlight = 2
+	rubiks := client.NewAsyncRubiksClient(network.EndpointList{server.Endpoint()}, &config)
+	deadline := time.Now().Add(time.Second)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j += 1 {
+				_, err := rubiks.GetAsync(deadline, []api.RubiksKK{{Table: 1, Key: []byte("a")}}).Wait()
+				misc.AssertNilError(err)
+			}
+		}()
+	}
+	wg.Wait()
+	misc.Assert(most.Load() <= 2 && server.NReq() == 32)
+}
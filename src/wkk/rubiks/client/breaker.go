@@ -0,0 +1,167 @@
+package client
+
+import (
+	"sync"
+	"time"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed   = BreakerState(0)
+	BreakerOpen     = BreakerState(1)
+	BreakerHalfOpen = BreakerState(2)
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:		return "closed"
+	case BreakerOpen:		return "open"
+	case BreakerHalfOpen:	return "half-open"
+	default:				panic("UNREACHABLE")
+	}
+}
+
+// Breaking tells when the breaker of an endpoint opens: on as many
+// failures in a row, or on the failure rate of a window with enough
+// requests in it. An open breaker keeps its endpoint out for OpenFor,
+// then lets Probes requests through half open, all of which must succeed
+// to close it again. Failures are failed submits, timeouts waiting for
+// completion and the TIMEOUT or EIO outcomes.
+type Breaking struct {
+	ConsecutiveFailures int
+	FailureRate         float64
+	MinRequests         int
+	Window              time.Duration
+
+	OpenFor             time.Duration
+	Probes              int
+
+	// called on every state change, with the breaker locked
+	OnStateChange       func(ep network.Endpoint, from, to BreakerState)
+}
+
+var FavoredBreaking = &Breaking{
+	ConsecutiveFailures: 5,
+	FailureRate:         0.5,
+	MinRequests:         20,
+	Window:              10 * time.Second,
+	OpenFor:             5  * time.Second,
+	Probes:              3,
+}
+
+type breaker struct {
+	mtx       sync.Mutex
+	ep        network.Endpoint
+	breaking  *Breaking
+
+	state     BreakerState
+	since     time.Time	// of the state, or the window when closed
+	nreq      int
+	nfail     int
+	inarow    int
+	probing   int		// probes out, half open
+}
+
+func newBreaker(ep network.Endpoint, breaking *Breaking) *breaker {
+	return &breaker{ep: ep, breaking: breaking, since: time.Now()}
+}
+
+// allow tells whether a request may go, a probe is taken if half open
+func (b *breaker) allow(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.since) < b.breaking.OpenFor {
+			return false
+		}
+		b.transit(BreakerHalfOpen, now)
+		fallthrough
+
+	case BreakerHalfOpen:
+		if b.probing + b.nreq >= b.breaking.Probes {
+			return false
+		}
+		b.probing += 1
+	}
+	return true
+}
+
+// cancel gives back what allow took for a request that never went
+func (b *breaker) cancel()  {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probing > 0 {
+		b.probing -= 1
+	}
+}
+
+func (b *breaker) record(ok bool)  {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+
+	switch b.state {
+	case BreakerOpen:
+		// late news of a request let through before opening
+
+	case BreakerHalfOpen:
+		if b.probing > 0 {
+			b.probing -= 1
+		}
+		if !ok {
+			b.transit(BreakerOpen, now)
+		} else if b.nreq += 1; b.nreq >= b.breaking.Probes {
+			b.transit(BreakerClosed, now)
+		}
+
+	case BreakerClosed:
+		if now.Sub(b.since) > b.breaking.Window {
+			b.since, b.nreq, b.nfail = now, 0, 0
+		}
+
+		b.nreq += 1
+		if ok {
+			b.inarow = 0
+			return
+		}
+		b.nfail += 1
+		b.inarow += 1
+
+		if (b.breaking.ConsecutiveFailures > 0 && b.inarow >= b.breaking.ConsecutiveFailures) ||
+			(b.nreq >= b.breaking.MinRequests &&
+				float64(b.nfail) >= b.breaking.FailureRate * float64(b.nreq)) {
+			b.transit(BreakerOpen, now)
+		}
+	}
+}
+
+func (b *breaker) transit(to BreakerState, now time.Time)  {
+	from := b.state
+
+	b.state, b.since = to, now
+	b.nreq, b.nfail, b.inarow, b.probing = 0, 0, 0, 0
+
+	if b.breaking.OnStateChange != nil {
+		b.breaking.OnStateChange(b.ep, from, to)
+	}
+}
+
+func (b *breaker) State() BreakerState {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.state
+}
+
+func failure(err error) bool {
+	switch err {
+	case nil, api.STALE, api.NONEXT, api.INVAL, api.MOVED:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+func Test8(t *testing.T)  {
+	var changes []BreakerState
+	breaking := &Breaking{
+		ConsecutiveFailures: 3,
+		FailureRate:         0.5,
+		MinRequests:         10,
+		Window:              time.Hour,
+		OpenFor:             20 * time.Millisecond,
+		Probes:              2,
+		OnStateChange: func(ep network.Endpoint, from, to BreakerState) {
+			changes = append(changes, to)
+		},
+	}
+	b := newBreaker(network.MkEndpoint(0x7f000001, 1), breaking)
+	now := time.Now()
+
+	// in a row
+	for i := 0; i < 3; i += 1 {
+		misc.Assert(b.allow(now))
+		b.record(false)
+	}
+	misc.Assert(b.State() == BreakerOpen && !b.allow(time.Now()))
+
+	// half open, probes limited, a failed one opens again
+	time.Sleep(25 * time.Millisecond)
+	misc.Assert(b.allow(time.Now()) && b.allow(time.Now()) && !b.allow(time.Now()))
+	misc.Assert(b.State() == BreakerHalfOpen)
+	b.record(true)
+	b.record(false)
+	misc.Assert(b.State() == BreakerOpen)
+
+	time.Sleep(25 * time.Millisecond)
+	misc.Assert(b.allow(time.Now()) && b.allow(time.Now()))
+	b.record(true)
+	b.record(true)
+	misc.Assert(b.State() == BreakerClosed)
+
+	// by rate, never 3 in a row
+	for i := 0; i < 10; i += 1 {
+		misc.Assert(b.allow(now))
+		b.record(i % 2 == 0)
+	}
+	misc.Assert(b.State() == BreakerOpen)
+	misc.Assert(len(changes) == 6)
+	misc.Assert(changes[0] == BreakerOpen && changes[1] == BreakerHalfOpen && changes[4] == BreakerClosed)
+
+	misc.Assert(!failure(api.STALE) && failure(api.TIMEOUT) && failure(api.EIO))
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"container/list"
+	"sync"
+	"time"
+	"wkk/common/serd"
+	"wkk/rubiks/api"
+)
+
+// Caching bounds a read-through cache of RPCGet. A cached pair is served
+// as is for the TTL of its table, reads are thus stale by the TTL at most.
+// Past the TTL the pair is fetched over again, or with Validate, kept if
+// RPCConfirm finds its seqnum still current. Tables without TTL aren't
+// cached.
+type Caching struct {
+	Capacity int						// pairs
+	TTL      map[api.Table]time.Duration
+	Validate bool
+}
+
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Confirmed     uint64	// hits past the TTL, by RPCConfirm
+	Evictions     uint64
+	Invalidations uint64
+}
+
+// CacheRubiks is a Rubiks, own commits write through it, others' go
+// unseen until the TTL runs out.
+type CacheRubiks struct {
+	rubiks  Rubiks
+	caching *Caching
+
+	mtx     sync.Mutex
+	lru     *list.List					// of *cacheEntry, recent first
+	entries map[string]*list.Element
+	stats   CacheStats
+}
+
+type cacheEntry struct {
+	id      string
+	vv      api.RubiksVV
+	expires time.Time
+}
+
+var _ Rubiks = (*CacheRubiks)(nil)
+
+func NewCacheRubiks(rubiks Rubiks, caching *Caching) *CacheRubiks {
+	return &CacheRubiks{
+		rubiks:  rubiks,
+		caching: caching,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *CacheRubiks) Stats() CacheStats {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.stats
+}
+
+// Invalidate drops kks, e.g. on news of a commit by someone else.
+func (c *CacheRubiks) Invalidate(kks ...api.RubiksKK)  {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, kk := range kks {
+		if elem, ok := c.entries[cacheId(kk)]; ok {
+			c.remove(elem)
+			c.stats.Invalidations += 1
+		}
+	}
+}
+
+func (c *CacheRubiks) RPCGet(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK) ([]api.RubiksVV, error) {
+
+	vvs := make([]api.RubiksVV, len(kks))
+	var missed, expired []int
+
+	now := time.Now()
+	c.mtx.Lock()
+	for i, kk := range kks {
+		elem, ok := c.entries[cacheId(kk)]
+		switch {
+		case !ok:
+			missed = append(missed, i)
+		case now.After(elem.Value.(*cacheEntry).expires):
+			vvs[i] = elem.Value.(*cacheEntry).vv
+			expired = append(expired, i)
+		default:
+			vvs[i] = elem.Value.(*cacheEntry).vv
+			c.lru.MoveToFront(elem)
+		}
+	}
+	c.stats.Hits += uint64(len(kks) - len(missed) - len(expired))
+	c.mtx.Unlock()
+
+	if len(expired) > 0 && c.caching.Validate {
+		if err := c.confirm(rbr, deadline, kks, vvs, expired); err == nil {
+			expired = nil
+		}
+	}
+
+	missed = append(missed, expired...)
+	if len(missed) == 0 {
+		return CloneVVs(vvs), nil
+	}
+
+	c.mtx.Lock()
+	c.stats.Misses += uint64(len(missed))
+	c.mtx.Unlock()
+
+	missedKKs := make([]api.RubiksKK, len(missed))
+	for j, i := range missed {
+		missedKKs[j] = kks[i]
+	}
+
+	fetched, err := c.rubiks.RPCGet(rbr, deadline, missedKKs)
+	if err != nil {
+		return nil, err
+	} else if len(fetched) != len(missed) {
+		return nil, api.EIO
+	}
+
+	for j, i := range missed {
+		vvs[i] = fetched[j]
+	}
+	c.put(missedKKs, CloneVVs(fetched))
+	return CloneVVs(vvs), nil
+}
+
+// confirm renews the expired pairs if their seqnums are still current
+func (c *CacheRubiks) confirm(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV, expired []int) error {
+
+	ckks := make([]api.RubiksKK, len(expired))
+	cvvs := make([]api.RubiksVV, len(expired))
+	for j, i := range expired {
+		ckks[j], cvvs[j] = kks[i], vvs[i]
+	}
+
+	if err := c.rubiks.RPCConfirm(rbr, deadline, ckks, cvvs); err != nil {
+		return err
+	}
+
+	c.mtx.Lock()
+	c.stats.Confirmed += uint64(len(expired))
+	c.mtx.Unlock()
+
+	c.put(ckks, cvvs)
+	return nil
+}
+
+func (c *CacheRubiks) RPCCommit(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+
+	result, err := c.rubiks.RPCCommit(rbr, deadline, kks, vvs)
+	if err != nil {
+		// a timed out commit may have made it
+		c.Invalidate(kks...)
+		return nil, err
+	}
+
+	c.put(kks, CloneVVs(result))
+	return result, nil
+}
+
+func (c *CacheRubiks) RPCConfirm(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	return c.rubiks.RPCConfirm(rbr, deadline, kks, vvs)
+}
+
+func (c *CacheRubiks) RPCIterate(rbr *RubiksR, deadline time.Time,
+	cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+	return c.rubiks.RPCIterate(rbr, deadline, cursor, npairs, hint)
+}
+
+// put takes vvs over, they must not refer to RubiksR buffers. A cached
+// pair of a higher seqnum stays.
+func (c *CacheRubiks) put(kks []api.RubiksKK, vvs []api.RubiksVV)  {
+	now := time.Now()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for i, kk := range kks {
+		ttl, ok := c.caching.TTL[kk.Table]
+		if !ok {
+			continue
+		}
+
+		entry := &cacheEntry{id: cacheId(kk), vv: vvs[i], expires: now.Add(ttl)}
+		if elem, ok := c.entries[entry.id]; ok {
+			if elem.Value.(*cacheEntry).vv.Seqnum > entry.vv.Seqnum {
+				continue	// a get older than a commit since
+			}
+			elem.Value = entry
+			c.lru.MoveToFront(elem)
+			continue
+		}
+		c.entries[entry.id] = c.lru.PushFront(entry)
+
+		for c.lru.Len() > c.caching.Capacity {
+			c.remove(c.lru.Back())
+			c.stats.Evictions += 1
+		}
+	}
+}
+
+func (c *CacheRubiks) remove(elem *list.Element)  {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).id)
+}
+
+func cacheId(kk api.RubiksKK) string {
+	return string(append(serd.Append64BE(nil, uint64(kk.Table)), kk.Key...))
+}
@@ -0,0 +1,114 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+func Test2(t *testing.T)  {
+	fake := rubiks_fake.New()
+	caching := &client.Caching{
+		Capacity: 2,
+		TTL:      map[api.Table]time.Duration{1: time.Hour},
+	}
+	cache := client.NewCacheRubiks(fake, caching)
+	deadline := time.Now().Add(time.Second)
+
+	a, b, c := api.RubiksKK{Table: 1, Key: []byte("a")}, api.RubiksKK{Table: 1, Key: []byte("b")},
+		api.RubiksKK{Table: 1, Key: []byte("c")}
+	put := func(rubiks client.PooledRubiks, kk api.RubiksKK, val string) {
+		_, err := rubiks.Commit(deadline, []api.RubiksKK{kk},
+			[]api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: []byte(val)}})
+		misc.AssertNilError(err)
+	}
+	get := func(kks ...api.RubiksKK) []api.RubiksVV {
+		vvs, err := client.Pooled(cache).Get(deadline, kks)
+		misc.AssertNilError(err)
+		return vvs
+	}
+
+	// own commits write through
+	put(client.Pooled(cache), a, "a1")
+	fake.NRPC = 0
+	vvs := get(a)
+	misc.Assert(fake.NRPC == 0 && string(vvs[0].Val) == "a1" && vvs[0].Seqnum == 1)
+
+	// others' commits go unseen within the TTL
+	put(fake, a, "a2")
+	fake.NRPC = 0
+	misc.Assert(string(get(a)[0].Val) == "a1" && fake.NRPC == 0)
+	cache.Invalidate(a)
+	misc.Assert(string(get(a)[0].Val) == "a2" && fake.NRPC == 1)
+
+	// only misses are fetched, the least recent goes
+	fake.NRPC = 0
+	vvs = get(a, b)
+	misc.Assert(fake.NRPC == 1 && vvs[0].Present && !vvs[1].Present)
+	get(c)
+	fake.NRPC = 0
+	get(b, c)
+	misc.Assert(fake.NRPC == 0)
+	get(a)
+	misc.Assert(fake.NRPC == 1)
+
+	stats := cache.Stats()
+	misc.Assert(stats.Hits == 5 && stats.Misses == 4 && stats.Evictions == 2 && stats.Invalidations == 1)
+
+	// past the TTL, seqnums confirmed
+	caching.TTL[1], caching.Validate = 0, true
+	put(client.Pooled(cache), a, "a3")
+	fake.NRPC = 0
+	misc.Assert(string(get(a)[0].Val) == "a3" && fake.NRPC == 1)
+	put(fake, a, "a4")
+	fake.NRPC = 0
+	misc.Assert(string(get(a)[0].Val) == "a4" && fake.NRPC == 2)
+	misc.Assert(cache.Stats().Confirmed == 1)
+}
+
+// a get that returns after a newer commit leaves the commit cached
+type racedRubiks struct {
+	client.Rubiks
+	raced func()
+}
+
+func (r *racedRubiks) RPCGet(rbr *client.RubiksR, deadline time.Time,
+	kks []api.RubiksKK) ([]api.RubiksVV, error) {
+
+	vvs, err := r.Rubiks.RPCGet(rbr, deadline, kks)
+	if r.raced != nil {
+		raced := r.raced
+		r.raced = nil
+		raced()
+	}
+	return vvs, err
+}
+
+func Test12(t *testing.T)  {
+	raced := &racedRubiks{Rubiks: rubiks_fake.New()}
+	cache := client.NewCacheRubiks(raced, &client.Caching{
+		Capacity: 2,
+		TTL:      map[api.Table]time.Duration{1: time.Hour},
+	})
+	rubiks := client.Pooled(cache)
+	deadline := time.Now().Add(time.Second)
+
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("a")}}
+	commit := func(val string) {
+		_, err := rubiks.Commit(deadline, kks, []api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: []byte(val)}})
+		misc.AssertNilError(err)
+	}
+
+	commit("a1")
+	cache.Invalidate(kks...)
+	raced.raced = func() { commit("a2") }
+
+	vvs, err := rubiks.Get(deadline, kks)
+	misc.Assert(err == nil && string(vvs[0].Val) == "a1")
+
+	vvs, err = rubiks.Get(deadline, kks)
+	misc.Assert(err == nil && string(vvs[0].Val) == "a2" && vvs[0].Seqnum == 2)
+}
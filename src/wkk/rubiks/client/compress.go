@@ -0,0 +1,180 @@
+package client
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"time"
+	"wkk/common/unit"
+	"wkk/rubiks/api"
+)
+
+// Compression picks the tables whose values get deflated on the way in
+// and inflated on the way out. A compressed value is
+//
+//	CompressMagic | CompressFlate | deflate stream
+//
+// anything else is a raw value, so values of a table written before it
+// opted in read back fine. A raw value which happens to lead with
+// CompressMagic is stored behind CompressMagic | CompressRaw.
+type Compression struct {
+	Tables    map[api.Table]bool
+	Threshold int		// values shorter are stored raw
+	Level     int		// flate level, 0 for flate.DefaultCompression
+}
+
+const (
+	CompressMagic = byte(0xc5)
+	CompressRaw   = byte(0x00)
+	CompressFlate = byte(0x01)
+
+	// bounds an inflated value, against corrupted or hostile streams
+	MaxInflated   = 4 * unit.MiB
+)
+
+var ErrInflate = errors.New("bad compressed value")
+
+func NewCompressRubiks(rubiks Rubiks, compression *Compression) Rubiks {
+	return &compressRubiks{
+		rubiks:      rubiks,
+		compression: compression,
+	}
+}
+
+type compressRubiks struct {
+	rubiks      Rubiks
+	compression *Compression
+	writers     sync.Pool
+}
+
+func (c *compressRubiks) RPCGet(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK) ([]api.RubiksVV, error) {
+
+	vvs, err := c.rubiks.RPCGet(rbr, deadline, kks)
+	if err != nil {
+		return nil, err
+	}
+	return vvs, c.inflateAll(kks, vvs)
+}
+
+func (c *compressRubiks) RPCCommit(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+
+	deflated := make([]api.RubiksVV, len(vvs))
+	for i, vv := range vvs {
+		deflated[i] = vv
+		if vv.Present && c.compression.Tables[kks[i].Table] {
+			deflated[i].Val = c.deflate(vv.Val)
+		}
+	}
+
+	deflated, err := c.rubiks.RPCCommit(rbr, deadline, kks, deflated)
+	if err != nil {
+		return nil, err
+	} else if len(deflated) != len(vvs) {
+		return nil, api.EIO
+	}
+
+	for i := range vvs {
+		vvs[i].Seqnum = deflated[i].Seqnum
+	}
+	return vvs, nil
+}
+
+func (c *compressRubiks) RPCConfirm(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	return c.rubiks.RPCConfirm(rbr, deadline, kks, vvs)
+}
+
+func (c *compressRubiks) RPCIterate(rbr *RubiksR, deadline time.Time,
+	cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+
+	kks, vvs, err := c.rubiks.RPCIterate(rbr, deadline, cursor, npairs, hint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return kks, vvs, c.inflateAll(kks, vvs)
+}
+
+func (c *compressRubiks) deflate(val []byte) []byte {
+	raw := func() []byte {
+		if len(val) > 0 && val[0] == CompressMagic {
+			return append([]byte{CompressMagic, CompressRaw}, val...)
+		}
+		return val
+	}
+
+	if len(val) < c.compression.Threshold {
+		return raw()
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(val)))
+	buf.Write([]byte{CompressMagic, CompressFlate})
+
+	w, _ := c.writers.Get().(*flate.Writer)
+	if w == nil {
+		level := c.compression.Level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+
+		var err error
+		if w, err = flate.NewWriter(buf, level); err != nil {
+			return raw()
+		}
+	} else {
+		w.Reset(buf)
+	}
+	defer c.writers.Put(w)
+
+	if _, err := w.Write(val); err != nil || w.Close() != nil {
+		return raw()
+	}
+
+	// not worth it
+	if buf.Len() >= len(val) {
+		return raw()
+	}
+	return buf.Bytes()
+}
+
+func (c *compressRubiks) inflateAll(kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	for i := range vvs {
+		if !vvs[i].Present || !c.compression.Tables[kks[i].Table] {
+			continue
+		}
+
+		val, err := inflate(vvs[i].Val)
+		if err != nil {
+			return err
+		}
+		vvs[i].Val = val
+	}
+	return nil
+}
+
+func inflate(val []byte) ([]byte, error) {
+	if len(val) == 0 || val[0] != CompressMagic {
+		return val, nil
+	} else if len(val) < 2 {
+		return nil, ErrInflate
+	}
+
+	switch val[1] {
+	case CompressRaw:
+		return val[2:], nil
+
+	case CompressFlate:
+		r := flate.NewReader(bytes.NewReader(val[2:]))
+		defer r.Close()
+
+		result, err := io.ReadAll(io.LimitReader(r, MaxInflated + 1))
+		if err != nil || len(result) > MaxInflated {
+			return nil, ErrInflate
+		}
+		return result, nil
+	}
+	return nil, ErrInflate
+}
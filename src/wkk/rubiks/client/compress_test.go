@@ -0,0 +1,71 @@
+package client_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+func Test0(t *testing.T)  {
+	fake := rubiks_fake.New()
+	rubiks := client.Pooled(client.NewCompressRubiks(fake, &client.Compression{
+		Tables:    map[api.Table]bool{1: true},
+		Threshold: 64,
+	}))
+	deadline := time.Now().Add(time.Second)
+
+	json := bytes.Repeat([]byte(`{"Name":"Kyle","Score":10},`), 1000)
+	noise := make([]byte, 1000)
+	rand.Read(noise)
+
+	kks := []api.RubiksKK{
+		{Table: 1, Key: []byte("json")},
+		{Table: 1, Key: []byte("short")},
+		{Table: 1, Key: []byte("noise")},
+		{Table: 1, Key: []byte("magic")},
+		{Table: 2, Key: []byte("json")},
+	}
+	vals := [][]byte{json, []byte("short"), noise, {client.CompressMagic, client.CompressFlate}, json[:8000]}
+
+	var vvs []api.RubiksVV
+	for _, val := range vals {
+		vvs = append(vvs, api.RubiksVV{Present: true, Seqnum: api.SeqnumInf, Val: val})
+	}
+	vvs, err := rubiks.Commit(deadline, kks, vvs)
+	misc.AssertNilError(err)
+	misc.Assert(vvs[0].Seqnum == 1 && bytes.Equal(vvs[0].Val, json))
+
+	// as stored
+	misc.Assert(len(fake.Lookup(kks[0]).Val) < len(json) / 10)
+	misc.Assert(string(fake.Lookup(kks[1]).Val) == "short")
+	misc.Assert(len(fake.Lookup(kks[2]).Val) == len(noise))
+	misc.Assert(len(fake.Lookup(kks[3]).Val) == 4)
+	misc.Assert(len(fake.Lookup(kks[4]).Val) == 8000)
+
+	vvs, err = rubiks.Get(deadline, kks)
+	misc.AssertNilError(err)
+	for i, val := range vals {
+		misc.Assert(bytes.Equal(vvs[i].Val, val))
+	}
+
+	kks1, vvs, err := rubiks.Iterate(deadline, api.RubiksKK{Table: 1}, api.MaxNPairs, api.IterateHintAll)
+	misc.Assert(err == nil && len(kks1) == 4)
+	for i := range kks1 {
+		misc.Assert(len(vvs[i].Val) == 1000 || len(vvs[i].Val) == len(json) ||
+			len(vvs[i].Val) == 5 || len(vvs[i].Val) == 2)
+	}
+
+	// a stream inflating past MaxInflated is refused
+	bomb := client.Pooled(client.NewCompressRubiks(fake, &client.Compression{Tables: map[api.Table]bool{3: true}}))
+	kk := api.RubiksKK{Table: 3, Key: []byte("bomb")}
+	_, err = bomb.Commit(deadline, []api.RubiksKK{kk},
+		[]api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: make([]byte, client.MaxInflated + 1)}})
+	misc.AssertNilError(err)
+	_, err = bomb.Get(deadline, []api.RubiksKK{kk})
+	misc.Assert(err == client.ErrInflate)
+}
@@ -0,0 +1,269 @@
+package client
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"wkk/common/serd"
+	"wkk/rubiks/api"
+)
+
+// KeyProvider unwraps the data keys of a table with its key encryption
+// key, which never leaves it, e.g. a KMS.
+type KeyProvider interface {
+	Unwrap(table api.Table, wrapped []byte) ([]byte, error)
+}
+
+// Encryption seals the values of Tables with AES-GCM as
+//
+//	EncryptMagic | EncryptGCM | keyId(4) | nonce(12) | ciphertext
+//
+// authenticated along with table and key, so a value moved under another
+// key fails as well. Keys stay in the clear for ordering. Put it under
+// compression, ciphertext doesn't compress.
+//
+// The data keys of a table are kept wrapped in DataKeys, keyId is their
+// index. New values go under the last one, older ones name theirs so
+// keys can rotate with values of both around. Keys unwraps a data key
+// once, on its first use.
+type Encryption struct {
+	Tables    map[api.Table]bool
+	DataKeys  map[api.Table][][]byte
+	Keys      KeyProvider
+	Plaintext bool	// read values written before the table opted in
+}
+
+const (
+	EncryptMagic = byte(0xe5)
+	EncryptGCM   = byte(0x01)
+
+	encryptHeader = 2 + 4 + 12
+)
+
+var (
+	ErrTampered  = errors.New("value fails authentication")
+	ErrPlaintext = errors.New("value not encrypted")	// see Encryption.Plaintext
+)
+
+func NewEncryptRubiks(rubiks Rubiks, encryption *Encryption) Rubiks {
+	return &encryptRubiks{
+		rubiks:     rubiks,
+		encryption: encryption,
+	}
+}
+
+type encryptRubiks struct {
+	rubiks     Rubiks
+	encryption *Encryption
+	aeads      sync.Map	// aeadId -> cipher.AEAD
+}
+
+type aeadId struct {
+	table api.Table
+	keyId uint32
+}
+
+func (e *encryptRubiks) RPCGet(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK) ([]api.RubiksVV, error) {
+
+	vvs, err := e.rubiks.RPCGet(rbr, deadline, kks)
+	if err != nil {
+		return nil, err
+	}
+	return vvs, e.openAll(kks, vvs)
+}
+
+func (e *encryptRubiks) RPCCommit(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+
+	sealed := make([]api.RubiksVV, len(vvs))
+	for i, vv := range vvs {
+		sealed[i] = vv
+		if vv.Present && e.encryption.Tables[kks[i].Table] {
+			val, err := e.seal(kks[i], vv.Val)
+			if err != nil {
+				return nil, err
+			}
+			sealed[i].Val = val
+		}
+	}
+
+	sealed, err := e.rubiks.RPCCommit(rbr, deadline, kks, sealed)
+	if err != nil {
+		return nil, err
+	} else if len(sealed) != len(vvs) {
+		return nil, api.EIO
+	}
+
+	for i := range vvs {
+		vvs[i].Seqnum = sealed[i].Seqnum
+	}
+	return vvs, nil
+}
+
+func (e *encryptRubiks) RPCConfirm(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	return e.rubiks.RPCConfirm(rbr, deadline, kks, vvs)
+}
+
+func (e *encryptRubiks) RPCIterate(rbr *RubiksR, deadline time.Time,
+	cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+
+	kks, vvs, err := e.rubiks.RPCIterate(rbr, deadline, cursor, npairs, hint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return kks, vvs, e.openAll(kks, vvs)
+}
+
+func (e *encryptRubiks) aead(table api.Table, keyId uint32) (cipher.AEAD, error) {
+	id := aeadId{table, keyId}
+	if aead, ok := e.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+
+	wrapped := e.encryption.DataKeys[table]
+	if int(keyId) >= len(wrapped) {
+		return nil, fmt.Errorf("no key %d for table %d", keyId, table)
+	}
+	key, err := e.encryption.Keys.Unwrap(table, wrapped[keyId])
+	if err != nil {
+		return nil, fmt.Errorf("key %d of table %d: %w", keyId, table, err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %d of table %d: %w", keyId, table, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	e.aeads.Store(id, aead)
+	return aead, nil
+}
+
+func (e *encryptRubiks) seal(kk api.RubiksKK, val []byte) ([]byte, error) {
+	keyId := len(e.encryption.DataKeys[kk.Table]) - 1
+	if keyId < 0 {
+		return nil, fmt.Errorf("no key for table %d", kk.Table)
+	}
+
+	aead, err := e.aead(kk.Table, uint32(keyId))
+	if err != nil {
+		return nil, err
+	}
+
+	dst := make([]byte, encryptHeader, encryptHeader + len(val) + aead.Overhead())
+	dst[0], dst[1] = EncryptMagic, EncryptGCM
+	serd.Put64BE(4, dst[2:], uint64(keyId))
+
+	nonce := dst[6:encryptHeader]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, val, additional(kk)), nil
+}
+
+func (e *encryptRubiks) open(kk api.RubiksKK, val []byte) ([]byte, error) {
+	if len(val) == 0 || val[0] != EncryptMagic {
+		if e.encryption.Plaintext {
+			return val, nil
+		}
+		return nil, ErrPlaintext
+	} else if len(val) < encryptHeader || val[1] != EncryptGCM {
+		return nil, ErrTampered
+	}
+
+	keyId, _, _ := serd.Get64BE(4, val[2:])
+	aead, err := e.aead(kk.Table, uint32(keyId))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := aead.Open(nil, val[6:encryptHeader], val[encryptHeader:], additional(kk))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return result, nil
+}
+
+func (e *encryptRubiks) openAll(kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	for i := range vvs {
+		if !vvs[i].Present || !e.encryption.Tables[kks[i].Table] {
+			continue
+		}
+
+		val, err := e.open(kks[i], vvs[i].Val)
+		if err != nil {
+			return fmt.Errorf("%v: %w", kks[i], err)
+		}
+		vvs[i].Val = val
+	}
+	return nil
+}
+
+func additional(kk api.RubiksKK) []byte {
+	return append(serd.Append64BE(nil, uint64(kk.Table)), kk.Key...)
+}
+
+// StaticKEK is a KeyProvider over the key encryption keys at hand, by
+// table, for tests and setups without a KMS.
+type StaticKEK map[api.Table][]byte
+
+// NewDataKey makes a data key for table, wrapped to go in DataKeys
+func (s StaticKEK) NewDataKey(table api.Table) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return s.Wrap(table, key)
+}
+
+// Wrap seals key as nonce(12) | ciphertext, authenticated along with table
+func (s StaticKEK) Wrap(table api.Table, key []byte) ([]byte, error) {
+	aead, err := s.aead(table)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(key) + aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, key, serd.Append64BE(nil, uint64(table))), nil
+}
+
+func (s StaticKEK) Unwrap(table api.Table, wrapped []byte) ([]byte, error) {
+	aead, err := s.aead(table)
+	if err != nil {
+		return nil, err
+	} else if len(wrapped) < aead.NonceSize() {
+		return nil, ErrTampered
+	}
+
+	n := aead.NonceSize()
+	key, err := aead.Open(nil, wrapped[:n], wrapped[n:], serd.Append64BE(nil, uint64(table)))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return key, nil
+}
+
+func (s StaticKEK) aead(table api.Table) (cipher.AEAD, error) {
+	kek, ok := s[table]
+	if !ok {
+		return nil, fmt.Errorf("no key encryption key for table %d", table)
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,96 @@
+package client_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+func Test1(t *testing.T)  {
+	fake := rubiks_fake.New()
+	kek := client.StaticKEK{1: bytes.Repeat([]byte{1}, 32)}
+	dataKey := func() []byte {
+		wrapped, err := kek.NewDataKey(1)
+		misc.AssertNilError(err)
+		return wrapped
+	}
+	encryption := &client.Encryption{
+		Tables:   map[api.Table]bool{1: true},
+		DataKeys: map[api.Table][][]byte{1: {dataKey()}},
+		Keys:     kek,
+	}
+	rubiks := client.Pooled(client.NewEncryptRubiks(fake, encryption))
+	deadline := time.Now().Add(time.Second)
+
+	kks := []api.RubiksKK{
+		{Table: 1, Key: []byte("alice")},
+		{Table: 1, Key: []byte("bob")},
+		{Table: 2, Key: []byte("alice")},
+	}
+	put := func(kk api.RubiksKK, val string) {
+		_, err := rubiks.Commit(deadline, []api.RubiksKK{kk},
+			[]api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: []byte(val)}})
+		misc.AssertNilError(err)
+	}
+	get := func(kk api.RubiksKK) (string, error) {
+		vvs, err := rubiks.Get(deadline, []api.RubiksKK{kk})
+		if err != nil {
+			return "", err
+		}
+		return string(vvs[0].Val), nil
+	}
+
+	put(kks[0], "alice@example.com")
+	put(kks[2], "in the clear")
+	misc.Assert(!bytes.Contains(fake.Lookup(kks[0]).Val, []byte("alice")))
+	misc.Assert(string(fake.Lookup(kks[2]).Val) == "in the clear")
+
+	// rotated, both keys readable
+	encryption.DataKeys[1] = append(encryption.DataKeys[1], dataKey())
+	put(kks[1], "bob@example.com")
+	misc.Assert(fake.Lookup(kks[1]).Val[5] == 1)
+
+	val, err := get(kks[0])
+	misc.Assert(err == nil && val == "alice@example.com")
+	val, err = get(kks[1])
+	misc.Assert(err == nil && val == "bob@example.com")
+
+	_, vvs, err := rubiks.Iterate(deadline, api.RubiksKK{Table: 1}, api.MaxNPairs, api.IterateHintAll)
+	misc.Assert(err == nil && len(vvs) == 2 && string(vvs[0].Val) == "alice@example.com")
+
+	// flipped bit, value moved under another key
+	sealed := fake.Lookup(kks[0]).Val
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered) - 1] ^= 1
+
+	for _, val := range [][]byte{tampered, sealed} {
+		_, err = fake.Commit(deadline, kks[1:2], []api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: val}})
+		misc.AssertNilError(err)
+		_, err = get(kks[1])
+		misc.Assert(errors.Is(err, client.ErrTampered))
+	}
+
+	// plaintext, read once allowed and sealed when written back
+	_, err = fake.Commit(deadline, kks[1:2], []api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: []byte("plain")}})
+	misc.AssertNilError(err)
+	_, err = get(kks[1])
+	misc.Assert(errors.Is(err, client.ErrPlaintext))
+
+	encryption.Plaintext = true
+	val, err = get(kks[1])
+	misc.Assert(err == nil && val == "plain")
+	put(kks[1], val)
+	misc.Assert(fake.Lookup(kks[1]).Val[0] == client.EncryptMagic)
+
+	// data keys only unwrap under their table's key encryption key
+	encryption.DataKeys[1][0][len(encryption.DataKeys[1][0]) - 1] ^= 1
+	_, err = kek.Unwrap(1, encryption.DataKeys[1][0])
+	misc.Assert(errors.Is(err, client.ErrTampered))
+	_, err = kek.Unwrap(2, encryption.DataKeys[1][1])
+	misc.Assert(err != nil)
+}
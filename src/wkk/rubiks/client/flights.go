@@ -0,0 +1,104 @@
+package client
+
+import (
+	"sync"
+	"time"
+	"wkk/common/serd"
+	"wkk/rubiks/api"
+)
+
+// getFlights lets identical gets in flight at once share the request of
+// the first one, the leader. Followers wait till their own deadline, and
+// share what the server told only. Should the leader fail on its own,
+// on its deadline, context or limits, followers with time left take over.
+type getFlights struct {
+	mtx     sync.Mutex
+	flights map[string]*getFlight
+}
+
+type getFlight struct {
+	done   chan struct{}
+	shared bool				// vvs and err are the server's
+	vvs    []api.RubiksVV	// copied out of the leader's RubiksR
+	err    error
+}
+
+func newGetFlights() *getFlights {
+	return &getFlights{flights: make(map[string]*getFlight)}
+}
+
+func (g *getFlights) do(deadline time.Time, kks []api.RubiksKK,
+	fn func() ([]api.RubiksVV, error)) ([]api.RubiksVV, error) {
+
+	id := flightId(kks)
+
+	for {
+		g.mtx.Lock()
+		f, follower := g.flights[id]
+		if !follower {
+			f = &getFlight{done: make(chan struct{})}
+			g.flights[id] = f
+		}
+		g.mtx.Unlock()
+
+		if !follower {
+			return g.lead(id, f, fn)
+		}
+
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case <- f.done:
+			timer.Stop()
+		case <- timer.C:
+			return nil, api.TIMEOUT
+		}
+
+		if !f.shared && time.Now().Before(deadline) {
+			continue
+		} else if !f.shared {
+			return nil, api.TIMEOUT
+		} else if f.err != nil {
+			return nil, f.err
+		}
+		return CloneVVs(f.vvs), nil
+	}
+}
+
+// lead lets the followers go however fn ends, a panic included
+func (g *getFlights) lead(id string, f *getFlight,
+	fn func() ([]api.RubiksVV, error)) ([]api.RubiksVV, error) {
+
+	defer func() {
+		g.mtx.Lock()
+		delete(g.flights, id)
+		g.mtx.Unlock()
+
+		close(f.done)
+	}()
+
+	vvs, err := fn()
+	if err == nil {
+		f.vvs = CloneVVs(vvs)
+	}
+	f.err = err
+	f.shared = fromServer(err)
+	return vvs, err
+}
+
+// fromServer tells results of the server from failures of the request
+// alone, TIMEOUT being of its deadline
+func fromServer(err error) bool {
+	oc, ok := err.(api.Outcome)
+	return err == nil || (ok && oc != api.TIMEOUT)
+}
+
+func flightId(kks []api.RubiksKK) string {
+	var id []byte
+
+	for _, kk := range kks {
+		id = serd.Append64BE(id, uint64(kk.Table))
+		id = serd.Append24BE(id, len(kk.Key))
+		id = append(id, kk.Key...)
+	}
+	return string(id)
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/rubiks/api"
+)
+
+func Test3(t *testing.T)  {
+	g := newGetFlights()
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("hot")}}
+	release := make(chan struct{})
+	var nreq int32
+
+	fn := func() ([]api.RubiksVV, error) {
+		atomic.AddInt32(&nreq, 1)
+		<- release
+		return []api.RubiksVV{{Present: true, Seqnum: 7, Val: []byte("v")}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vvs, err := g.do(time.Now().Add(time.Second), kks, fn)
+			misc.Assert(err == nil && vvs[0].Seqnum == 7 && string(vvs[0].Val) == "v")
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	misc.Assert(atomic.LoadInt32(&nreq) == 1)
+
+	// followers keep their deadline, and outlive the leader's
+	block := make(chan struct{})
+	go g.do(time.Now().Add(time.Second), kks, func() ([]api.RubiksVV, error) {
+		<- block
+		return nil, api.TIMEOUT
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := g.do(time.Now().Add(10 * time.Millisecond), kks, fn)
+	misc.Assert(err == api.TIMEOUT)
+
+	done := make(chan error)
+	go func() {
+		_, err := g.do(time.Now().Add(time.Second), kks, fn)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(block)
+	misc.Assert(<- done == nil && atomic.LoadInt32(&nreq) == 2)
+
+	// nor are the leader's context, limits or panic theirs
+	for _, fail := range []func() ([]api.RubiksVV, error){
+		func() ([]api.RubiksVV, error) { <- block; return nil, context.Canceled },
+		func() ([]api.RubiksVV, error) { <- block; return nil, ErrLimited },
+		func() ([]api.RubiksVV, error) { <- block; panic("leader") },
+	} {
+		block = make(chan struct{})
+		go func() {
+			defer func() { recover() }()
+			g.do(time.Now().Add(time.Second), kks, fail)
+		}()
+		time.Sleep(10 * time.Millisecond)
+
+		go func() {
+			_, err := g.do(time.Now().Add(time.Second), kks, fn)
+			done <- err
+		}()
+		time.Sleep(10 * time.Millisecond)
+		close(block)
+		misc.Assert(<- done == nil)
+	}
+
+	// what the server told is shared
+	block = make(chan struct{})
+	go g.do(time.Now().Add(time.Second), kks, func() ([]api.RubiksVV, error) {
+		<- block
+		return nil, api.EIO
+	})
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		_, err := g.do(time.Now().Add(time.Second), kks, fn)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(block)
+	misc.Assert(<- done == api.EIO && atomic.LoadInt32(&nreq) == 5)
+}
@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+// Limits of a Limiter, zero for none. Rates are requests per second with
+// bursts of as many, Burst at least one.
+type Limits struct {
+	Rate        float64
+	TableRate   map[api.Table]float64
+	Burst       int
+
+	MaxInFlight         int		// per client
+	MaxInFlightEndpoint int		// per endpoint
+
+	// fail with ErrLimited rather than wait till the deadline, or the
+	// context of the RubiksR
+	FailFast    bool
+}
+
+var ErrLimited = errors.New("rubiks client over its limits")
+
+// Limiter is enforced by RubiksCM.Submit, share one among clients to
+// limit them together. Limits may change any time by SetLimits.
+type Limiter struct {
+	mtx      sync.Mutex
+	limits   Limits
+	bucket   bucket
+	tables   map[api.Table]*bucket
+	inflight int
+	endpoint map[string]int		// by address, clients list them apart
+	released chan struct{}	// closed on every release
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(limits Limits) *Limiter {
+	l := &Limiter{
+		tables:   make(map[api.Table]*bucket),
+		endpoint: make(map[string]int),
+		released: make(chan struct{}),
+	}
+	l.SetLimits(limits)
+	return l
+}
+
+func (l *Limiter) SetLimits(limits Limits)  {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if limits.Burst < 1 {
+		limits.Burst = 1
+	}
+	l.limits = limits
+
+	// waiters go over the new limits
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+func (l *Limiter) Limits() Limits {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.limits
+}
+
+func (l *Limiter) acquire(ctx context.Context, deadline time.Time, table api.Table, ep network.Endpoint) error {
+	for {
+		l.mtx.Lock()
+		wait, ok := l.take(table, ep.String())
+		released := l.released
+		failFast := l.limits.FailFast
+		l.mtx.Unlock()
+
+		if ok {
+			return nil
+		} else if failFast {
+			return ErrLimited
+		}
+
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return api.TIMEOUT
+		}
+
+		timer := time.NewTimer(min(wait, timeout))
+		select {
+		case <- timer.C:
+		case <- released:
+			timer.Stop()
+		case <- ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// take is all or nothing, otherwise tells how long a token is away
+func (l *Limiter) take(table api.Table, ep string) (time.Duration, bool) {
+	now := time.Now()
+
+	if (l.limits.MaxInFlight > 0 && l.inflight >= l.limits.MaxInFlight) ||
+		(l.limits.MaxInFlightEndpoint > 0 && l.endpoint[ep] >= l.limits.MaxInFlightEndpoint) {
+		return time.Duration(math.MaxInt64), false
+	}
+
+	tableRate, ok := l.limits.TableRate[table]
+	if !ok {
+		delete(l.tables, table)
+	} else if l.tables[table] == nil {
+		l.tables[table] = &bucket{tokens: float64(l.limits.Burst), last: now}
+	}
+
+	wait := max(l.bucket.refill(now, l.limits.Rate, l.limits.Burst),
+		l.tables[table].refill(now, tableRate, l.limits.Burst))
+	if wait > 0 {
+		return wait, false
+	}
+
+	if l.limits.Rate > 0 {
+		l.bucket.tokens -= 1
+	}
+	if l.tables[table] != nil {
+		l.tables[table].tokens -= 1
+	}
+	l.inflight += 1
+	l.endpoint[ep] += 1
+	return 0, true
+}
+
+func (l *Limiter) release(ep network.Endpoint)  {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	addr := ep.String()
+	l.inflight -= 1
+	if l.endpoint[addr] -= 1; l.endpoint[addr] == 0 {
+		delete(l.endpoint, addr)
+	}
+
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// refill tells how long till a token, 0 if there is one
+func (b *bucket) refill(now time.Time, rate float64, burst int) time.Duration {
+	if b == nil {
+		return 0
+	} else if rate <= 0 {
+		b.last = time.Time{}	// full once limited again
+		return 0
+	}
+
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = math.Min(float64(burst), b.tokens + now.Sub(b.last).Seconds() * rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second)) + 1
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+func Test5(t *testing.T)  {
+	ctx := context.Background()
+	l := NewLimiter(Limits{Rate: 100, Burst: 5})
+	far := time.Now().Add(time.Second)
+	ep0, ep1 := network.MkEndpoint(0x7f000001, 1), network.MkEndpoint(0x7f000001, 2)
+
+	// the burst goes at once, then 10ms a request
+	start := time.Now()
+	for i := 0; i < 5 + 5; i += 1 {
+		misc.AssertNilError(l.acquire(ctx, far, 1, ep0))
+		l.release(ep0)
+	}
+	elapsed := time.Since(start)
+	misc.Assert(elapsed > 40 * time.Millisecond && elapsed < 500 * time.Millisecond)
+
+	misc.Assert(l.acquire(ctx, time.Now().Add(time.Millisecond), 1, ep0) == api.TIMEOUT)
+
+	// a table of its own rate, adjusted at runtime
+	l.SetLimits(Limits{TableRate: map[api.Table]float64{2: 1}, FailFast: true})
+	misc.AssertNilError(l.acquire(ctx, far, 2, ep0))
+	misc.Assert(l.acquire(ctx, far, 2, ep0) == ErrLimited)
+	misc.AssertNilError(l.acquire(ctx, far, 3, ep0))
+
+	// in flight, per endpoint then per client
+	l = NewLimiter(Limits{MaxInFlight: 3, MaxInFlightEndpoint: 2})
+	misc.AssertNilError(l.acquire(ctx, far, 1, ep0))
+	misc.AssertNilError(l.acquire(ctx, far, 1, ep0))
+	misc.AssertNilError(l.acquire(ctx, far, 1, ep1))
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	misc.Assert(l.acquire(cctx, far, 1, ep1) == context.Canceled)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		l.release(ep0)
+	}()
+	misc.AssertNilError(l.acquire(ctx, far, 1, ep1))
+	misc.Assert(l.inflight == 3 && l.endpoint[ep0.String()] == 1 && l.endpoint[ep1.String()] == 2)
+
+	// by address, whichever client lists it
+	l.release(ep0)
+	misc.Assert(l.acquire(ctx, time.Now(), 1, network.MkEndpoint(0x7f000001, 2)) == api.TIMEOUT)
+	misc.AssertNilError(l.acquire(ctx, far, 1, network.MkEndpoint(0x7f000001, 1)))
+}
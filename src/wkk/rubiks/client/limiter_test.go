@@ -0,0 +1,106 @@
+package client_test
+
+import (
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+func Test6(t *testing.T)  {
+	server, err := rubiks_fake.NewServer(rubiks_fake.New())
+	misc.AssertNilError(err)
+	defer server.Close()
+
+	limiter := client.NewLimiter(client.Limits{TableRate: map[api.Table]float64{1: 1}, FailFast: true})
+	config := *client.FavoredConfig
+	config.Limiter = limiter
+	rubiks := client.Pooled(client.NewRubiksClient2(network.EndpointList{server.Endpoint()}, &config))
+	deadline := time.Now().Add(time.Second)
+
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("a")}}
+	_, err = rubiks.Get(deadline, kks)
+	misc.AssertNilError(err)
+	_, err = rubiks.Get(deadline, kks)
+	misc.Assert(err == client.ErrLimited && server.NReq() == 1)
+
+	_, err = rubiks.Get(deadline, []api.RubiksKK{{Table: 2, Key: []byte("a")}})
+	misc.AssertNilError(err)
+
+	limiter.SetLimits(client.Limits{})
+	_, err = rubiks.Get(deadline, kks)
+	misc.Assert(err == nil && server.NReq() == 3)
+}
+
+func Test7(t *testing.T)  {
+	fake := rubiks_fake.New()
+	servers := make([]*rubiks_fake.Server, 2)
+	var epl network.EndpointList
+	for i := range servers {
+		server, err := rubiks_fake.NewServer(fake)
+		misc.AssertNilError(err)
+		defer server.Close()
+		servers[i], epl = server, append(epl, server.Endpoint())
+	}
+
+	config := *client.FavoredConfig
+	config.Retry = &client.SimpleRetry{}
+	config.Breaking = &client.Breaking{ConsecutiveFailures: 2, OpenFor: time.Hour, Probes: 1}
+	rubiks := client.Pooled(client.NewRubiksClient2(epl, &config))
+	deadline := time.Now().Add(time.Second)
+
+	// one endpoint times out, the other fails, both open in the end
+	servers[0].Inject(func(kind uint64) (time.Duration, api.Outcome) {
+		return 50 * time.Millisecond, api.OK
+	})
+	servers[1].Inject(func(kind uint64) (time.Duration, api.Outcome) {
+		return 0, api.EIO
+	})
+
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("a")}}
+	for i := 0; i < 4; i += 1 {
+		rubiks.Get(time.Now().Add(10 * time.Millisecond), kks)
+	}
+	servers[0].Inject(nil)
+	servers[1].Inject(nil)
+
+	_, err := rubiks.Get(deadline, kks)
+	misc.Assert(err == api.EIO)
+}
+
+// probes taken by requests over the limits go back, the breaker closes
+func Test11(t *testing.T)  {
+	server, err := rubiks_fake.NewServer(rubiks_fake.New())
+	misc.AssertNilError(err)
+	defer server.Close()
+
+	limiter := client.NewLimiter(client.Limits{TableRate: map[api.Table]float64{1: 0.001}, FailFast: true})
+	config := *client.FavoredConfig
+	config.Retry = &client.SimpleRetry{}
+	config.Breaking = &client.Breaking{ConsecutiveFailures: 1, OpenFor: 20 * time.Millisecond, Probes: 1}
+	config.Limiter = limiter
+	rubiks := client.Pooled(client.NewRubiksClient2(network.EndpointList{server.Endpoint()}, &config))
+	deadline := time.Now().Add(time.Second)
+
+	// the only token goes on a failure, which opens
+	server.Inject(func(kind uint64) (time.Duration, api.Outcome) {
+		return 0, api.EIO
+	})
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("a")}}
+	_, err = rubiks.Get(deadline, kks)
+	misc.Assert(err == api.EIO)
+	server.Inject(nil)
+
+	time.Sleep(25 * time.Millisecond)
+	for i := 0; i < 3; i += 1 {
+		_, err = rubiks.Get(deadline, kks)
+		misc.Assert(err == client.ErrLimited)
+	}
+
+	limiter.SetLimits(client.Limits{})
+	_, err = rubiks.Get(deadline, kks)
+	misc.AssertNilError(err)
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"sync"
+	"time"
+	"wkk/rubiks/api"
+)
+
+var rbrPool = sync.Pool{
+	New: func() interface{} {
+		return NewRubiksR()
+	},
+}
+
+// AcquireRubiksR hands out a RubiksR from a process wide pool, results
+// returned by an RPC refer to its buffers until ReleaseRubiksR.
+func AcquireRubiksR() *RubiksR {
+	return rbrPool.Get().(*RubiksR)
+}
+
+func ReleaseRubiksR(r *RubiksR)  {
+	// drop a late wakeup of a timed out request
+	select {
+	case <- r.wakeup:
+	default:
+	}
+	r.ctx, r.topology = nil, nil
+	rbrPool.Put(r)
+}
+
+func Pooled(rubiks Rubiks) PooledRubiks {
+	if pr, ok := rubiks.(PooledRubiks); ok {
+		return pr
+	}
+	return pooledRubiks{rubiks}
+}
+
+type pooledRubiks struct {
+	Rubiks
+}
+
+func (p pooledRubiks) Get(deadline time.Time, kks []api.RubiksKK) ([]api.RubiksVV, error) {
+	return pooledGet(p.Rubiks, deadline, kks)
+}
+
+func (p pooledRubiks) Commit(deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+	return pooledCommit(p.Rubiks, deadline, kks, vvs)
+}
+
+func (p pooledRubiks) Confirm(deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	return pooledConfirm(p.Rubiks, deadline, kks, vvs)
+}
+
+func (p pooledRubiks) Iterate(deadline time.Time, cursor api.RubiksKK,
+	npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+	return pooledIterate(p.Rubiks, deadline, cursor, npairs, hint)
+}
+
+// helpers behind the RubiksR free methods of PooledRubiks, for any implementation
+
+func pooledGet(rubiks Rubiks, deadline time.Time, kks []api.RubiksKK) ([]api.RubiksVV, error) {
+	rbr := AcquireRubiksR()
+	defer ReleaseRubiksR(rbr)
+
+	vvs, err := rubiks.RPCGet(rbr, deadline, kks)
+	if err != nil {
+		return nil, err
+	}
+	return CloneVVs(vvs), nil
+}
+
+func pooledCommit(rubiks Rubiks, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+	rbr := AcquireRubiksR()
+	defer ReleaseRubiksR(rbr)
+
+	vvs, err := rubiks.RPCCommit(rbr, deadline, kks, vvs)
+	if err != nil {
+		return nil, err
+	}
+	return CloneVVs(vvs), nil
+}
+
+func pooledConfirm(rubiks Rubiks, deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	rbr := AcquireRubiksR()
+	defer ReleaseRubiksR(rbr)
+
+	return rubiks.RPCConfirm(rbr, deadline, kks, vvs)
+}
+
+func pooledIterate(rubiks Rubiks, deadline time.Time, cursor api.RubiksKK,
+	npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+	rbr := AcquireRubiksR()
+	defer ReleaseRubiksR(rbr)
+
+	kks, vvs, err := rubiks.RPCIterate(rbr, deadline, cursor, npairs, hint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return CloneKKs(kks), CloneVVs(vvs), nil
+}
+
+func CloneKKs(kks []api.RubiksKK) []api.RubiksKK {
+	if kks == nil {
+		return nil
+	}
+
+	result := make([]api.RubiksKK, len(kks))
+	for i, kk := range kks {
+		result[i] = api.RubiksKK{
+			Table: kk.Table,
+			Key:   append([]byte{}, kk.Key...),
+		}
+	}
+	return result
+}
+
+func CloneVVs(vvs []api.RubiksVV) []api.RubiksVV {
+	if vvs == nil {
+		return nil
+	}
+
+	result := make([]api.RubiksVV, len(vvs))
+	for i, vv := range vvs {
+		result[i] = vv
+		if vv.Val != nil {
+			result[i].Val = append([]byte{}, vv.Val...)
+		}
+	}
+	return result
+}
@@ -21,7 +21,7 @@ func (r *SimpleRetry) Fn(fn func() error) error {
 	var err error
 
 	for i := 0; i < 3; i += 1 {
-		if err = fn(); err == nil || !err.(api.Outcome).Retryable() {
+		if err = fn(); !retryable(err) {
 			return err
 		}
 	}
@@ -45,7 +45,7 @@ func (r *ExpBackRetry) Fn(fn func() error) error {
 	backoff := r.Low
 
 	for i := 0; i < 5; i += 1 {
-		if err = fn(); err == nil || !err.(api.Outcome).Retryable() {
+		if err = fn(); !retryable(err) {
 			return err
 		}
 
@@ -54,4 +54,10 @@ func (r *ExpBackRetry) Fn(fn func() error) error {
 	}
 
 	return err
-}
\ No newline at end of file
+}
+
+// errors other than outcomes, e.g. of limits or contexts, are final
+func retryable(err error) bool {
+	oc, ok := err.(api.Outcome)
+	return ok && oc.Retryable()
+}
@@ -0,0 +1,229 @@
+package client
+
+import (
+	"cmp"
+	"math"
+	"sort"
+	"sync"
+	"wkk/common/perm"
+	"wkk/common/siphash"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+// Router places requests on endpoints. Hint condenses the kk of a request,
+// Rank orders the endpoints for a hint, best first, the rest stand in for
+// it while its breaker is open.
+type Router interface {
+	Hint(kk api.RubiksKK) uint64
+
+	Rank(hint uint64, epl network.EndpointList) []int
+}
+
+var FavoredRouter Router = &XorRouter{HintFn: FineHint}
+
+// PrefixHint hashes table and the leading prefix bytes of the key, or
+// with prefix 0 or less, the key but its last -prefix bytes. FineHint
+// is PrefixHint(kk, -1), CoarseHint PrefixHint(kk, -2).
+func PrefixHint(kk api.RubiksKK, prefix int) uint64 {
+	n := len(kk.Key) + prefix
+	if prefix > 0 {
+		n = prefix
+	}
+
+	if n > len(kk.Key) {
+		n = len(kk.Key)
+	}
+	if n <= 0 {
+		return perm.Perm64(uint64(kk.Table))
+	}
+	return perm.Perm64(uint64(kk.Table)) ^ siphash.Siphash(kk.Key[:n], siphash.DefaultTweak)
+}
+
+// XorRouter is the original routing, the hint XORed with the address of
+// an endpoint ranks it. Balance depends on the addresses.
+type XorRouter struct {
+	HintFn func(kk api.RubiksKK) uint64
+}
+
+func (r *XorRouter) Hint(kk api.RubiksKK) uint64 {
+	return r.HintFn(kk)
+}
+
+func (r *XorRouter) Rank(hint uint64, epl network.EndpointList) []int {
+	return rankBy(len(epl), func(i int) uint64 {
+		return epl[i].U64() ^ hint
+	})
+}
+
+// RendezvousRouter ranks endpoints by the highest random weight of hint
+// and endpoint. Weights, by endpoint, scale their shares, absent ones
+// weigh 1.
+type RendezvousRouter struct {
+	Prefix  int
+	Weights map[string]float64
+}
+
+func (r *RendezvousRouter) Hint(kk api.RubiksKK) uint64 {
+	return PrefixHint(kk, r.Prefix)
+}
+
+func (r *RendezvousRouter) Rank(hint uint64, epl network.EndpointList) []int {
+	return rankBy(len(epl), func(i int) float64 {
+		// endpointId is siphash of the endpoint, hashed once and cached,
+		// the XOR alone would tie the weights of two hints alike on every
+		// endpoint, so hint is permuted before and the XOR after, u is
+		// uniform in (0, 1)
+		h := perm.Perm64(perm.Perm64(hint) ^ endpointId(epl[i]))
+		u := (float64(h >> 11) + 0.5) / (1 << 53)
+
+		weight, ok := r.Weights[epl[i].String()]
+		if !ok {
+			weight = 1
+		}
+		return -weight / math.Log(u)
+	})
+}
+
+// JumpRouter is jump consistent hashing, the cheapest with the least
+// moves when endpoints are appended, but neither weighs endpoints nor
+// copes with removals but the last.
+type JumpRouter struct {
+	Prefix int
+}
+
+func (r *JumpRouter) Hint(kk api.RubiksKK) uint64 {
+	return PrefixHint(kk, r.Prefix)
+}
+
+func (r *JumpRouter) Rank(hint uint64, epl network.EndpointList) []int {
+	var result []int
+	seen := make([]bool, len(epl))
+
+	for k := uint64(0); k < 4 * uint64(len(epl)) && len(result) < len(epl); k += 1 {
+		if i := jump(perm.Perm64(hint + k), len(epl)); !seen[i] {
+			result, seen[i] = append(result, i), true
+		}
+	}
+
+	for i := range epl {
+		if !seen[i] {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func jump(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+
+	for j < int64(n) {
+		b = j
+		key = key * 2862933555777941757 + 1
+		j = int64(float64(b + 1) * (float64(int64(1) << 31) / float64((key >> 33) + 1)))
+	}
+	return int(b)
+}
+
+// RingRouter is consistent hashing on a ring of virtual nodes, VNodes
+// points an endpoint, 100 if 0, scaled by the weight of the endpoint as
+// in RendezvousRouter. An endpoint ranks by the first of its points past
+// the hint on the ring. The ring is built for the endpoints of the last
+// call, and rebuilt for others, Weights are read then.
+type RingRouter struct {
+	Prefix  int
+	VNodes  int
+	Weights map[string]float64
+
+	mtx     sync.Mutex
+	epl     network.EndpointList
+	ring    []ringPoint		// by at
+}
+
+type ringPoint struct {
+	at uint64
+	i  int
+}
+
+func (r *RingRouter) Hint(kk api.RubiksKK) uint64 {
+	return PrefixHint(kk, r.Prefix)
+}
+
+func (r *RingRouter) Rank(hint uint64, epl network.EndpointList) []int {
+	ring := r.build(epl)
+
+	var result []int
+	seen := make([]bool, len(epl))
+	h := perm.Perm64(hint)
+	start := sort.Search(len(ring), func(k int) bool { return ring[k].at >= h })
+
+	for k := 0; k < len(ring) && len(result) < len(epl); k += 1 {
+		if i := ring[(start + k) % len(ring)].i; !seen[i] {
+			result, seen[i] = append(result, i), true
+		}
+	}
+
+	for i := range epl {
+		if !seen[i] {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+func (r *RingRouter) build(epl network.EndpointList) []ringPoint {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.ring != nil && r.epl.Equal(epl) {
+		return r.ring
+	}
+
+	vnodes := r.VNodes
+	if vnodes <= 0 {
+		vnodes = 100
+	}
+
+	ring := []ringPoint{}
+	for i, ep := range epl {
+		weight, ok := r.Weights[ep.String()]
+		if !ok {
+			weight = 1
+		}
+
+		id := endpointId(ep)
+		for v := 0; v < max(1, int(math.Round(weight * float64(vnodes)))); v += 1 {
+			ring = append(ring, ringPoint{at: perm.Perm64(id + uint64(v)), i: i})
+		}
+	}
+	sort.Slice(ring, func(j, k int) bool { return ring[j].at < ring[k].at })
+
+	r.epl, r.ring = append(network.EndpointList{}, epl...), ring
+	return ring
+}
+
+func rankBy[S cmp.Ordered](n int, score func(i int) S) []int {
+	order := make([]int, n)
+	scores := make([]S, n)
+
+	for i := range order {
+		order[i], scores[i] = i, score(i)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
+
+var endpointIds sync.Map	// string -> uint64
+
+func endpointId(ep network.Endpoint) uint64 {
+	s := ep.String()
+	if id, ok := endpointIds.Load(s); ok {
+		return id.(uint64)
+	}
+
+	id := siphash.Siphash([]byte(s), siphash.DefaultTweak)
+	endpointIds.Store(s, id)
+	return id
+}
@@ -0,0 +1,76 @@
+package client_test
+
+import (
+	"fmt"
+	"testing"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+)
+
+func spread(router client.Router, epl network.EndpointList, n int) ([]int, []int) {
+	counts := make([]int, len(epl))
+	var firsts []int
+
+	for i := 0; i < n; i += 1 {
+		kk := api.RubiksKK{Table: 1, Key: []byte(fmt.Sprintf("user%06dx", i))}
+		first := router.Rank(router.Hint(kk), epl)[0]
+		counts[first] += 1
+		firsts = append(firsts, first)
+	}
+	return counts, firsts
+}
+
+func Test9(t *testing.T)  {
+	var epl network.EndpointList
+	for i := 0; i < 6; i += 1 {
+		epl = append(epl, network.MkEndpoint(0x0a000001, 7000 + i))
+	}
+
+	kk := api.RubiksKK{Table: 3, Key: []byte("abcdef")}
+	misc.Assert(client.PrefixHint(kk, -1) == client.FineHint(kk))
+	misc.Assert(client.PrefixHint(kk, -2) == client.CoarseHint(kk))
+	misc.Assert(client.PrefixHint(kk, 4) == client.CoarseHint(kk))
+
+	// the last byte of the keys is left out
+	rendezvous := &client.RendezvousRouter{Prefix: -1}
+	jump := &client.JumpRouter{Prefix: -1}
+	ring := &client.RingRouter{Prefix: -1, VNodes: 200}
+
+	for _, router := range []client.Router{rendezvous, jump, ring} {
+		counts, firsts := spread(router, epl[:5], 10000)
+		for _, count := range counts {
+			misc.Assert(count > 1700 && count < 2300)
+		}
+
+		// one more endpoint, keys move to it only
+		_, firsts1 := spread(router, epl, 10000)
+		moved := 0
+		for i := range firsts {
+			if firsts[i] != firsts1[i] {
+				misc.Assert(firsts1[i] == 5)
+				moved += 1
+			}
+		}
+		misc.Assert(moved > 1300 && moved < 2000)
+
+		ranks := router.Rank(router.Hint(kk), epl)
+		misc.Assert(len(ranks) == len(epl))
+	}
+
+	rendezvous.Weights = map[string]float64{epl[0].String(): 2}
+	counts, _ := spread(rendezvous, epl[:5], 12000)
+	misc.Assert(counts[0] > 3600 && counts[1] < 2400)
+
+	// twice the virtual nodes, for a ring of other endpoints
+	ring.Weights = rendezvous.Weights
+	spread(ring, epl[1:], 1)
+	counts, _ = spread(ring, epl[:5], 12000)
+	misc.Assert(counts[0] > 3600 && counts[1] < 2400)
+
+	config := *client.FavoredConfig
+	config.Router = rendezvous
+	rubiks := client.NewRubiksClient2(epl, &config).(client.Routed)
+	misc.Assert(rubiks.Route(kk)[0].Equal(epl[rendezvous.Rank(rendezvous.Hint(kk), epl)[0]]))
+}
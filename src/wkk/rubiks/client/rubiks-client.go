@@ -3,7 +3,6 @@ package client
 import (
 	"time"
 	"wkk/common/log"
-	"wkk/common/misc"
 	"wkk/network"
 	"wkk/rubiks/api"
 )
@@ -22,31 +21,105 @@ type Rubiks interface {
 		cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error)
 }
 
-func NewRubiksClient1(epl network.EndpointList, retry Retry) Rubiks {
-	return &rubiksClient{
-		cm:     NewRubiksCM(epl),
-		retry:  retry,
-		hintFn: FineHint,
+// PooledRubiks is Rubiks with a pooled RubiksR, results are copied out of
+// it. Any Rubiks becomes one by Pooled.
+type PooledRubiks interface {
+	Rubiks
+
+	Get(deadline time.Time, kks []api.RubiksKK) ([]api.RubiksVV, error)
+
+	Commit(deadline time.Time, kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error)
+
+	Confirm(deadline time.Time, kks []api.RubiksKK, vvs []api.RubiksVV) error
+
+	Iterate(deadline time.Time, cursor api.RubiksKK, npairs int,
+		hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error)
+}
+
+// Config of a client, start from a copy of FavoredConfig
+type Config struct {
+	Retry    Retry
+
+	// RPCGets of up to Coalesce kks, all the same and in flight at once,
+	// share one request, 0 for none
+	Coalesce int
+
+	// requests of AsyncRubiks in flight at once, beyond that the oldest
+	// is waited for before submitting, 0 for no bound
+	MaxInFlight int
+
+	// rate and in flight limits of all requests, nil for none
+	Limiter  *Limiter
+
+	// breakers of the endpoints
+	Breaking *Breaking
+
+	Router   Router
+
+	// extents to place requests by before the router, nil for none
+	Topology *Topology
+}
+
+var FavoredConfig = &Config{
+	Retry:       FavoredRetry,
+	Coalesce:    1,
+	MaxInFlight: 64,
+	Breaking:    FavoredBreaking,
+	Router:      FavoredRouter,
+}
+
+func NewRubiksClient2(epl network.EndpointList, config *Config) Rubiks {
+	client := &rubiksClient{
+		cm:      NewRubiksCM1(epl, config.Breaking),
+		retry:   config.Retry,
+		hintFn:  config.Router.Hint,
+		config:  config,
+		flights: newGetFlights(),
+	}
+	client.inflight.max = config.MaxInFlight
+	client.cm.SetRouter(config.Router)
+	if config.Limiter != nil {
+		client.cm.SetLimiter(config.Limiter)
+	}
+	if config.Topology != nil {
+		client.cm.SetTopology(config.Topology)
 	}
+	return client
+}
+
+func NewRubiksClient1(epl network.EndpointList, retry Retry) Rubiks {
+	config := *FavoredConfig
+	config.Retry = retry
+	return NewRubiksClient2(epl, &config)
 }
 
 func NewRubiksClient(epl network.EndpointList) Rubiks {
-	return &rubiksClient{
-		cm:     NewRubiksCM(epl),
-		retry:  FavoredRetry,
-		hintFn: FineHint,
-	}
+	return NewRubiksClient2(epl, FavoredConfig)
 }
 
 type rubiksClient struct {
-	cm     *RubiksCM
-	retry  Retry
-	hintFn func (kk api.RubiksKK)uint64
+	cm       *RubiksCM
+	retry    Retry
+	hintFn   func (kk api.RubiksKK)uint64
+	config   *Config
+	flights  *getFlights
+	inflight inflight
 }
 
 func (client *rubiksClient) RPCGet(rbr *RubiksR, deadline time.Time,
 	kks []api.RubiksKK) ([]api.RubiksVV, error) {
 
+	if len(kks) <= client.config.Coalesce {
+		return client.flights.do(deadline, kks, func() ([]api.RubiksVV, error) {
+			return client.rpcGet(rbr, deadline, kks)
+		})
+	}
+	return client.rpcGet(rbr, deadline, kks)
+}
+
+func (client *rubiksClient) rpcGet(rbr *RubiksR, deadline time.Time,
+	kks []api.RubiksKK) ([]api.RubiksVV, error) {
+
 	if err := client.retry.Fn(func() error {
 		rbr.Begin(deadline)
 		rbr.req.MkGET(kks, rbr.payload)
@@ -54,15 +127,18 @@ func (client *rubiksClient) RPCGet(rbr *RubiksR, deadline time.Time,
 	}); err != nil {
 		return nil, err
 	}
+	return decodeGet(rbr)
+}
 
+func decodeGet(rbr *RubiksR) ([]api.RubiksVV, error) {
 	_, vvs, err := api.DeserializeKVS(rbr.resp.Blob(0).Data)
 	if err != nil {
 		return nil, err
 	}
 
-	present := rbr.resp.Get(api.TagPresent)
+	present := rbr.resp.GetDefault(api.TagPresent, 0)
 	for i := 0; i < len(vvs); i += 1 {
-		vvs[i].Seqnum  = rbr.resp.GetSeqnum(i)
+		vvs[i].Seqnum  = respSeqnum(rbr, i)
 		vvs[i].Present = (present & (1 << i)) != 0
 	}
 	return vvs, err
@@ -73,24 +149,33 @@ func (client *rubiksClient) RPCCommit(rbr *RubiksR, deadline time.Time,
 
 	if err := client.retry.Fn(func() error {
 		rbr.Begin(deadline)
-		rbr.req.MkCOMMIT(kks, vvs, rbr.payload)
-
-		if len(rbr.req.Blob(0).Data) > api.MaxCommitSize {
-			log.Info("commit size overflow, limit: %d", api.MaxCommitSize)
-			// commit size limit
-			return api.INVAL
+		if err := mkCommit(rbr, kks, vvs); err != nil {
+			return err
 		}
-
 		return client.cm.RPC(rbr, client.hintFn(kks[0]))
 	}); err != nil {
 		return nil, err
 	}
+	return decodeCommit(rbr, vvs), nil
+}
+
+func mkCommit(rbr *RubiksR, kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	rbr.req.MkCOMMIT(kks, vvs, rbr.payload)
+
+	if len(rbr.req.Blob(0).Data) > api.MaxCommitSize {
+		log.Info("commit size overflow, limit: %d", api.MaxCommitSize)
+		// commit size limit
+		return api.INVAL
+	}
+	return nil
+}
 
+func decodeCommit(rbr *RubiksR, vvs []api.RubiksVV) []api.RubiksVV {
 	for i := 0; i < len(vvs); i += 1 {
-		vvs[i].Seqnum  = rbr.resp.GetSeqnum(i)
+		vvs[i].Seqnum  = respSeqnum(rbr, i)
 		// fixme check present bit
 	}
-	return vvs, nil
+	return vvs
 }
 
 func (client *rubiksClient) RPCConfirm(rbr *RubiksR, deadline time.Time,
@@ -113,10 +198,15 @@ func (client *rubiksClient) RPCIterate(rbr *RubiksR, deadline time.Time,
 	}); err != nil {
 		return nil, nil, err
 	}
+	return decodeIterate(rbr, hint)
+}
 
+func decodeIterate(rbr *RubiksR, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
 	// not necessary equals to the desired npairs, but can't be zero
-	npairs = int(rbr.resp.Get(api.TagNPairs))
-	misc.Assert(npairs != 0)
+	npairs := int(rbr.resp.GetDefault(api.TagNPairs, 0))
+	if npairs == 0 {
+		return nil, nil, api.EIO
+	}
 
 	if hint & api.IterateHintValue == api.IterateHintValue {
 		kks, vvs, err := api.DeserializeKVS(rbr.resp.Blob(0).Data)
@@ -127,14 +217,14 @@ func (client *rubiksClient) RPCIterate(rbr *RubiksR, deadline time.Time,
 			return nil, nil, api.EIO
 		}
 		if len(kks) != npairs {
-			return nil, nil, err
+			return nil, nil, api.EIO
 		}
 
 		for i := 0; i < len(vvs); i += 1 {
 			vvs[i].Present = true
 
 			if hint & api.IterateHintSeqnum == api.IterateHintSeqnum {
-				vvs[i].Seqnum = rbr.resp.GetSeqnum(i)
+				vvs[i].Seqnum = respSeqnum(rbr, i)
 			}
 		}
 		return kks, vvs, nil
@@ -148,4 +238,37 @@ func (client *rubiksClient) RPCIterate(rbr *RubiksR, deadline time.Time,
 		}
 		return kks, nil, nil
 	}
-}
\ No newline at end of file
+}
+
+// respSeqnum is 0 for a seqnum the response doesn't tell
+func respSeqnum(rbr *RubiksR, i int) api.Seqnum {
+	return api.Seqnum(rbr.resp.GetDefault(api.TagSeqnum + uint64(i), 0))
+}
+
+// Routed is met by the clients of NewRubiksClient2 and the like
+type Routed interface {
+	Route(kk api.RubiksKK) network.EndpointList
+}
+
+func (client *rubiksClient) Route(kk api.RubiksKK) network.EndpointList {
+	return client.cm.Route(kk)
+}
+
+func (client *rubiksClient) Get(deadline time.Time, kks []api.RubiksKK) ([]api.RubiksVV, error) {
+	return pooledGet(client, deadline, kks)
+}
+
+func (client *rubiksClient) Commit(deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+	return pooledCommit(client, deadline, kks, vvs)
+}
+
+func (client *rubiksClient) Confirm(deadline time.Time,
+	kks []api.RubiksKK, vvs []api.RubiksVV) error {
+	return pooledConfirm(client, deadline, kks, vvs)
+}
+
+func (client *rubiksClient) Iterate(deadline time.Time, cursor api.RubiksKK,
+	npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+	return pooledIterate(client, deadline, cursor, npairs, hint)
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"wkk/common/blob"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+)
+
+// framed but corrupt responses fail EIO, never panic
+func Test14(t *testing.T)  {
+	rbr := AcquireRubiksR()
+	defer ReleaseRubiksR(rbr)
+
+	kks := []api.RubiksKK{{Table: 1, Key: []byte("a")}}
+	payload := blob.Seal(api.SerializeKKS(make([]byte, api.SerializeSize), kks), api.PayloadZero.CRC)
+
+	// no outcome, an unknown one
+	rbr.resp.Reset(api.KindGet | network.KindBitResponse, 1, payload)
+	misc.Assert(outcome(rbr) == api.EIO)
+	rbr.resp.Put(api.TagOutcome, 42)
+	misc.Assert(strings.Contains(outcome(rbr).Error(), "42"))
+
+	// no npairs, npairs other than the pairs
+	rbr.resp.Reset(api.KindIterate | network.KindBitResponse, 0, payload)
+	_, _, err := decodeIterate(rbr, api.IterateHintAll)
+	misc.Assert(err == api.EIO)
+
+	vvs := []api.RubiksVV{{Present: true, Val: []byte("a")}}
+	pairs := blob.Seal(api.SerializeKVS(make([]byte, api.SerializeSize), kks, vvs), api.PayloadZero.CRC)
+
+	for hint, payload := range map[api.IterateHint]blob.T{0: payload, api.IterateHintAll: pairs} {
+		rbr.resp.Reset(api.KindIterate | network.KindBitResponse, 2, payload)
+		_, _, err = decodeIterate(rbr, hint)
+		misc.Assert(err == api.EIO)
+	}
+}
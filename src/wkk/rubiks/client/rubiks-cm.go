@@ -1,34 +1,55 @@
 package client
 
 import (
+	"context"
 	"time"
 	"wkk/common/misc"
 	"wkk/common/perm"
+	"wkk/common/serd"
 	"wkk/common/siphash"
+	hapi "wkk/host/api"
 	"wkk/network"
 	"wkk/rubiks/api"
 )
 
-const RevivePeriod = time.Minute
-
 type RubiksCM struct {
-	gcm  network.CM
-	epl  network.EndpointList
-	sick []time.Time
+	gcm      network.CM
+	epl      network.EndpointList
+	breakers []*breaker
+	limiter  *Limiter
+	router   Router
+	topology *Topology
+	index    map[string]int	// of endpoints in epl
 }
 
 func NewRubiksCM(epl network.EndpointList) *RubiksCM {
+	return NewRubiksCM1(epl, FavoredBreaking)
+}
+
+func NewRubiksCM1(epl network.EndpointList, breaking *Breaking) *RubiksCM {
 	cm := &RubiksCM{
-		gcm:  network.NewCM("rubiks", api.TIMEOUT, api.WireMagic, api.SerializeSize),
-		epl:  epl,
-		sick: make([]time.Time, len(epl)),
+		gcm:    network.NewCM("rubiks", api.TIMEOUT, api.WireMagic, api.SerializeSize),
+		epl:    epl,
+		router: FavoredRouter,
+		index:  make(map[string]int),
 	}
-	for i, _ := range cm.sick {
-		cm.sick[i] = time.Time{}
+	for i, ep := range epl {
+		cm.breakers = append(cm.breakers, newBreaker(ep, breaking))
+		cm.index[ep.String()] = i
 	}
 	return cm
 }
 
+// BreakerStates tells the breaker state of every endpoint, in order
+func (cm *RubiksCM) BreakerStates() []BreakerState {
+	var result []BreakerState
+
+	for _, b := range cm.breakers {
+		result = append(result, b.State())
+	}
+	return result
+}
+
 func FineHint(kk api.RubiksKK) uint64 {
 	sz := len(kk.Key)
 
@@ -51,26 +72,145 @@ func CoarseHint(kk api.RubiksKK) uint64 {
 	}
 }
 
+// SetRouter replaces FavoredRouter, hints must come from the same router
+func (cm *RubiksCM) SetRouter(router Router)  {
+	cm.router = router
+}
+
+// SetTopology has the replicas of the extent of a hint go before the
+// ranking of the router. Replicas not among the endpoints are skipped,
+// extents of a replica known to lack api.FeatureMoved go by the router.
+func (cm *RubiksCM) SetTopology(topology *Topology)  {
+	cm.topology = topology
+}
+
+// Route ranks the endpoints for kk, best first, for a look at the balance
+func (cm *RubiksCM) Route(kk api.RubiksKK) network.EndpointList {
+	var result network.EndpointList
+
+	for _, i := range cm.rank(cm.router.Hint(kk), cm.current()) {
+		result = append(result, cm.epl[i])
+	}
+	return result
+}
+
+func (cm *RubiksCM) current() *hapi.Topology {
+	if cm.topology == nil {
+		return nil
+	}
+	return cm.topology.Current()
+}
+
+func (cm *RubiksCM) rank(hint uint64, topology *hapi.Topology) []int {
+	var ext *hapi.Extent
+	if topology != nil {
+		ext = topology.Lookup(hint)
+	}
+	if ext == nil || !cm.moves(ext.Replicas) {
+		return cm.router.Rank(hint, cm.epl)
+	}
+
+	var result []int
+	seen := make([]bool, len(cm.epl))
+
+	for k := range ext.Replicas {
+		ep := ext.Replicas[(ext.Leader + k) % len(ext.Replicas)]
+		if i, ok := cm.index[ep.String()]; ok && !seen[i] {
+			result, seen[i] = append(result, i), true
+		}
+	}
+	for _, i := range cm.router.Rank(hint, cm.epl) {
+		if !seen[i] {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// moves tells whether the servers at epl answer MOVED for extents they
+// don't serve, the topology can't be trusted otherwise. Servers not
+// known yet are taken to.
+func (cm *RubiksCM) moves(epl network.EndpointList) bool {
+	for _, ep := range epl {
+		if peer, ok := cm.gcm.Peer(ep); ok && !peer.Has(api.FeatureMoved) {
+			return false
+		}
+	}
+	return true
+}
+
+// Peer is what the server at ep told of itself, see network.CM
+func (cm *RubiksCM) Peer(ep network.Endpoint) (network.Peer, bool) {
+	return cm.gcm.Peer(ep)
+}
+
+// SetLimiter has Submit wait for, or fail on, the limits of limiter
+func (cm *RubiksCM) SetLimiter(limiter *Limiter)  {
+	cm.limiter = limiter
+}
+
 func (cm *RubiksCM) Submit(rbr *RubiksR, hint uint64) error {
-	victim, err := cm.pick(hint)
+	topology := cm.current()
+
+	victim, err := cm.pick(hint, topology)
 	if err != nil {
 		return err
 	}
 
+	if cm.limiter != nil {
+		if err := cm.limiter.acquire(rbr.Context(), rbr.deadline, rbr.table(), cm.epl[victim]); err != nil {
+			cm.breakers[victim].cancel()
+			return err
+		}
+		rbr.held = victim
+	}
+
 	err = cm.gcm.Submit(rbr, cm.epl[victim])
 	if err != nil {
-		cm.sick[victim] = time.Now()
+		cm.breakers[victim].record(false)
+		cm.releaseLimit(rbr)
 		return api.EIO
 	}
+	rbr.ep, rbr.topology = victim, topology
 	return nil
 }
 
+func (cm *RubiksCM) releaseLimit(rbr *RubiksR)  {
+	if rbr.held >= 0 {
+		cm.limiter.release(cm.epl[rbr.held])
+		rbr.held = -1
+	}
+}
+
 func (cm *RubiksCM) WaitForCompletion(rbr *RubiksR) error {
+	err := cm.waitForCompletion(rbr)
+	cm.releaseLimit(rbr)
+
+	if rbr.ep >= 0 {
+		cm.breakers[rbr.ep].record(!failure(err))
+		rbr.ep = -1
+	}
+	if err == api.MOVED && cm.topology != nil {
+		cm.topology.moved(rbr.deadline, rbr.topology)
+	}
+	return err
+}
+
+func (cm *RubiksCM) waitForCompletion(rbr *RubiksR) error {
 	err := cm.gcm.WaitForCompletion(rbr)
 	if err != nil {
 		return err
 	}
 
+	return outcome(rbr)
+}
+
+// outcome is EIO for a response that tells none
+func outcome(rbr *RubiksR) error {
+	if !rbr.resp.Has(api.TagOutcome) {
+		return api.EIO
+	}
+
 	oc := api.Outcome(rbr.resp.Get(api.TagOutcome))
 	if oc != api.OK {
 		return oc
@@ -86,26 +226,17 @@ func (cm *RubiksCM) RPC(rbr *RubiksR, hint uint64) error {
 	return cm.WaitForCompletion(rbr)
 }
 
-func (cm *RubiksCM) pick(hint uint64) (int, error) {
-	victim, max, now := -1, uint64(0), time.Now()
-
-reviveAndRetry:
-	for i, ep := range cm.epl {
-		if now.After(cm.sick[i].Add(RevivePeriod)) {
-			if tmp := ep.U64() ^ hint; tmp >= max {
-				victim, max = i, tmp
-			}
-		}
-	}
+// pick goes for the endpoint of the hint, or the next best one as long
+// as breakers are open
+func (cm *RubiksCM) pick(hint uint64, topology *hapi.Topology) (int, error) {
+	now := time.Now()
 
-	if victim == -1 {
-		// no available candidate, revive all
-		for i := range cm.sick {
-			cm.sick[i] = time.Time{}
+	for _, i := range cm.rank(hint, topology) {
+		if cm.breakers[i].allow(now) {
+			return i, nil
 		}
-		goto reviveAndRetry
 	}
-	return victim, nil
+	return -1, api.EIO
 }
 
 type RubiksR struct {
@@ -119,6 +250,16 @@ type RubiksR struct {
 	wakeup    chan struct{}
 	serialize []byte
 	payload   []byte
+
+	// limiter
+	ctx       context.Context
+	held      int		// endpoint of the in flight slot held, -1 for none
+
+	// breaker
+	ep        int		// endpoint submitted to, -1 for none
+
+	// topology
+	topology  *hapi.Topology	// submitted by
 }
 
 func NewRubiksR() *RubiksR {
@@ -126,7 +267,31 @@ func NewRubiksR() *RubiksR {
 		wakeup:    make(chan struct{}, 1),
 		serialize: make([]byte, api.SerializeSize),
 		payload:   make([]byte, api.MaxNPairs * (3 + api.MaxPairSize)),
+		held:      -1,
+		ep:        -1,
+	}
+}
+
+// SetContext has a request waiting on limits give up with ctx, it stays
+// till set otherwise.
+func (r *RubiksR) SetContext(ctx context.Context)  {
+	r.ctx = ctx
+}
+
+func (r *RubiksR) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// table of the first pair of the request, kks and kvs lead with it
+func (r *RubiksR) table() api.Table {
+	table, _, err := serd.Get64LE(8, r.req.Blob(0).Data)
+	if err != nil || len(r.req.Blob(0).Data) < 8 {
+		return 0
 	}
+	return api.Table(table)
 }
 
 func (r *RubiksR) Begin(deadline time.Time)  {
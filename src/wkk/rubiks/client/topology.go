@@ -0,0 +1,100 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	hapi "wkk/host/api"
+	hclient "wkk/host/client"
+	"wkk/network"
+)
+
+// Topology is the map of extents of a cluster, fetched from its hosts.
+// Extents range over the hints of the Router, RubiksCM sends requests to
+// the replicas of the extent of their hint, leader first, and refreshes
+// the map when a replica answers MOVED.
+type Topology struct {
+	hcm       *hclient.HostCM
+	hosts     network.EndpointList
+	clusterId uint64
+
+	// after a refresh finding nothing newer, MOVED waits this long to
+	// refresh again
+	MinRefresh time.Duration
+
+	current atomic.Pointer[hapi.Topology]
+	mtx     sync.Mutex	// one refresh at a time
+	last    time.Time
+	newer   bool		// of the last refresh
+}
+
+func NewTopology(hosts network.EndpointList, clusterId uint64) *Topology {
+	return &Topology{
+		hcm:        hclient.NewHostCM(),
+		hosts:      hosts,
+		clusterId:  clusterId,
+		MinRefresh: 100 * time.Millisecond,
+	}
+}
+
+// Current is the latest map, nil before the first Refresh
+func (t *Topology) Current() *hapi.Topology {
+	return t.current.Load()
+}
+
+// Lookup finds the extent of hint, nil if unknown
+func (t *Topology) Lookup(hint uint64) *hapi.Extent {
+	if current := t.Current(); current != nil {
+		return current.Lookup(hint)
+	}
+	return nil
+}
+
+// Refresh asks the hosts in turn till one answers, a map older than the
+// current one is ignored
+func (t *Topology) Refresh(deadline time.Time) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.refresh(deadline)
+}
+
+func (t *Topology) refresh(deadline time.Time) error {
+	var err error
+	hr := hclient.NewHostR()
+
+	for _, ep := range t.hosts {
+		hr.GetTopology(deadline, t.clusterId)
+		if err = t.hcm.RPC(hr, ep); err != nil {
+			continue
+		}
+
+		var topology *hapi.Topology
+		if topology, err = hr.Topology(); err != nil {
+			continue
+		}
+
+		current := t.Current()
+		if current == nil || current.Version <= topology.Version {
+			t.current.Store(topology)
+		}
+		t.last, t.newer = time.Now(), current == nil || current.Version < topology.Version
+		return nil
+	}
+	return err
+}
+
+// moved refreshes the map a request went by, unless already refreshed
+// meanwhile, a refresh under way is waited for
+func (t *Topology) moved(deadline time.Time, used *hapi.Topology)  {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if t.Current() != used {
+		return
+	}
+	if !t.newer && time.Since(t.last) < t.MinRefresh {
+		return
+	}
+	_ = t.refresh(deadline)
+}
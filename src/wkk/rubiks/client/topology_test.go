@@ -0,0 +1,112 @@
+package client_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	hapi "wkk/host/api"
+	"wkk/host/host-fake"
+	"wkk/network"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+func Test10(t *testing.T)  {
+	fake := rubiks_fake.New()
+	var servers []*rubiks_fake.Server
+	var epl network.EndpointList
+
+	for i := 0; i < 2; i += 1 {
+		server, err := rubiks_fake.NewServer(fake)
+		misc.AssertNilError(err)
+		defer server.Close()
+		servers, epl = append(servers, server), append(epl, server.Endpoint())
+	}
+
+	host, err := host_fake.NewServer(7)
+	misc.AssertNilError(err)
+	defer host.Close()
+
+	// the low half of the hints on servers[lo], the high half on the other
+	place := func(version uint64, lo int) {
+		host.SetTopology(&hapi.Topology{Version: version, Extents: []hapi.Extent{
+			{ExtentId: 1, Low: 0, High: 1 << 63 - 1, Leader: lo, Replicas: epl},
+			{ExtentId: 2, Low: 1 << 63, High: ^uint64(0), Leader: 1 - lo, Replicas: epl},
+		}})
+		servers[lo].Own(func(kk api.RubiksKK) bool { return client.FineHint(kk) < 1 << 63 })
+		servers[1 - lo].Own(func(kk api.RubiksKK) bool { return client.FineHint(kk) >= 1 << 63 })
+	}
+	place(1, 0)
+
+	// round trip, overlaps refused
+	current := &hapi.Topology{Version: 1, Extents: []hapi.Extent{{ExtentId: 1, Low: 5, High: 9, Replicas: epl}}}
+	topology, err := hapi.DeserializeTopology(1, current.Serialize(nil))
+	misc.Assert(err == nil && topology.Lookup(7).Replicas.Equal(epl) && topology.Lookup(10) == nil)
+
+	current.Extents = append(current.Extents, hapi.Extent{ExtentId: 2, Low: 9, High: 12, Replicas: epl})
+	_, err = hapi.DeserializeTopology(1, current.Serialize(nil))
+	misc.Assert(err == hapi.ErrTopology)
+
+	config := *client.FavoredConfig
+	config.Topology = client.NewTopology(network.EndpointList{host.Endpoint()}, 7)
+	rubiks := client.Pooled(client.NewRubiksClient2(epl, &config))
+	deadline := time.Now().Add(time.Second)
+
+	misc.Assert(config.Topology.Current() == nil)
+	misc.AssertNilError(config.Topology.Refresh(deadline))
+	misc.Assert(config.Topology.Current().Version == 1)
+
+	// straight to the owner, nothing moved
+	var kks []api.RubiksKK
+	for i := 0; i < 50; i += 1 {
+		kk := api.RubiksKK{Table: 1, Key: []byte(fmt.Sprintf("key%02d", i))}
+		kks = append(kks, kk)
+
+		owner := 0
+		if client.FineHint(kk) >= 1 << 63 {
+			owner = 1
+		}
+		misc.Assert(rubiks.(client.Routed).Route(kk)[0].Equal(epl[owner]))
+
+		_, err := rubiks.Commit(deadline, []api.RubiksKK{kk},
+			[]api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: kk.Key}})
+		misc.AssertNilError(err)
+	}
+	misc.Assert(servers[0].NReq() + servers[1].NReq() == len(kks))
+	misc.Assert(servers[0].NReq() > 10 && servers[1].NReq() > 10)
+
+	// the extents swap, the first MOVED refreshes
+	place(2, 1)
+	for _, kk := range kks {
+		vvs, err := rubiks.Get(deadline, []api.RubiksKK{kk})
+		misc.Assert(err == nil && vvs[0].Present && string(vvs[0].Val) == string(kk.Key))
+	}
+	misc.Assert(config.Topology.Current().Version == 2)
+	misc.Assert(host.NReq(hapi.KindGetTopology) == 2)
+	misc.Assert(servers[0].NReq() + servers[1].NReq() == 2 * len(kks) + 1)
+
+	// an older server serving all, the router ranks
+	servers[0].SetPeer(network.Peer{Version: network.Version})
+	servers[0].Own(nil)
+	servers[1].Own(nil)
+	for _, kk := range kks {
+		_, err := rubiks.Get(deadline, []api.RubiksKK{kk})
+		misc.AssertNilError(err)
+	}
+	for _, kk := range kks {
+		rank := client.FavoredRouter.Rank(client.FavoredRouter.Hint(kk), epl)
+		misc.Assert(rubiks.(client.Routed).Route(kk)[0].Equal(epl[rank[0]]))
+	}
+	servers[0].SetPeer(network.Peer{Version: network.Version, Features: api.Features})
+	place(2, 1)
+
+	// older maps are ignored
+	place(1, 0)
+	misc.AssertNilError(config.Topology.Refresh(deadline))
+	misc.Assert(config.Topology.Current().Version == 2)
+
+	// unknown cluster
+	misc.Assert(client.NewTopology(network.EndpointList{host.Endpoint()}, 8).Refresh(deadline) == hapi.Inval)
+}
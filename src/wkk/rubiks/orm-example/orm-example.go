@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"time"
 	"wkk/common/log"
 	"wkk/network"
 	"wkk/rubiks/api"
@@ -29,7 +31,8 @@ func main() {
 	rubiks := client.NewRubiksClient(epl)
 	orm := rubiks_orm.NewRubiksOrm(rubiks)
 
-	rubiks_orm.Register(&User{})
+	err := rubiks_orm.Register(&User{})
+	log.FatalIf(err != nil, "error: %s", err)
 
 	user0 := User{
 		Id:     10,
@@ -50,7 +53,7 @@ func main() {
 
 	// load user0/user1 (and seqnum) from rubiks
 	// overrides fields if there are records in rubiks.
-	err := orm.Get(&user0, &user1)
+	err = orm.Get(&user0, &user1)
 	log.FatalIf(err != nil, "error: %s", err)
 
 	log.Info("load from db: %v", user0)
@@ -68,28 +71,34 @@ func main() {
 	// list by email
 	log.Info("-------------------------")
 	log.Info("list by email:")
-	rc, ec := orm.ListBy(&user0, "101")
-	for ent := range rc {
+	err = orm.ForEachBy(context.Background(), &user0, "101", func(ent rubiks_orm.EntityI) error {
 		log.Info("  %v", ent)
-	}
-
-	if err := <- ec; err != nil {
-		log.Fatal("error=%s", err)
-	}
+		return nil
+	})
+	log.FatalIf(err != nil, "error=%s", err)
 
 	// list by address
 	log.Info("-------------------------")
 	log.Info("list by address:")
-	rc, ec = orm.ListBy(&user0, "102")
-	for ent := range rc {
-		log.Info("  %v", ent)
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
 
-	if err := <- ec; err != nil {
-		log.Fatal("error=%s", err)
+	cursor := orm.ListBy(ctx, &user0, "102")
+	for cursor.Next() {
+		log.Info("  %v", cursor.Entity())
 	}
+	log.FatalIf(cursor.Err() != nil, "error=%s", cursor.Err())
 
-	// list by name
+	// list by name, typed
+	log.Info("-------------------------")
+	log.Info("list by name:")
+	users, err := rubiks_orm.NewRepo[User](orm)
+	log.FatalIf(err != nil, "error: %s", err)
+
+	for user, err := range users.ListBy(ctx, "103", "Bar") {
+		log.FatalIf(err != nil, "error=%s", err)
+		log.Info("  %v", *user)
+	}
 
 	log.Info("all done!!")
 }
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"wkk/host/api"
+	"wkk/host/client"
+	"wkk/host/host-bootstrap"
+	"wkk/network"
+)
+
+type options struct {
+	hosts    network.EndpointList
+	json     bool
+	deadline time.Duration
+	yes      bool
+}
+
+func main() {
+	opts, args := parseInput()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := dispatch(client.NewHostCM(), opts, args, os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s!!\n", err)
+		os.Exit(1)
+	}
+}
+
+func dispatch(hcm *client.HostCM, opts options, args []string, in io.Reader, out io.Writer) error {
+	deadline := time.Now().Add(opts.deadline)
+
+	switch args[0] {
+	case "ping":
+		rows, _ := client.FanOut(opts.hosts, func(ep network.Endpoint) (pingRow, error) {
+			pr, err := hcm.Ping(deadline, ep)
+			return pingRow{row: mkRow(ep, err), ClusterId: pr.ClusterId, RTTMicros: pr.RTT.Microseconds()}, nil
+		})
+		return emit(out, opts, rows, func() {
+			for _, row := range rows {
+				if row.Error != "" {
+					fmt.Fprintf(out, "%-21s error: %s\n", row.Host, row.Error)
+				} else {
+					fmt.Fprintf(out, "%-21s cluster=%d rtt=%dus\n", row.Host, row.ClusterId, row.RTTMicros)
+				}
+			}
+		})
+
+	case "status":
+		rows, _ := client.FanOut(opts.hosts, func(ep network.Endpoint) (statusRow, error) {
+			status, err := hcm.Status(deadline, ep)
+			return statusRow{
+				row:       mkRow(ep, err),
+				ClusterId: status.ClusterId,
+				Capacity:  status.Capacity,
+				Used:      status.Used,
+				Free:      status.Free(),
+				NReplicas: status.NReplicas,
+				NoSpace:   status.NoSpace(),
+			}, nil
+		})
+		return emit(out, opts, rows, func() {
+			for _, row := range rows {
+				if row.Error != "" {
+					fmt.Fprintf(out, "%-21s error: %s\n", row.Host, row.Error)
+				} else {
+					fmt.Fprintf(out, "%-21s cluster=%d replicas=%d used=%d capacity=%d free=%d nospace=%v\n",
+						row.Host, row.ClusterId, row.NReplicas, row.Used, row.Capacity, row.Free, row.NoSpace)
+				}
+			}
+		})
+
+	case "create-first-replica":
+		ep, err := oneHost(opts)
+		if err != nil {
+			return err
+		}
+		if len(args) != 5 {
+			return errors.New("expected cluster type extent nominal")
+		}
+		u, err := parseU64s(args[1:4], 3, "cluster type extent")
+		if err != nil {
+			return err
+		}
+
+		var nominal network.Endpoint
+		if err := nominal.Set(args[4]); err != nil {
+			return err
+		}
+		return done(out, opts, hcm.CreateFirstReplica(deadline, ep, u[0], u[1], u[2], nominal))
+
+	case "add-replica":
+		ep, err := oneHost(opts)
+		if err != nil {
+			return err
+		}
+		u, err := parseU64s(args[1:], 5, "cluster type extent ecrow participant")
+		if err != nil {
+			return err
+		}
+		return done(out, opts, hcm.CreateExtraReplica(deadline, ep, u[0], u[1], u[2], u[3], u[4]))
+
+	case "remove-replica":
+		ep, err := oneHost(opts)
+		if err != nil {
+			return err
+		}
+		u, err := parseU64s(args[1:], 4, "cluster type extent participant")
+		if err != nil {
+			return err
+		}
+
+		if !opts.yes && !confirm(in, out, fmt.Sprintf("remove replica %d/%d of participant %d from %v",
+			u[1], u[2], u[3], ep)) {
+			return errors.New("not confirmed")
+		}
+		return done(out, opts, hcm.RemoveReplica(deadline, ep, u[0], u[1], u[2], u[3]))
+
+	case "rebalance":
+		fs := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "plan the moves only")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if !*dryRun {
+			return errors.New("moves are not carried out yet, use -dry-run")
+		}
+		u, err := parseU64s(fs.Args(), 1, "cluster")
+		if err != nil {
+			return err
+		}
+
+		moves, err := rebalance(hcm, deadline, opts.hosts, u[0])
+		if err != nil {
+			return err
+		}
+		return emit(out, opts, moves, func() {
+			for _, m := range moves {
+				fmt.Fprintf(out, "move %d/%d of participant %d from %s to %s\n",
+					m.ExtentType, m.ExtentId, m.ParticipantId, m.From, m.To)
+			}
+			fmt.Fprintf(out, "total - %d\n", len(moves))
+		})
+
+	case "bootstrap":
+		fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "plan the actions only")
+		prune := fs.Bool("prune", false, "remove replicas beyond the spec")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errors.New("expected spec")
+		}
+
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		spec, err := host_bootstrap.LoadSpec(f)
+		if err != nil {
+			return err
+		}
+
+		r := host_bootstrap.NewReconciler(hcm, spec)
+		r.Prune, r.Deadline = *prune, opts.deadline
+
+		actions, err := r.Plan()
+		if err != nil {
+			return err
+		}
+
+		nremove := 0
+		for _, a := range actions {
+			if a.Kind == host_bootstrap.Remove {
+				nremove += 1
+			}
+		}
+		if !*dryRun && nremove > 0 && !opts.yes &&
+			!confirm(in, out, fmt.Sprintf("remove %d replicas", nremove)) {
+			return errors.New("not confirmed")
+		}
+
+		if !*dryRun {
+			if err := r.Apply(actions); err != nil {
+				return err
+			}
+		}
+		return emit(out, opts, actions, func() {
+			for _, a := range actions {
+				fmt.Fprintf(out, "%-12s %d/%d ecrow=%d participant=%d on %s\n",
+					a.Kind, a.ExtentType, a.ExtentId, a.Ecrow, a.ParticipantId, a.Host)
+			}
+			fmt.Fprintf(out, "total - %d\n", len(actions))
+		})
+
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+type row struct {
+	Host  string `json:"host"`
+	Error string `json:"error,omitempty"`
+}
+
+type pingRow struct {
+	row
+	ClusterId uint64 `json:"cluster"`
+	RTTMicros int64  `json:"rtt_us"`
+}
+
+type statusRow struct {
+	row
+	ClusterId uint64 `json:"cluster"`
+	Capacity  uint64 `json:"capacity"`
+	Used      uint64 `json:"used"`
+	Free      uint64 `json:"free"`
+	NReplicas int    `json:"replicas"`
+	NoSpace   bool   `json:"nospace"`
+}
+
+func mkRow(ep network.Endpoint, err error) row {
+	r := row{Host: ep.String()}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func emit(out io.Writer, opts options, v any, text func()) error {
+	if !opts.json {
+		text()
+		return nil
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func done(out io.Writer, opts options, err error) error {
+	if err != nil {
+		return err
+	}
+	return emit(out, opts, map[string]string{"outcome": "OK"}, func() {
+		fmt.Fprintf(out, "OK\n")
+	})
+}
+
+func oneHost(opts options) (network.Endpoint, error) {
+	if len(opts.hosts) != 1 {
+		return network.Endpoint{}, errors.New("exactly one host (-e) expected")
+	}
+	return opts.hosts[0], nil
+}
+
+func parseU64s(args []string, n int, usage string) ([]uint64, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("expected %s", usage)
+	}
+
+	var result []uint64
+	for _, s := range args {
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+func confirm(in io.Reader, out io.Writer, what string) bool {
+	fmt.Fprintf(out, "%s? [y/N] ", what)
+
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+type move struct {
+	ExtentType    uint64 `json:"type"`
+	ExtentId      uint64 `json:"extent"`
+	ParticipantId uint64 `json:"participant"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+}
+
+func rebalance(hcm *client.HostCM, deadline time.Time,
+	hosts network.EndpointList, clusterId uint64) ([]move, error) {
+
+	lists, errs := client.FanOut(hosts, func(ep network.Endpoint) ([]api.Replica, error) {
+		return hcm.ListReplicas(deadline, ep, clusterId)
+	})
+	statuses, errs1 := client.FanOut(hosts, func(ep network.Endpoint) (api.Status, error) {
+		return hcm.Status(deadline, ep)
+	})
+
+	for i := range hosts {
+		if err := errors.Join(errs[i], errs1[i]); err != nil {
+			return nil, fmt.Errorf("%v: %w", hosts[i], err)
+		}
+	}
+	return plan(hosts, lists, statuses), nil
+}
+
+// plan moves replicas off the host keeping most to the one keeping least
+// till they differ by one at most. A host takes no second replica of an
+// extent, nor one it has no space for, a replica weighs the average of
+// its host.
+func plan(hosts network.EndpointList, lists [][]api.Replica, statuses []api.Status) []move {
+	type extent struct{ extentType, extentId uint64 }
+
+	var moves []move
+	keeps := make([]map[extent]bool, len(hosts))
+	free := make([]uint64, len(hosts))
+
+	for i := range hosts {
+		keeps[i] = make(map[extent]bool)
+		for _, r := range lists[i] {
+			keeps[i][extent{r.ExtentType, r.ExtentId}] = true
+		}
+		free[i] = statuses[i].Free()
+	}
+
+	for {
+		order := make([]int, len(hosts))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return len(lists[order[a]]) > len(lists[order[b]])
+		})
+
+		moved := false
+		for _, from := range order {
+			for k := len(order) - 1; k >= 0 && !moved; k -= 1 {
+				to := order[k]
+				if len(lists[from]) - len(lists[to]) <= 1 {
+					break
+				}
+
+				size := statuses[from].Used / uint64(len(lists[from]))
+				for i, r := range lists[from] {
+					if keeps[to][extent{r.ExtentType, r.ExtentId}] || free[to] < size {
+						continue
+					}
+
+					moves = append(moves, move{
+						ExtentType:    r.ExtentType,
+						ExtentId:      r.ExtentId,
+						ParticipantId: r.ParticipantId,
+						From:          hosts[from].String(),
+						To:            hosts[to].String(),
+					})
+					lists[from] = append(lists[from][:i:i], lists[from][i+1:]...)
+					lists[to] = append(lists[to], r)
+					delete(keeps[from], extent{r.ExtentType, r.ExtentId})
+					keeps[to][extent{r.ExtentType, r.ExtentId}] = true
+					free[from], free[to] = free[from] + size, free[to] - size
+					moved = true
+					break
+				}
+			}
+			if moved {
+				break
+			}
+		}
+
+		if !moved {
+			return moves
+		}
+	}
+}
+
+func parseInput() (options, []string) {
+	var opts options
+
+	flag.Usage = func() {
+		fmt.Printf("rubiks-admin [-e endpoint]+ [-json] [-deadline d] [-yes] command ...    \n")
+		fmt.Printf("  -e                           host nominal endpoint           \n")
+		fmt.Printf("  -json                        print results as json           \n")
+		fmt.Printf("  -deadline                    of every request, 1s by default \n")
+		fmt.Printf("  -yes                         skip confirmations              \n")
+		fmt.Printf("  ping                                                         \n")
+		fmt.Printf("  status                                                       \n")
+		fmt.Printf("  create-first-replica cluster type extent nominal             \n")
+		fmt.Printf("  add-replica    cluster type extent ecrow participant         \n")
+		fmt.Printf("  remove-replica cluster type extent participant               \n")
+		fmt.Printf("  rebalance -dry-run cluster   plan moves of replicas          \n")
+		fmt.Printf("  bootstrap [-dry-run] [-prune] spec.json                      \n")
+		fmt.Printf("                               bring hosts to a JSON spec      \n")
+		fmt.Printf("                                                               \n")
+		fmt.Printf("where numbers are 64-bit integers, replica commands take one host\n")
+		fmt.Printf("                                                               \n")
+		fmt.Printf("example 1: rubiks-admin -e <endpoint> -e <endpoint> status      \n")
+		fmt.Printf("example 2: rubiks-admin -e <endpoint> remove-replica 7 1 100 2  \n")
+	}
+
+	flag.CommandLine.Var(&opts.hosts, "e", "host endpoint list (nominal)")
+	flag.BoolVar(&opts.json, "json", false, "print results as json")
+	flag.DurationVar(&opts.deadline, "deadline", time.Second, "deadline of every request")
+	flag.BoolVar(&opts.yes, "yes", false, "skip confirmations")
+	flag.Parse()
+
+	opts.hosts = opts.hosts.Delta(api.PortDelta)
+	return opts, flag.Args()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/host/api"
+	"wkk/host/client"
+	"wkk/host/host-fake"
+	"wkk/network"
+)
+
+func Test0(t *testing.T)  {
+	var hosts network.EndpointList
+	var servers []*host_fake.Server
+
+	for i := 0; i < 3; i += 1 {
+		server, err := host_fake.NewServer(7)
+		misc.AssertNilError(err)
+		defer server.Close()
+		hosts, servers = append(hosts, server.Endpoint()), append(servers, server)
+	}
+
+	hcm := client.NewHostCM()
+	run := func(opts options, in string, args ...string) (string, error) {
+		var out bytes.Buffer
+		if opts.deadline == 0 {
+			opts.deadline = time.Second
+		}
+		err := dispatch(hcm, opts, args, strings.NewReader(in), &out)
+		return out.String(), err
+	}
+	on := func(i int) options {
+		return options{hosts: hosts[i:i+1]}
+	}
+
+	out, err := run(options{hosts: hosts}, "", "ping")
+	misc.Assert(err == nil && strings.Count(out, "cluster=7") == 3)
+
+	// five on the first host, one on the last, extent 100 on both
+	_, err = run(on(0), "", "create-first-replica", "7", "1", "100", hosts[0].String())
+	misc.AssertNilError(err)
+	for _, extentId := range []string{"101", "102", "103", "104"} {
+		_, err = run(on(0), "", "add-replica", "7", "1", extentId, "3", "2")
+		misc.AssertNilError(err)
+	}
+	_, err = run(on(2), "", "add-replica", "7", "1", "100", "3", "4")
+	misc.AssertNilError(err)
+
+	_, err = run(options{hosts: hosts}, "", "add-replica", "7", "1", "105", "3", "2")
+	misc.Assert(err != nil)
+	_, err = run(on(0), "", "add-replica", "7", "1", "105")
+	misc.Assert(err != nil)
+
+	var rows []statusRow
+	out, err = run(options{hosts: hosts, json: true}, "", "status")
+	misc.Assert(err == nil && json.Unmarshal([]byte(out), &rows) == nil)
+	misc.Assert(len(rows) == 3 && rows[0].NReplicas == 5 && rows[1].NReplicas == 0 && rows[2].Host == hosts[2].String())
+
+	// to [2 2 2], extent 100 stays off the last host
+	_, err = run(options{hosts: hosts}, "", "rebalance", "7")
+	misc.Assert(err != nil)
+
+	var moves []move
+	out, err = run(options{hosts: hosts, json: true}, "", "rebalance", "--dry-run", "7")
+	misc.Assert(err == nil && json.Unmarshal([]byte(out), &moves) == nil && len(moves) == 3)
+	for _, m := range moves {
+		misc.Assert(m.From == hosts[0].String())
+		misc.Assert(m.ExtentId != 100 || m.To == hosts[1].String())
+	}
+	misc.Assert(len(servers[0].Replicas()) == 5)
+
+	// confirmed or not
+	_, err = run(on(0), "n\n", "remove-replica", "7", "1", "101", "2")
+	misc.Assert(err != nil && len(servers[0].Replicas()) == 5)
+	out, err = run(on(0), "y\n", "remove-replica", "7", "1", "101", "2")
+	misc.Assert(err == nil && strings.HasSuffix(out, "OK\n") && len(servers[0].Replicas()) == 4)
+	_, err = run(options{hosts: hosts[:1], yes: true}, "", "remove-replica", "7", "1", "102", "2")
+	misc.Assert(err == nil && len(servers[0].Replicas()) == 3)
+
+	servers[1].Close()
+	out, err = run(options{hosts: hosts, deadline: 100 * time.Millisecond}, "", "status")
+	misc.Assert(err == nil && strings.Count(out, "error:") == 1)
+}
+
+func Test1(t *testing.T)  {
+	server, err := host_fake.NewServer(7)
+	misc.AssertNilError(err)
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "spec.json")
+	misc.AssertNilError(os.WriteFile(path, []byte(fmt.Sprintf(
+		`{"cluster": 7, "hosts": ["%s"], "replication": 1, "extents": [{"type": 1, "id": 100}, {"type": 1, "id": 101}]}`,
+		server.Endpoint().Delta(-api.PortDelta))), 0644))
+
+	hcm := client.NewHostCM()
+	opts := options{deadline: time.Second}
+
+	var out bytes.Buffer
+	misc.AssertNilError(dispatch(hcm, opts, []string{"bootstrap", "-dry-run", path}, strings.NewReader(""), &out))
+	misc.Assert(strings.HasSuffix(out.String(), "total - 2\n") && len(server.Replicas()) == 0)
+
+	out.Reset()
+	misc.AssertNilError(dispatch(hcm, opts, []string{"bootstrap", path}, strings.NewReader(""), &out))
+	misc.Assert(len(server.Replicas()) == 2)
+
+	out.Reset()
+	misc.AssertNilError(dispatch(hcm, opts, []string{"bootstrap", path}, strings.NewReader(""), &out))
+	misc.Assert(out.String() == "total - 0\n")
+}
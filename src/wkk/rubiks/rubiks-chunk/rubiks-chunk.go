@@ -0,0 +1,386 @@
+package rubiks_chunk
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+	"wkk/common/crc128"
+	"wkk/common/log"
+	"wkk/common/serd"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+)
+
+// Store keeps values of any size under a manifest pair at the key of the
+// value, the manifest holds small values inline and otherwise the size,
+// chunk count, version and crc128 of the value. Chunks go to their own
+// table keyed by
+//
+//	table(8) | key | len(key)(3) | version(8) | chunk(3)
+//
+// A version is written chunks first, manifest last, its chunks are
+// never rewritten, so a reader holding a manifest reads that version or
+// finds chunks gone and starts over. Chunks of replaced versions are
+// removed by the writer, the ones of aborted writes by GC.
+type Store struct {
+	rubiks client.PooledRubiks
+	chunks api.Table
+}
+
+func NewStore(rubiks client.Rubiks, chunks api.Table) *Store {
+	return &Store{rubiks: client.Pooled(rubiks), chunks: chunks}
+}
+
+const (
+	formatInline  = byte(0x00)
+	formatChunked = byte(0x01)
+
+	manifestSize  = 1 + 8 + 3 + 8 + 16
+
+	pairOverhead  = 8 + 3 + 3	// see api.SerializedSize
+	versionShift  = 20			// low bits of a version are random
+	maxAttempts   = 8
+)
+
+var crc0 = crc128.MkCRC(0x6368756e6b656400, 0x7275626b73000000)
+
+var ErrCorrupted = errors.New("chunked value corrupted")
+
+type manifest struct {
+	size    uint64
+	nchunks int
+	version uint64
+	crc     crc128.T
+	inline  []byte
+}
+
+// Get reads the value at kk, Seqnum is the one of the manifest.
+func (s *Store) Get(deadline time.Time, kk api.RubiksKK) (api.RubiksVV, error) {
+	for attempt := 0; attempt < maxAttempts; attempt += 1 {
+		vv, m, err := s.getManifest(deadline, kk)
+		if err != nil || !vv.Present {
+			return vv, err
+		}
+
+		if m.version == 0 {
+			vv.Val = m.inline
+			return vv, nil
+		}
+
+		val, err := s.getChunks(deadline, kk, m)
+		if err == nil {
+			vv.Val = val
+			return vv, nil
+		} else if err != ErrCorrupted {
+			return api.RubiksVV{}, err
+		}
+
+		// chunks gone or mixed up, fine if the manifest moved on meanwhile
+		if err := s.rubiks.Confirm(deadline, []api.RubiksKK{kk}, []api.RubiksVV{vv}); err == nil {
+			return api.RubiksVV{}, ErrCorrupted
+		} else if err != api.STALE {
+			return api.RubiksVV{}, err
+		}
+	}
+	return api.RubiksVV{}, api.STALE
+}
+
+// Put writes vv.Val at kk if its manifest is still at vv.Seqnum, or in
+// any case at api.SeqnumInf, and returns the new seqnum. Present false
+// removes the value.
+func (s *Store) Put(deadline time.Time, kk api.RubiksKK, vv api.RubiksVV) (api.Seqnum, error) {
+	var m manifest
+	var mval []byte
+
+	switch {
+	case !vv.Present:
+	case len(vv.Val) <= s.inlineSize(kk):
+		mval = append([]byte{formatInline}, vv.Val...)
+	default:
+		var err error
+		if m, err = s.putChunks(deadline, kk, vv.Val); err != nil {
+			return 0, err
+		}
+		mval = encodeManifest(m)
+	}
+
+	for attempt := 0; ; attempt += 1 {
+		// the manifest replaced tells which chunks to drop afterwards
+		old, oldm, err := s.getManifest(deadline, kk)
+		if err == ErrCorrupted {
+			old, oldm, err = s.getPair(deadline, kk)
+		}
+		if err != nil {
+			s.dropChunks(deadline, kk, m)
+			return 0, err
+		}
+
+		seqnum := vv.Seqnum
+		if seqnum == api.SeqnumInf {
+			seqnum = old.Seqnum
+		} else if seqnum != old.Seqnum {
+			s.dropChunks(deadline, kk, m)
+			return 0, api.STALE
+		}
+
+		vvs, err := s.rubiks.Commit(deadline, []api.RubiksKK{kk},
+			[]api.RubiksVV{{Present: vv.Present, Seqnum: seqnum, Val: mval}})
+
+		if err == api.STALE && vv.Seqnum == api.SeqnumInf && attempt + 1 < maxAttempts {
+			continue
+		} else if err != nil {
+			s.dropChunks(deadline, kk, m)
+			return 0, err
+		} else if len(vvs) != 1 {
+			return 0, api.EIO
+		}
+
+		if old.Present && oldm.version != m.version {
+			s.dropChunks(deadline, kk, oldm)
+		}
+		return vvs[0].Seqnum, nil
+	}
+}
+
+// GC removes the chunks of versions no manifest refers to, unless written
+// within grace as their manifest may be underway still.
+func (s *Store) GC(deadline time.Time, grace time.Duration) (int, error) {
+	cursor := api.RubiksKK{Table: s.chunks}
+	horizon := uint64(time.Now().Add(-grace).UnixMilli()) << versionShift
+	ndropped := 0
+
+	var kk api.RubiksKK
+	var m manifest
+	var present bool
+
+	for {
+		// keys only, iterate yields present pairs
+		kks, _, err := s.rubiks.Iterate(deadline, cursor, api.MaxNPairs, 0)
+		if err == api.NONEXT || (err == nil && len(kks) == 0) {
+			return ndropped, nil
+		} else if err != nil {
+			return ndropped, err
+		}
+
+		var drops []api.RubiksKK
+		done := false
+		for _, ckk := range kks {
+			if ckk.Table != s.chunks {
+				done = true
+				break
+			}
+
+			kk1, version, _, err := parseChunkKey(ckk.Key)
+			if err != nil {
+				log.Warn("gc: bad chunk key %v", ckk)
+				continue
+			}
+
+			if kk1.Table != kk.Table || string(kk1.Key) != string(kk.Key) {
+				var vv api.RubiksVV
+				if vv, m, err = s.getManifest(deadline, kk1); err == ErrCorrupted {
+					vv, err = api.RubiksVV{Present: false}, nil
+				}
+				if err != nil {
+					return ndropped, err
+				}
+				kk, present = kk1, vv.Present
+			}
+
+			if (!present || m.version != version) && version < horizon {
+				drops = append(drops, ckk)
+			}
+		}
+
+		if err := s.drop(deadline, drops); err != nil {
+			return ndropped, err
+		}
+		ndropped += len(drops)
+
+		if done {
+			return ndropped, nil
+		}
+		cursor = kks[len(kks) - 1]
+	}
+}
+
+func (s *Store) getPair(deadline time.Time, kk api.RubiksKK) (api.RubiksVV, manifest, error) {
+	vvs, err := s.rubiks.Get(deadline, []api.RubiksKK{kk})
+	if err != nil {
+		return api.RubiksVV{}, manifest{}, err
+	} else if len(vvs) != 1 {
+		return api.RubiksVV{}, manifest{}, api.EIO
+	}
+	return vvs[0], manifest{}, nil
+}
+
+func (s *Store) getManifest(deadline time.Time, kk api.RubiksKK) (api.RubiksVV, manifest, error) {
+	vv, _, err := s.getPair(deadline, kk)
+	if err != nil || !vv.Present {
+		return vv, manifest{}, err
+	}
+
+	m, err := decodeManifest(vv.Val)
+	if err != nil {
+		return api.RubiksVV{}, manifest{}, err
+	}
+	vv.Val = nil
+	return vv, m, nil
+}
+
+func (s *Store) getChunks(deadline time.Time, kk api.RubiksKK, m manifest) ([]byte, error) {
+	val := make([]byte, 0, m.size)
+
+	for i := 0; i < m.nchunks; i += api.MaxNPairs {
+		var kks []api.RubiksKK
+		for j := i; j < m.nchunks && j < i + api.MaxNPairs; j += 1 {
+			kks = append(kks, s.chunkKK(kk, m.version, j))
+		}
+
+		vvs, err := s.rubiks.Get(deadline, kks)
+		if err != nil {
+			return nil, err
+		} else if len(vvs) != len(kks) {
+			return nil, api.EIO
+		}
+
+		for _, vv := range vvs {
+			if !vv.Present {
+				return nil, ErrCorrupted
+			}
+			val = append(val, vv.Val...)
+		}
+	}
+
+	if uint64(len(val)) != m.size || !crc128.Eq(crc128.Update(crc0, val), m.crc) {
+		return nil, ErrCorrupted
+	}
+	return val, nil
+}
+
+func (s *Store) putChunks(deadline time.Time, kk api.RubiksKK, val []byte) (manifest, error) {
+	m := manifest{
+		size:    uint64(len(val)),
+		version: mkVersion(),
+		crc:     crc128.Update(crc0, val),
+	}
+
+	// one chunk per commit, a chunk fills MaxCommitSize alone
+	for n := s.chunkSize(kk); len(val) > 0; m.nchunks += 1 {
+		chunk := val[:min(n, len(val))]
+		val = val[len(chunk):]
+
+		_, err := s.rubiks.Commit(deadline,
+			[]api.RubiksKK{s.chunkKK(kk, m.version, m.nchunks)},
+			[]api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: chunk}})
+		if err != nil {
+			s.dropChunks(deadline, kk, m)
+			return manifest{}, err
+		}
+	}
+	return m, nil
+}
+
+// dropChunks is best effort, GC gets what is left behind
+func (s *Store) dropChunks(deadline time.Time, kk api.RubiksKK, m manifest) {
+	var kks []api.RubiksKK
+
+	for i := 0; i < m.nchunks; i += 1 {
+		kks = append(kks, s.chunkKK(kk, m.version, i))
+	}
+
+	if err := s.drop(deadline, kks); err != nil {
+		log.Warn("drop chunks of %v version %d: %s", kk, m.version, err)
+	}
+}
+
+func (s *Store) drop(deadline time.Time, kks []api.RubiksKK) error {
+	for len(kks) > 0 {
+		n := min(len(kks), api.MaxNPairs)
+		vvs := make([]api.RubiksVV, n)
+
+		for i := range vvs {
+			vvs[i] = api.RubiksVV{Present: false, Seqnum: api.SeqnumInf}
+		}
+
+		if _, err := s.rubiks.Commit(deadline, kks[:n], vvs); err != nil {
+			return err
+		}
+		kks = kks[n:]
+	}
+	return nil
+}
+
+func (s *Store) inlineSize(kk api.RubiksKK) int {
+	return api.MaxCommitSize - pairOverhead - len(kk.Key) - 1
+}
+
+func (s *Store) chunkSize(kk api.RubiksKK) int {
+	return api.MaxCommitSize - pairOverhead - len(s.chunkKK(kk, 0, 0).Key)
+}
+
+func (s *Store) chunkKK(kk api.RubiksKK, version uint64, chunk int) api.RubiksKK {
+	key := serd.Append64BE(nil, uint64(kk.Table))
+	key = append(key, kk.Key...)
+	key = serd.Append24BE(key, len(kk.Key))
+	key = serd.Append64BE(key, version)
+	key = serd.Append24BE(key, chunk)
+
+	return api.RubiksKK{Table: s.chunks, Key: key}
+}
+
+func parseChunkKey(key []byte) (api.RubiksKK, uint64, int, error) {
+	if len(key) < 8 + 3 + 8 + 3 {
+		return api.RubiksKK{}, 0, 0, api.EIO
+	}
+
+	tail := key[len(key) - 3 - 8 - 3:]
+	klen, tail, _ := serd.Get64BE(3, tail)
+	version, tail, _ := serd.Get64BE(8, tail)
+	chunk, _, _ := serd.Get64BE(3, tail)
+
+	if int(klen) != len(key) - 8 - 3 - 8 - 3 {
+		return api.RubiksKK{}, 0, 0, api.EIO
+	}
+	table, _, _ := serd.Get64BE(8, key)
+
+	return api.RubiksKK{Table: api.Table(table), Key: key[8:8+klen]}, version, int(chunk), nil
+}
+
+func encodeManifest(m manifest) []byte {
+	dst := []byte{formatChunked}
+	dst = serd.Append64BE(dst, m.size)
+	dst = serd.Append24BE(dst, m.nchunks)
+	dst = serd.Append64BE(dst, m.version)
+	dst = serd.Append64BE(dst, m.crc.V[0])
+	dst = serd.Append64BE(dst, m.crc.V[1])
+	return dst
+}
+
+func decodeManifest(src []byte) (manifest, error) {
+	var m manifest
+
+	if len(src) > 0 && src[0] == formatInline {
+		m.inline = src[1:]
+		return m, nil
+	} else if len(src) != manifestSize || src[0] != formatChunked {
+		return m, ErrCorrupted
+	}
+
+	src = src[1:]
+	m.size, src, _ = serd.Get64BE(8, src)
+	nchunks, src, _ := serd.Get64BE(3, src)
+	m.version, src, _ = serd.Get64BE(8, src)
+	m.crc.V[0], src, _ = serd.Get64BE(8, src)
+	m.crc.V[1], _, _ = serd.Get64BE(8, src)
+
+	m.nchunks = int(nchunks)
+	if m.version == 0 {
+		return m, ErrCorrupted
+	}
+	return m, nil
+}
+
+func mkVersion() uint64 {
+	return uint64(time.Now().UnixMilli()) << versionShift | uint64(rand.Intn(1 << versionShift)) | 1
+}
@@ -0,0 +1,147 @@
+package rubiks_chunk
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+	"wkk/common/misc"
+	"wkk/network"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+	"wkk/rubiks/rubiks-fake"
+)
+
+const chunks = api.Table(900)
+
+func deadline() time.Time {
+	return time.Now().Add(time.Second)
+}
+
+func Test0(t *testing.T)  {
+	fake := rubiks_fake.New()
+	s := NewStore(fake, chunks)
+	kk := api.RubiksKK{Table: 1, Key: []byte("doc")}
+
+	// small values stay inline
+	seqnum, err := s.Put(deadline(), kk, api.RubiksVV{Present: true, Seqnum: 0, Val: []byte("hello")})
+	misc.AssertNilError(err)
+	misc.Assert(seqnum == 1 && fake.NPresent(chunks) == 0)
+
+	vv, err := s.Get(deadline(), kk)
+	misc.AssertNilError(err)
+	misc.Assert(vv.Present && vv.Seqnum == 1 && string(vv.Val) == "hello")
+
+	big := make([]byte, 100 * 1024)
+	rand.Read(big)
+
+	_, err = s.Put(deadline(), kk, api.RubiksVV{Present: true, Seqnum: 0, Val: big})
+	misc.Assert(err == api.STALE && fake.NPresent(chunks) == 0)
+
+	seqnum, err = s.Put(deadline(), kk, api.RubiksVV{Present: true, Seqnum: 1, Val: big})
+	misc.AssertNilError(err)
+	nchunks := fake.NPresent(chunks)
+	misc.Assert(seqnum == 2 && nchunks == (len(big) + s.chunkSize(kk) - 1) / s.chunkSize(kk))
+
+	vv, err = s.Get(deadline(), kk)
+	misc.AssertNilError(err)
+	misc.Assert(vv.Seqnum == 2 && bytes.Equal(vv.Val, big))
+
+	// the version replaced goes away with the write
+	big[0] ^= 0xff
+	_, err = s.Put(deadline(), kk, api.RubiksVV{Present: true, Seqnum: api.SeqnumInf, Val: big})
+	misc.AssertNilError(err)
+	misc.Assert(fake.NPresent(chunks) == nchunks)
+
+	vv, err = s.Get(deadline(), kk)
+	misc.AssertNilError(err)
+	misc.Assert(vv.Seqnum == 3 && bytes.Equal(vv.Val, big))
+
+	_, err = s.Put(deadline(), kk, api.RubiksVV{Present: false, Seqnum: 3})
+	misc.AssertNilError(err)
+	misc.Assert(fake.NPresent(chunks) == 0)
+
+	vv, err = s.Get(deadline(), kk)
+	misc.Assert(err == nil && !vv.Present && vv.Seqnum == 4)
+}
+
+func Test1(t *testing.T)  {
+	fake := rubiks_fake.New()
+	s := NewStore(fake, chunks)
+	kk := api.RubiksKK{Table: 1, Key: []byte("doc")}
+
+	val := make([]byte, 40 * 1024)
+	_, err := s.Put(deadline(), kk, api.RubiksVV{Present: true, Seqnum: api.SeqnumInf, Val: val})
+	misc.AssertNilError(err)
+	nchunks := fake.NPresent(chunks)
+
+	// chunks of a write aborted before its manifest
+	_, err = s.putChunks(deadline(), kk, val)
+	misc.AssertNilError(err)
+	misc.Assert(fake.NPresent(chunks) == 2 * nchunks)
+
+	n, err := s.GC(deadline(), time.Hour)
+	misc.Assert(err == nil && n == 0)
+
+	n, err = s.GC(deadline(), -time.Second)
+	misc.Assert(err == nil && n == nchunks && fake.NPresent(chunks) == nchunks)
+
+	vv, err := s.Get(deadline(), kk)
+	misc.Assert(err == nil && bytes.Equal(vv.Val, val))
+
+	// a chunk lost under a manifest that stays put
+	kks, _, err := fake.Iterate(deadline(), api.RubiksKK{Table: chunks}, 1, api.IterateHintSeqnum)
+	misc.AssertNilError(err)
+	_, err = fake.Commit(deadline(), kks, []api.RubiksVV{{Present: false, Seqnum: api.SeqnumInf}})
+	misc.AssertNilError(err)
+
+	_, err = s.Get(deadline(), kk)
+	misc.Assert(err == ErrCorrupted)
+}
+
+// through the client, GC sees keys only and stays in the chunk table
+func Test2(t *testing.T)  {
+	fake := rubiks_fake.New()
+	server, err := rubiks_fake.NewServer(fake)
+	misc.AssertNilError(err)
+	defer server.Close()
+
+	s := NewStore(client.NewRubiksClient(network.EndpointList{server.Endpoint()}), chunks)
+	kk := api.RubiksKK{Table: 1, Key: []byte("doc")}
+
+	val := make([]byte, 40 * 1024)
+	_, err = s.Put(deadline(), kk, api.RubiksVV{Present: true, Seqnum: api.SeqnumInf, Val: val})
+	misc.AssertNilError(err)
+	nchunks := fake.NPresent(chunks)
+
+	_, err = s.putChunks(deadline(), kk, val)
+	misc.AssertNilError(err)
+
+	next := api.RubiksKK{Table: chunks + 1, Key: []byte("other")}
+	_, err = fake.Commit(deadline(), []api.RubiksKK{next}, []api.RubiksVV{{Present: true, Seqnum: api.SeqnumInf, Val: []byte("x")}})
+	misc.AssertNilError(err)
+
+	n, err := s.GC(deadline(), -time.Second)
+	misc.Assert(err == nil && n == nchunks && fake.NPresent(chunks) == nchunks)
+	misc.Assert(fake.Lookup(next).Present)
+
+	vv, err := s.Get(deadline(), kk)
+	misc.Assert(err == nil && bytes.Equal(vv.Val, val))
+}
+
+// iterates nothing, with no NONEXT either
+type emptyIterate struct {
+	client.Rubiks
+}
+
+func (emptyIterate) RPCIterate(rbr *client.RubiksR, deadline time.Time,
+	cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+	return nil, nil, nil
+}
+
+func Test3(t *testing.T)  {
+	s := NewStore(emptyIterate{rubiks_fake.New()}, chunks)
+
+	n, err := s.GC(deadline(), -time.Second)
+	misc.Assert(err == nil && n == 0)
+}
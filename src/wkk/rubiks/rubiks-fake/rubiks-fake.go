@@ -0,0 +1,151 @@
+package rubiks_fake
+
+import (
+    "bytes"
+    "sort"
+    "sync"
+    "time"
+    "wkk/rubiks/api"
+    "wkk/rubiks/client"
+)
+
+// Fake is an in-memory client.Rubiks for tests, deleted keys leave their
+// seqnum. Commits are checked against api.MaxNPairs only.
+type Fake struct {
+    NRPC  int   // RPCs so far
+
+    mtx   sync.Mutex
+    pairs map[api.Table]map[string]api.RubiksVV
+}
+
+var _ client.Rubiks = (*Fake)(nil)
+
+func New() *Fake {
+    return &Fake{pairs: make(map[api.Table]map[string]api.RubiksVV)}
+}
+
+func (f *Fake) lookup(kk api.RubiksKK) api.RubiksVV {
+    return f.pairs[kk.Table][string(kk.Key)]
+}
+
+// Lookup peeks at a pair without counting an RPC
+func (f *Fake) Lookup(kk api.RubiksKK) api.RubiksVV {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    return f.lookup(kk)
+}
+
+// NPresent counts the present pairs of table
+func (f *Fake) NPresent(table api.Table) int {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+
+    n := 0
+    for _, vv := range f.pairs[table] {
+        if vv.Present {
+            n += 1
+        }
+    }
+    return n
+}
+
+func (f *Fake) RPCGet(rbr *client.RubiksR, deadline time.Time,
+    kks []api.RubiksKK) ([]api.RubiksVV, error) {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    f.NRPC += 1
+
+    var vvs []api.RubiksVV
+    for _, kk := range kks {
+        vvs = append(vvs, f.lookup(kk))
+    }
+    return vvs, nil
+}
+
+func (f *Fake) RPCCommit(rbr *client.RubiksR, deadline time.Time,
+    kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    f.NRPC += 1
+
+    if len(kks) > api.MaxNPairs {
+        return nil, api.INVAL
+    }
+    for i, kk := range kks {
+        if vvs[i].Seqnum != api.SeqnumInf && vvs[i].Seqnum != f.lookup(kk).Seqnum {
+            return nil, api.STALE
+        }
+    }
+
+    for i, kk := range kks {
+        if f.pairs[kk.Table] == nil {
+            f.pairs[kk.Table] = make(map[string]api.RubiksVV)
+        }
+        vv := api.RubiksVV{
+            Present: vvs[i].Present,
+            Seqnum:  f.lookup(kk).Seqnum + 1,
+            Val:     append([]byte{}, vvs[i].Val...),
+        }
+        f.pairs[kk.Table][string(kk.Key)] = vv
+        vvs[i].Seqnum = vv.Seqnum
+    }
+    return vvs, nil
+}
+
+func (f *Fake) RPCConfirm(rbr *client.RubiksR, deadline time.Time,
+    kks []api.RubiksKK, vvs []api.RubiksVV) error {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    f.NRPC += 1
+
+    for i, kk := range kks {
+        if vvs[i].Seqnum != f.lookup(kk).Seqnum {
+            return api.STALE
+        }
+    }
+    return nil
+}
+
+func (f *Fake) RPCIterate(rbr *client.RubiksR, deadline time.Time,
+    cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+    f.mtx.Lock()
+    defer f.mtx.Unlock()
+    f.NRPC += 1
+
+    var keys []string
+    for key, vv := range f.pairs[cursor.Table] {
+        if vv.Present && bytes.Compare([]byte(key), cursor.Key) > 0 {
+            keys = append(keys, key)
+        }
+    }
+    if len(keys) == 0 {
+        return nil, nil, api.NONEXT
+    }
+    sort.Strings(keys)
+
+    var kks []api.RubiksKK
+    var vvs []api.RubiksVV
+    for _, key := range keys[:min(npairs, len(keys))] {
+        kks = append(kks, api.RubiksKK{Table: cursor.Table, Key: []byte(key)})
+        vvs = append(vvs, f.pairs[cursor.Table][key])
+    }
+    return kks, vvs, nil
+}
+
+func (f *Fake) Get(deadline time.Time, kks []api.RubiksKK) ([]api.RubiksVV, error) {
+    return f.RPCGet(nil, deadline, kks)
+}
+
+func (f *Fake) Commit(deadline time.Time,
+    kks []api.RubiksKK, vvs []api.RubiksVV) ([]api.RubiksVV, error) {
+    return f.RPCCommit(nil, deadline, kks, vvs)
+}
+
+func (f *Fake) Confirm(deadline time.Time, kks []api.RubiksKK, vvs []api.RubiksVV) error {
+    return f.RPCConfirm(nil, deadline, kks, vvs)
+}
+
+func (f *Fake) Iterate(deadline time.Time, cursor api.RubiksKK, npairs int,
+    hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+    return f.RPCIterate(nil, deadline, cursor, npairs, hint)
+}
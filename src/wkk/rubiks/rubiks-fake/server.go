@@ -0,0 +1,275 @@
+package rubiks_fake
+
+import (
+    "net"
+    "sync"
+    "time"
+    "wkk/common/blob"
+    "wkk/network"
+    "wkk/rubiks/api"
+)
+
+// Server serves a Fake over the wire protocol, for tests of the client
+// as a whole. Inject delays or fails requests on the way.
+type Server struct {
+    Fake *Fake
+
+    listener net.Listener
+    mtx      sync.Mutex
+    inject   func(kind uint64) (time.Duration, api.Outcome)
+    own      func(kk api.RubiksKK) bool
+    peer     network.Peer
+    nreq     int
+}
+
+func NewServer(fake *Fake) (*Server, error) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+
+    s := &Server{
+        Fake:     fake,
+        listener: listener,
+        peer:     network.Peer{Version: network.Version, Features: api.Features},
+    }
+    go s.accept()
+    return s, nil
+}
+
+func (s *Server) Endpoint() network.Endpoint {
+    return network.Endpoint(*s.listener.Addr().(*net.TCPAddr))
+}
+
+func (s *Server) Close() {
+    _ = s.listener.Close()
+}
+
+// Inject is consulted on every request, a delay to respond after and an
+// outcome other than OK to respond with instead of serving it.
+func (s *Server) Inject(inject func(kind uint64) (time.Duration, api.Outcome)) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.inject = inject
+}
+
+// Own has requests for kks it does not own, by their first kk, answered
+// MOVED, nil owns all.
+func (s *Server) Own(own func(kk api.RubiksKK) bool) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.own = own
+}
+
+func (s *Server) owns(kks []api.RubiksKK) bool {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.own == nil || len(kks) == 0 || s.own(kks[0])
+}
+
+// SetPeer is told in every response from now on, Version 0 for an
+// older server
+func (s *Server) SetPeer(peer network.Peer) {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    s.peer = peer
+}
+
+// NReq counts the requests received, served or not
+func (s *Server) NReq() int {
+    s.mtx.Lock()
+    defer s.mtx.Unlock()
+    return s.nreq
+}
+
+func (s *Server) accept() {
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+        go s.serve(conn)
+    }
+}
+
+func (s *Server) serve(conn net.Conn) {
+    defer conn.Close()
+
+    var wmtx sync.Mutex
+    data := make([]byte, 4 * api.SerializeSize)
+
+    for avail := 0; ; {
+        n, err := conn.Read(data[avail:])
+        if err != nil {
+            return
+        }
+        avail += n
+
+        for {
+            n, _, _ := network.Consumable(data[:avail], api.WireMagic)
+            if n < 0 {
+                return
+            } else if n == 0 {
+                break
+            }
+
+            src := append([]byte{}, data[:n]...)
+            copy(data, data[n:avail])
+            avail -= n
+
+            go func() {
+                resp := s.handle(src)
+                if resp == nil {
+                    return
+                }
+
+                wmtx.Lock()
+                defer wmtx.Unlock()
+                _, _ = conn.Write(resp)
+            }()
+        }
+    }
+}
+
+func (s *Server) handle(src []byte) []byte {
+    var req, resp api.RubiksMessage
+
+    if err := req.Deserialize(src); err != nil {
+        return nil
+    }
+    kind := req.Get(api.TagKind)
+
+    s.mtx.Lock()
+    s.nreq += 1
+    inject, peer := s.inject, s.peer
+    s.mtx.Unlock()
+
+    oc := api.OK
+    if inject != nil {
+        var delay time.Duration
+        if delay, oc = inject(kind); delay > 0 {
+            time.Sleep(delay)
+        }
+    }
+
+    if oc == api.OK {
+        oc = s.apply(&req, &resp, kind)
+    }
+    if oc != api.OK {
+        resp.Reset(kind | network.KindBitResponse, 0, api.PayloadZero)
+    }
+    resp.Put(api.TagOutcome, uint64(oc))
+    resp.PutHdr1(time.Now(), req.Hdr(network.TagRequestID), req.Hdr(network.TagClientID), peer)
+
+    return resp.Serialize(make([]byte, api.SerializeSize))
+}
+
+func (s *Server) apply(req, resp *api.RubiksMessage, kind uint64) api.Outcome {
+    deadline := time.Now().Add(time.Second)
+    npairs := int(req.Get(api.TagNPairs))
+    kind |= network.KindBitResponse
+
+    switch kind &^ network.KindBitResponse {
+    case api.KindGet:
+        kks, err := api.DeserializeKKS(req.Blob(0).Data)
+        if err != nil || len(kks) != npairs {
+            return api.INVAL
+        }
+        if !s.owns(kks) {
+            return api.MOVED
+        }
+
+        vvs, _ := s.Fake.Get(deadline, kks)
+        s.respond(resp, kind, kks, vvs, true)
+
+    case api.KindCommit:
+        kks, vvs, err := api.DeserializeKVS(req.Blob(0).Data)
+        if err != nil || len(kks) != npairs {
+            return api.INVAL
+        }
+        if !s.owns(kks) {
+            return api.MOVED
+        }
+
+        present := req.Get(api.TagPresent)
+        for i := range vvs {
+            vvs[i].Present = present & (1 << i) != 0
+            vvs[i].Seqnum = req.GetSeqnum(i)
+        }
+
+        vvs, err = s.Fake.Commit(deadline, kks, vvs)
+        if err != nil {
+            return err.(api.Outcome)
+        }
+        for i := range vvs {
+            vvs[i].Val = nil
+        }
+        s.respond(resp, kind, nil, vvs, true)
+
+    case api.KindConfirm:
+        kks, err := api.DeserializeKKS(req.Blob(0).Data)
+        if err != nil || len(kks) != npairs {
+            return api.INVAL
+        }
+        if !s.owns(kks) {
+            return api.MOVED
+        }
+
+        vvs := make([]api.RubiksVV, len(kks))
+        for i := range vvs {
+            vvs[i].Seqnum = req.GetSeqnum(i)
+        }
+
+        if err := s.Fake.Confirm(deadline, kks, vvs); err != nil {
+            return err.(api.Outcome)
+        }
+        resp.Reset(kind, 0, api.PayloadZero)
+
+    case api.KindIterate:
+        cursor, err := api.DeserializeKKS(req.Blob(0).Data)
+        if err != nil || len(cursor) != 1 {
+            return api.INVAL
+        }
+        if !s.owns(cursor) {
+            return api.MOVED
+        }
+        hint := api.IterateHint(req.Get(api.TagIterateHint))
+
+        kks, vvs, err := s.Fake.Iterate(deadline, cursor[0], npairs, hint)
+        if err != nil {
+            return err.(api.Outcome)
+        }
+
+        if hint & api.IterateHintValue == 0 {
+            resp.Reset(kind, len(kks), blob.Seal(api.SerializeKKS(make([]byte, api.SerializeSize), kks),
+                api.PayloadZero.CRC))
+        } else {
+            s.respond(resp, kind, kks, vvs, hint & api.IterateHintSeqnum != 0)
+        }
+
+    default:
+        return api.INVAL
+    }
+    return api.OK
+}
+
+func (s *Server) respond(resp *api.RubiksMessage, kind uint64,
+    kks []api.RubiksKK, vvs []api.RubiksVV, seqnums bool) {
+
+    payload := api.PayloadZero
+    if kks != nil {
+        payload = blob.Seal(api.SerializeKVS(make([]byte, api.SerializeSize), kks, vvs), api.PayloadZero.CRC)
+    }
+    resp.Reset(kind, len(vvs), payload)
+
+    present := uint64(0)
+    for i, vv := range vvs {
+        if seqnums {
+            resp.Put(api.TagSeqnum + uint64(i), uint64(vv.Seqnum))
+        }
+        if vv.Present {
+            present |= 1 << i
+        }
+    }
+    resp.Put(api.TagPresent, present)
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// rubiks-orm-gen writes the reflection free KeyCoder of rubiks-orm entities,
+// typically from a go:generate line next to the entity:
+//
+//	//go:generate rubiks-orm-gen -type User
+func main() {
+	output, types, tables, input := parseInput()
+
+	src, err := generate(input, types, tables)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rubiks-orm-gen: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(output, src, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "rubiks-orm-gen: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+type field struct {
+	Name  string
+	Type  string	// uint64, string or time.Time
+	Param string	// name as helper parameter
+}
+
+type index struct {
+	Tag    string
+	Table  uint64
+	Const  string
+	By     string	// field names joined
+	Fields []field
+}
+
+type entity struct {
+	Name      string
+	Primary   index
+	Indexes   []index
+	Decodable bool
+}
+
+type file struct {
+	Package  string
+	Entities []entity
+	Time     bool	// helpers take time.Time
+	Context  bool	// there are helpers at all
+	Serd     bool
+}
+
+func generate(input string, types []string, tables map[string]uint64) ([]byte, error) {
+	fset := token.NewFileSet()
+
+	f, err := parser.ParseFile(fset, input, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	out := file{Package: f.Name.Name}
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok || (len(types) > 0 && !slices.Contains(types, ts.Name.Name)) {
+				continue
+			}
+
+			ent, ok, err := mkEntity(ts.Name.Name, st, tables)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", fset.Position(ts.Pos()), err)
+			}
+			if ok {
+				out.Entities = append(out.Entities, ent)
+				delete(wanted, ts.Name.Name)
+			}
+		}
+	}
+
+	for t := range wanted {
+		return nil, fmt.Errorf("no entity %s in %s", t, input)
+	}
+	if len(out.Entities) == 0 {
+		return nil, fmt.Errorf("no entity in %s", input)
+	}
+
+	for _, ent := range out.Entities {
+		out.Context = out.Context || len(ent.Indexes) > 0
+		out.Serd = out.Serd || len(ent.Indexes) > 0
+
+		for _, f := range ent.Primary.Fields {
+			out.Serd = out.Serd || f.Type != "string"
+		}
+		for _, idx := range ent.Indexes {
+			for _, f := range idx.Fields {
+				out.Time = out.Time || f.Type == "time.Time"
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, out); err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// mkEntity follows rubiks-orm Register, ok is false for a struct carrying
+// no key tags at all.
+func mkEntity(name string, st *ast.StructType, tables map[string]uint64) (entity, bool, error) {
+	ent := entity{Name: name, Decodable: true}
+	byTag := make(map[string]*index)
+	var tags []string
+
+	for _, f := range st.Fields.List {
+		if f.Tag == nil || len(f.Names) == 0 {
+			continue
+		}
+
+		tag, err := strconv.Unquote(f.Tag.Value)
+		if err != nil {
+			return ent, false, err
+		}
+
+		typ := exprString(f.Type)
+		primary, isPrimary := reflect.StructTag(tag).Lookup("primary")
+		secondary, isIndex := reflect.StructTag(tag).Lookup("index")
+		if !isPrimary && !isIndex {
+			continue
+		}
+		if typ != "uint64" && typ != "string" && typ != "time.Time" {
+			return ent, false, fmt.Errorf("field %s: %s can't be part of a key", f.Names[0], typ)
+		}
+
+		for _, n := range f.Names {
+			if isPrimary {
+				if ent.Primary.Tag != "" && ent.Primary.Tag != primary {
+					return ent, false, fmt.Errorf("field %s: primary %q differs from %q",
+						n.Name, primary, ent.Primary.Tag)
+				}
+				ent.Primary.Tag = primary
+				ent.Primary.Fields = append(ent.Primary.Fields, field{Name: n.Name, Type: typ})
+			}
+
+			if isIndex {
+				if _, ok := byTag[secondary]; !ok {
+					byTag[secondary] = &index{Tag: secondary}
+					tags = append(tags, secondary)
+				}
+				byTag[secondary].Fields = append(byTag[secondary].Fields,
+					field{Name: n.Name, Type: typ, Param: param(n.Name)})
+			}
+		}
+	}
+
+	if ent.Primary.Tag == "" && len(tags) == 0 {
+		return ent, false, nil
+	} else if ent.Primary.Tag == "" {
+		return ent, false, errors.New("no primary field")
+	}
+
+	var err error
+	if ent.Primary.Table, err = resolve(ent.Primary.Tag, tables); err != nil {
+		return ent, false, err
+	}
+	ent.Primary.Const = name + "Table"
+
+	for i, f := range ent.Primary.Fields {
+		last := i == len(ent.Primary.Fields) - 1
+		if f.Type == "time.Time" || (f.Type == "string" && !last) {
+			ent.Decodable = false
+		}
+	}
+
+	sort.Strings(tags)	// same order as the ORM
+	for _, tag := range tags {
+		idx := byTag[tag]
+		if tag == ent.Primary.Tag {
+			return ent, false, fmt.Errorf("index %q is also primary", tag)
+		}
+		if idx.Table, err = resolve(tag, tables); err != nil {
+			return ent, false, err
+		}
+		idx.By = idx.byName()
+		idx.Const = name + "By" + idx.By + "Table"
+		ent.Indexes = append(ent.Indexes, *idx)
+	}
+	return ent, true, nil
+}
+
+func (idx index) byName() string {
+	name := ""
+	for _, f := range idx.Fields {
+		name += f.Name
+	}
+	return name
+}
+
+func resolve(tag string, tables map[string]uint64) (uint64, error) {
+	if table, err := strconv.ParseUint(tag, 10, 64); err == nil {
+		return table, nil
+	}
+	if table, ok := tables[tag]; ok {
+		return table, nil
+	}
+	return 0, fmt.Errorf("table %q neither numeric nor given by -tables", tag)
+}
+
+func param(name string) string {
+	p := strings.ToLower(name[:1]) + name[1:]
+	if token.IsKeyword(p) || p == "ctx" || p == "orm" {
+		p += "0"
+	}
+	return p
+}
+
+func exprString(e ast.Expr) string {
+	switch t := e.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.SelectorExpr:
+		return exprString(t.X) + "." + t.Sel.Name
+	case *ast.StarExpr:
+		return "*" + exprString(t.X)
+	case *ast.ArrayType:
+		return "[]" + exprString(t.Elt)
+	}
+	return fmt.Sprintf("%T", e)
+}
+
+var tmpl = template.Must(template.New("").Funcs(template.FuncMap{
+	"put": func(f field) string {
+		switch f.Type {
+		case "uint64":	return "key = serd.Append64BE(key, e." + f.Name + ")"
+		case "string":	return "key = append(key, e." + f.Name + "...)"
+		default:		return "key = serd.Append64BE(key, uint64(e." + f.Name + ".Second()))"
+		}
+	},
+}).Parse(`// Code generated by rubiks-orm-gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	{{- if .Context}}
+	"context"
+	{{- end}}
+	{{- if .Time}}
+	"time"
+	{{- end}}
+	{{- if .Serd}}
+	"wkk/common/serd"
+	{{- end}}
+	"wkk/rubiks/api"
+	"wkk/rubiks/rubiks-orm"
+)
+
+{{range $e := .Entities}}
+const (
+	{{$e.Primary.Const}} = api.Table({{$e.Primary.Table}})
+	{{- range $e.Indexes}}
+	{{.Const}} = api.Table({{.Table}})	// index "{{.Tag}}"
+	{{- end}}
+)
+
+var _ rubiks_orm.KeyCoder = (*{{$e.Name}})(nil)
+
+func (e *{{$e.Name}}) RubiksPrimaryKK() api.RubiksKK {
+	var key []byte
+	{{- range $e.Primary.Fields}}
+	{{put .}}
+	{{- end}}
+	return api.RubiksKK{Table: {{$e.Primary.Const}}, Key: key}
+}
+
+func (e *{{$e.Name}}) RubiksSecondaryKK(index string, pk *api.RubiksKK) api.RubiksKK {
+	{{- if not $e.Indexes}}
+	return api.RubiksKK{}	// no index
+	{{- else}}
+	var key []byte
+	var table api.Table
+
+	switch index {
+	{{- range $e.Indexes}}
+	case "{{.Tag}}":
+		table = {{.Const}}
+		{{- range .Fields}}
+		{{put .}}
+		{{- end}}
+	{{- end}}
+	default:
+		return api.RubiksKK{}
+	}
+
+	if pk != nil {
+		key = append(key, pk.Key...)
+		key = serd.Append24BE(key, len(pk.Key))
+	}
+	return api.RubiksKK{Table: table, Key: key}
+	{{- end}}
+}
+{{if $e.Decodable}}
+var _ rubiks_orm.PKDecoder = (*{{$e.Name}})(nil)
+
+// RubiksDecodePK fills the primary fields from a primary key.
+func (e *{{$e.Name}}) RubiksDecodePK(key []byte) error {
+	{{- range $e.Primary.Fields}}
+	{{- if eq .Type "uint64"}}
+	if len(key) < 8 {
+		return api.EIO
+	}
+	e.{{.Name}}, key, _ = serd.Get64BE(8, key)
+	{{- else}}
+	e.{{.Name}}, key = string(key), nil
+	{{- end}}
+	{{- end}}
+	if len(key) != 0 {
+		return api.EIO
+	}
+	return nil
+}
+{{end}}
+{{- range $idx := $e.Indexes}}
+func List{{$e.Name}}By{{$idx.By}}(ctx context.Context, orm rubiks_orm.RubiksOrm
+	{{- range $idx.Fields}}, {{.Param}} {{.Type}}{{end}}) *rubiks_orm.Cursor {
+	probe := &{{$e.Name}}{
+		{{- range $idx.Fields}}{{.Name}}: {{.Param}}, {{end -}}
+	}
+	return orm.ListBy(ctx, probe, "{{$idx.Tag}}")
+}
+{{end}}
+{{- end}}
+`))
+
+func parseInput() (string, []string, map[string]uint64, string) {
+	flag.Usage = func() {
+		fmt.Printf("rubiks-orm-gen [-type T,...] [-tables name=table,...] [-o output] [file.go]\n")
+		fmt.Printf("  file.go   source of the entities, $GOFILE by default          \n")
+		fmt.Printf("  -type     entities to generate, all tagged structs by default \n")
+		fmt.Printf("  -tables   numbers of the named tables in tags                 \n")
+		fmt.Printf("  -o        output, file_rubiks.go by default                   \n")
+	}
+
+	output := flag.String("o", "", "output file")
+	types := flag.String("type", "", "comma separated entity types")
+	tables := flag.String("tables", "", "comma separated name=table")
+	flag.Parse()
+
+	input := os.Getenv("GOFILE")
+	if flag.NArg() > 0 {
+		input = flag.Arg(0)
+	}
+	if input == "" {
+		flag.Usage()
+		os.Exit(255)
+	}
+
+	if *output == "" {
+		if strings.HasSuffix(input, "_test.go") {
+			*output = strings.TrimSuffix(input, "_test.go") + "_rubiks_test.go"
+		} else {
+			*output = strings.TrimSuffix(input, ".go") + "_rubiks.go"
+		}
+	}
+
+	var typeList []string
+	if *types != "" {
+		typeList = strings.Split(*types, ",")
+	}
+
+	tableMap := make(map[string]uint64)
+	for _, s := range strings.Split(*tables, ",") {
+		if ss := strings.Split(s, "="); len(ss) == 2 {
+			table, err := strconv.ParseUint(ss[1], 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "rubiks-orm-gen: bad table %q\n", s)
+				os.Exit(255)
+			}
+			tableMap[ss[0]] = table
+		}
+	}
+	return *output, typeList, tableMap, input
+}
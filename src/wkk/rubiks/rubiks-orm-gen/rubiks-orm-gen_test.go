@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"wkk/common/misc"
+)
+
+// the checked in output under rubiks-orm, which tests it, must be current
+func Test0(t *testing.T)  {
+	src, err := generate("../rubiks-orm/gen_test.go",
+		[]string{"GenUser", "GenEvent"}, map[string]uint64{"events": 210})
+	misc.AssertNilError(err)
+
+	existing, err := os.ReadFile("../rubiks-orm/gen_rubiks_test.go")
+	misc.AssertNilError(err)
+	misc.Assert(bytes.Equal(src, existing))
+}
+
+func Test1(t *testing.T)  {
+	_, err := generate("../rubiks-orm/gen_test.go", []string{"GenEvent"}, nil)
+	misc.Assert(err != nil)	// events unresolved
+
+	_, err = generate("../rubiks-orm/gen_test.go", []string{"Nope"}, nil)
+	misc.Assert(err != nil)
+}
+
+// entities without index, of string or numeric primary, build
+func Test2(t *testing.T)  {
+	input := filepath.Join(t.TempDir(), "plain.go")
+	misc.AssertNilError(os.WriteFile(input, []byte(`package plain
+
+import "wkk/rubiks/rubiks-orm"
+
+type Named struct {
+	rubiks_orm.EntityBase
+	Name string ` + "`primary:\"300\"`" + `
+}
+
+type Numbered struct {
+	rubiks_orm.EntityBase
+	Id uint64 ` + "`primary:\"301\"`" + `
+}
+`), 0644))
+
+	imp := importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+	for _, types := range [][]string{{"Named"}, {"Numbered"}, {"Named", "Numbered"}} {
+		src, err := generate(input, types, nil)
+		misc.AssertNilError(err)
+		misc.Assert(!bytes.Contains(src, []byte(`"context"`)) && !bytes.Contains(src, []byte("switch")))
+		misc.Assert(bytes.Contains(src, []byte(`"wkk/common/serd"`)) == (types[len(types)-1] == "Numbered"))
+		misc.AssertNilError(typeCheck(imp, input, src))
+	}
+}
+
+func typeCheck(imp types.Importer, input string, src []byte) error {
+	fset := token.NewFileSet()
+
+	var files []*ast.File
+	for _, f := range []struct{ name string; src interface{} }{{input, nil}, {"plain_rubiks.go", src}} {
+		file, err := parser.ParseFile(fset, f.name, f.src, 0)
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	conf := types.Config{Importer: imp}
+	_, err := conf.Check(strings.TrimSuffix(filepath.Base(input), ".go"), fset, files, nil)
+	return err
+}
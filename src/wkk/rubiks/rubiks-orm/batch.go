@@ -0,0 +1,143 @@
+package rubiks_orm
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"wkk/rubiks/api"
+)
+
+// staged holds the pairs of one entity, primary first
+type staged struct {
+	kks  []api.RubiksKK
+	vvs  []api.RubiksVV
+	size int	// serialized
+}
+
+func stage(entity EntityI, present bool, seqnum api.Seqnum) (staged, error) {
+	if err := beforeWrite(entity, present); err != nil {
+		return staged{}, err
+	}
+
+	pk := primaryIndex(entity)
+
+	vv, err := commitEntity1(entity, present, seqnum)
+	if err != nil {
+		return staged{}, err
+	}
+
+	st := staged{
+		kks: append([]api.RubiksKK{pk}, secondaryKKs(entity, &pk)...),
+		vvs: append([]api.RubiksVV{vv}, secondaryVVs1(entity, present)...),
+	}
+	for i := range st.kks {
+		st.size += api.SerializedSize(st.kks[i], st.vvs[i])
+	}
+
+	if len(st.kks) > api.MaxNPairs || st.size > api.MaxCommitSize {
+		return st, fmt.Errorf("%v takes %d pairs of %d bytes, over %d pairs or %d bytes: %w",
+			reflect.TypeOf(entity).Elem(), len(st.kks), st.size, api.MaxNPairs, api.MaxCommitSize, ErrTooBig)
+	}
+	return st, nil
+}
+
+// drop removes the index entries of kks not staged already
+func (st *staged) drop(kks []api.RubiksKK) {
+	for _, kk := range kks {
+		if !containsKK(st.kks, kk) {
+			vv := api.RubiksVV{Present: false, Seqnum: api.SeqnumInf}
+
+			st.kks, st.vvs = append(st.kks, kk), append(st.vvs, vv)
+			st.size += api.SerializedSize(kk, vv)
+		}
+	}
+}
+
+func (orm *rubiksOrm) commitStaged(ctx context.Context, entities []EntityI, present []bool, sts []staged) error {
+	var kks []api.RubiksKK
+	var vvs []api.RubiksVV
+
+	// primary kk/vv, then index kk/vv
+	for _, st := range sts {
+		kks, vvs = append(kks, st.kks[0]), append(vvs, st.vvs[0])
+	}
+	for _, st := range sts {
+		kks, vvs = append(kks, st.kks[1:]...), append(vvs, st.vvs[1:]...)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	vvs, err := orm.rubiks.Commit(ctxDeadline(ctx), kks, vvs)
+	if err != nil {
+		return err
+	}
+
+	if len(vvs) != len(kks) {
+		return api.EIO
+	}
+
+	for i, ent := range entities {
+		ent.SetPresent(present[i])
+		ent.SetSeqnum(vvs[i].Seqnum)
+	}
+	return nil
+}
+
+func (orm *rubiksOrm) CommitBatched(ctx context.Context, entities...EntityI) []error {
+	errs := make([]error, len(entities))
+
+	var group []int
+	var sts []staged
+	npairs, size := 0, 0
+
+	flush := func() {
+		if len(group) > 0 {
+			orm.commitGroup(ctx, entities, group, sts, errs)
+		}
+		group, sts, npairs, size = nil, nil, 0, 0
+	}
+
+	for i, ent := range entities {
+		st, err := stage(ent, ent.GetPresent(), ent.GetSeqnum())
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		if npairs + len(st.kks) > api.MaxNPairs || size + st.size > api.MaxCommitSize {
+			flush()
+		}
+		group, sts = append(group, i), append(sts, st)
+		npairs, size = npairs + len(st.kks), size + st.size
+	}
+	flush()
+
+	return errs
+}
+
+// commitGroup commits entities[group] at once, on STALE it commits them
+// one by one to tell the stale ones.
+func (orm *rubiksOrm) commitGroup(ctx context.Context,
+	entities []EntityI, group []int, sts []staged, errs []error) {
+
+	var ents []EntityI
+	var present []bool
+
+	for _, i := range group {
+		ents, present = append(ents, entities[i]), append(present, entities[i].GetPresent())
+	}
+
+	err := orm.commitStaged(ctx, ents, present, sts)
+	if err == api.STALE && len(group) > 1 {
+		for k, i := range group {
+			errs[i] = orm.commitStaged(ctx, ents[k:k+1], present[k:k+1], sts[k:k+1])
+		}
+		return
+	}
+
+	for _, i := range group {
+		errs[i] = err
+	}
+}
@@ -0,0 +1,261 @@
+package rubiks_orm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+)
+
+// binaryCodec lays the exported fields out in declaration order with
+// varints and length prefixes, no field names. Fields may be appended to
+// an entity later on, older values decode with them left zero.
+type binaryCodec struct{}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (binaryCodec) Id() byte {
+	return CodecIdBinary
+}
+
+func (binaryCodec) Marshal(entity EntityI) ([]byte, error) {
+	return appendBinary(nil, reflect.ValueOf(entity).Elem())
+}
+
+func (binaryCodec) Unmarshal(src []byte, entity EntityI) error {
+	rfv := reflect.ValueOf(entity).Elem()
+	var err error
+
+	for i := 0; i < rfv.NumField() && len(src) > 0; i += 1 {
+		if rfv.Type().Field(i).IsExported() {
+			if src, err = readBinary(src, rfv.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(src) != 0 {
+		return errors.New("trailing bytes in value")
+	}
+	return nil
+}
+
+func appendBinary(dst []byte, rfv reflect.Value) ([]byte, error) {
+	var err error
+
+	switch rfv.Kind() {
+	case reflect.Bool:
+		if rfv.Bool() {
+			return append(dst, 1), nil
+		}
+		return append(dst, 0), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(dst, rfv.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(dst, rfv.Uint()), nil
+
+	case reflect.Float32:
+		return binary.LittleEndian.AppendUint32(dst, math.Float32bits(float32(rfv.Float()))), nil
+
+	case reflect.Float64:
+		return binary.LittleEndian.AppendUint64(dst, math.Float64bits(rfv.Float())), nil
+
+	case reflect.String:
+		dst = binary.AppendUvarint(dst, uint64(rfv.Len()))
+		return append(dst, rfv.String()...), nil
+
+	case reflect.Slice:
+		dst = binary.AppendUvarint(dst, uint64(rfv.Len()))
+		if rfv.Type().Elem().Kind() == reflect.Uint8 {
+			return append(dst, rfv.Bytes()...), nil
+		}
+		fallthrough
+
+	case reflect.Array:
+		for i := 0; i < rfv.Len() && err == nil; i += 1 {
+			dst, err = appendBinary(dst, rfv.Index(i))
+		}
+		return dst, err
+
+	case reflect.Map:
+		dst = binary.AppendUvarint(dst, uint64(rfv.Len()))
+		for it := rfv.MapRange(); it.Next() && err == nil; {
+			if dst, err = appendBinary(dst, it.Key()); err == nil {
+				dst, err = appendBinary(dst, it.Value())
+			}
+		}
+		return dst, err
+
+	case reflect.Ptr:
+		if rfv.IsNil() {
+			return append(dst, 0), nil
+		}
+		return appendBinary(append(dst, 1), rfv.Elem())
+
+	case reflect.Struct:
+		if rfv.Type() == timeType {
+			tmp, err := rfv.Interface().(time.Time).MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			dst = binary.AppendUvarint(dst, uint64(len(tmp)))
+			return append(dst, tmp...), nil
+		}
+
+		for i := 0; i < rfv.NumField() && err == nil; i += 1 {
+			if rfv.Type().Field(i).IsExported() {
+				dst, err = appendBinary(dst, rfv.Field(i))
+			}
+		}
+		return dst, err
+	}
+	return nil, fmt.Errorf("binary codec: unsupported %v", rfv.Type())
+}
+
+func readBinary(src []byte, rfv reflect.Value) ([]byte, error) {
+	var err error
+
+	switch rfv.Kind() {
+	case reflect.Bool:
+		if len(src) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rfv.SetBool(src[0] != 0)
+		return src[1:], nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, n := binary.Varint(src)
+		if n <= 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rfv.SetInt(v)
+		return src[n:], nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		v, n := binary.Uvarint(src)
+		if n <= 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rfv.SetUint(v)
+		return src[n:], nil
+
+	case reflect.Float32:
+		if len(src) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rfv.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(src))))
+		return src[4:], nil
+
+	case reflect.Float64:
+		if len(src) < 8 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rfv.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(src)))
+		return src[8:], nil
+
+	case reflect.String:
+		var tmp []byte
+		if tmp, src, err = readBytes(src); err != nil {
+			return nil, err
+		}
+		rfv.SetString(string(tmp))
+		return src, nil
+
+	case reflect.Slice:
+		if rfv.Type().Elem().Kind() == reflect.Uint8 {
+			var tmp []byte
+			if tmp, src, err = readBytes(src); err != nil {
+				return nil, err
+			}
+			rfv.SetBytes(append([]byte{}, tmp...))
+			return src, nil
+		}
+
+		count, n := binary.Uvarint(src)
+		if n <= 0 || count > uint64(len(src)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		src = src[n:]
+
+		rfv.Set(reflect.MakeSlice(rfv.Type(), int(count), int(count)))
+		for i := 0; i < int(count) && err == nil; i += 1 {
+			src, err = readBinary(src, rfv.Index(i))
+		}
+		return src, err
+
+	case reflect.Array:
+		for i := 0; i < rfv.Len() && err == nil; i += 1 {
+			src, err = readBinary(src, rfv.Index(i))
+		}
+		return src, err
+
+	case reflect.Map:
+		count, n := binary.Uvarint(src)
+		if n <= 0 || count > uint64(len(src)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		src = src[n:]
+
+		rfv.Set(reflect.MakeMapWithSize(rfv.Type(), int(count)))
+		for i := 0; i < int(count); i += 1 {
+			k := reflect.New(rfv.Type().Key()).Elem()
+			v := reflect.New(rfv.Type().Elem()).Elem()
+
+			if src, err = readBinary(src, k); err != nil {
+				return nil, err
+			}
+			if src, err = readBinary(src, v); err != nil {
+				return nil, err
+			}
+			rfv.SetMapIndex(k, v)
+		}
+		return src, nil
+
+	case reflect.Ptr:
+		if len(src) < 1 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if src[0] == 0 {
+			rfv.Set(reflect.Zero(rfv.Type()))
+			return src[1:], nil
+		}
+		rfv.Set(reflect.New(rfv.Type().Elem()))
+		return readBinary(src[1:], rfv.Elem())
+
+	case reflect.Struct:
+		if rfv.Type() == timeType {
+			var tmp []byte
+			if tmp, src, err = readBytes(src); err != nil {
+				return nil, err
+			}
+			var t time.Time
+			if err = t.UnmarshalBinary(tmp); err != nil {
+				return nil, err
+			}
+			rfv.Set(reflect.ValueOf(t))
+			return src, nil
+		}
+
+		for i := 0; i < rfv.NumField() && err == nil; i += 1 {
+			if rfv.Type().Field(i).IsExported() {
+				src, err = readBinary(src, rfv.Field(i))
+			}
+		}
+		return src, err
+	}
+	return nil, fmt.Errorf("binary codec: unsupported %v", rfv.Type())
+}
+
+func readBytes(src []byte) ([]byte, []byte, error) {
+	n, m := binary.Uvarint(src)
+	if m <= 0 || n > uint64(len(src) - m) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	src = src[m:]
+	return src[:n], src[n:], nil
+}
@@ -1,9 +1,12 @@
 package rubiks_orm
 
 import (
-	"encoding/json"
+	"bytes"
+	"fmt"
 	"reflect"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 	"wkk/common/log"
 	"wkk/common/misc"
@@ -11,159 +14,344 @@ import (
 	"wkk/rubiks/api"
 )
 
-var entityIndex = make(map[reflect.Type] map[string][]int)
-var entityTable = make(map[reflect.Type]string)
+type schema struct {
+	rft     reflect.Type
+	codec   Codec
+	primary string					// tag of the primary index
+	indexes []string				// tags of secondary indexes, sorted
+	tables  map[string]api.Table	// table by index tag
+	keys    map[string][]keyField	// key fields by index tag
+}
+
+type keyField struct {
+	i   int
+	put func(dst []byte, rfv reflect.Value) []byte
+}
+
+var schemaMtx sync.RWMutex
+var schemas = make(map[reflect.Type]*schema)
+
+// SchemaError lists everything Register found wrong with an entity type.
+type SchemaError struct {
+	Type     reflect.Type
+	Problems []string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("bad entity %v: %s", e.Type, strings.Join(e.Problems, "; "))
+}
+
+func Register(entity EntityI) error {
+	return Register1(entity, JSONCodec)
+}
 
-func Register(entity EntityI) {
-	rft := reflect.ValueOf(entity).Elem().Type()
-	log.Info("register %v", rft)
+// Register1 is Register with the codec to write the entity values, values
+// are read with whichever codec wrote them.
+func Register1(entity EntityI, codec Codec) error {
+	rfv := reflect.ValueOf(entity)
+	if rfv.Kind() != reflect.Ptr || rfv.Elem().Kind() != reflect.Struct {
+		return &SchemaError{Type: rfv.Type(), Problems: []string{"not a pointer to struct"}}
+	}
+
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+
+	s, problems := mkSchema(rfv.Elem().Type(), codec)
+	if len(problems) > 0 {
+		return &SchemaError{Type: s.rft, Problems: problems}
+	}
+
+	log.Info("register %v with codec 0x%02x", s.rft, codec.Id())
+	schemas[s.rft] = s
+	return nil
+}
+
+func mkSchema(rft reflect.Type, codec Codec) (*schema, []string) {
+	var problems []string
 
-	if _, ok := entityIndex[rft]; !ok {
-		entityIndex[rft] = make(map[string][]int)
+	s := &schema{
+		rft:    rft,
+		codec:  codec,
+		tables: make(map[string]api.Table),
+		keys:   make(map[string][]keyField),
 	}
+	seen := make(map[string]bool)
 
 	for i := 0; i < rft.NumField(); i += 1 {
-		if table, ok := rft.Field(i).Tag.Lookup("primary"); ok {
-			entityIndex[rft][table] = append(entityIndex[rft][table], i)
+		f := rft.Field(i)
+		primary, isPrimary := f.Tag.Lookup("primary")
+		index, isIndex := f.Tag.Lookup("index")
+
+		if isPrimary {
+			if s.primary != "" && s.primary != primary {
+				problems = append(problems,
+					fmt.Sprintf("field %s: primary %q differs from %q", f.Name, primary, s.primary))
+			} else {
+				s.primary = primary
+			}
+			s.keys[primary] = append(s.keys[primary], keyField{i, keyPutter(f.Type)})
+		}
 
-			if existing, ok := entityTable[rft]; ok && existing != table {
-				log.Fatal("inconsistent primary index on %v", entity)
+		if isIndex {
+			if !seen[index] {
+				s.indexes, seen[index] = append(s.indexes, index), true
 			}
-			entityTable[rft] = table
+			s.keys[index] = append(s.keys[index], keyField{i, keyPutter(f.Type)})
 		}
 
-		if table, ok := rft.Field(i).Tag.Lookup("index"); ok {
-			entityIndex[rft][table] = append(entityIndex[rft][table], i)
+		if !isPrimary && !isIndex {
+			continue
+		}
+		if !f.IsExported() {
+			problems = append(problems, fmt.Sprintf("field %s: key field not exported", f.Name))
+		} else if put := keyPutter(f.Type); put == nil {
+			problems = append(problems,
+				fmt.Sprintf("field %s: %v can't be part of a key", f.Name, f.Type))
+		}
+	}
+
+	if s.primary == "" {
+		problems = append(problems, "no primary field")
+	}
+	for _, index := range s.indexes {
+		if index == s.primary {
+			problems = append(problems, fmt.Sprintf("index %q is also primary", index))
 		}
 	}
+	sort.Strings(s.indexes)
+
+	// resolve tables and look for the ones claimed twice
+	owner := make(map[api.Table]string)
+	for tag := range s.keys {
+		table, err := lookupTable(tag)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if existing, ok := owner[table]; ok {
+			problems = append(problems,
+				fmt.Sprintf("indexes %q and %q share table %d", existing, tag, table))
+		}
+		owner[table] = tag
+		s.tables[tag] = table
+
+		for rft0, s0 := range schemas {
+			for tag0, table0 := range s0.tables {
+				if table0 == table && rft0 != rft {
+					problems = append(problems,
+						fmt.Sprintf("table %d of %q taken by %v %q", table, tag, rft0, tag0))
+				}
+			}
+		}
+	}
+
+	if codec == nil {
+		problems = append(problems, "no codec")
+	} else if known, ok := codecOf(codec.Id()); !ok || !sameCodec(known, codec) {
+		problems = append(problems, fmt.Sprintf("codec 0x%02x not registered", codec.Id()))
+	} else if _, ok := reflect.New(rft).Interface().(ProtoMessage); sameCodec(codec, ProtoCodec) && !ok {
+		problems = append(problems, "proto codec on a non proto message")
+	}
+
+	// generated key code must agree with the tags, at least on zero values
+	if kc, ok := reflect.New(rft).Interface().(KeyCoder); ok && len(problems) == 0 {
+		zero := reflect.New(rft).Elem()
+
+		kk := kc.RubiksPrimaryKK()
+		if kk.Table != s.tables[s.primary] || !bytes.Equal(kk.Key, s.key(zero, s.primary)) {
+			problems = append(problems, "generated primary key out of date")
+		}
+
+		for _, index := range s.indexes {
+			kk := kc.RubiksSecondaryKK(index, nil)
+			if kk.Table != s.tables[index] || !bytes.Equal(kk.Key, s.key(zero, index)) {
+				problems = append(problems, fmt.Sprintf("generated index %q out of date", index))
+			}
+		}
+	}
+	return s, problems
+}
+
+func (s *schema) isIndex(index string) bool {
+	i := sort.SearchStrings(s.indexes, index)
+	return i < len(s.indexes) && s.indexes[i] == index
+}
+
+func (s *schema) key(rfv reflect.Value, index string) []byte {
+	return s.keyPrefix(rfv, index, len(s.keys[index]))
 }
 
-func encodeRfvForKey(rfv reflect.Value) ([]byte, bool) {
-	var result []byte
+// keyPrefix is the key of the first n fields of index
+func (s *schema) keyPrefix(rfv reflect.Value, index string, n int) []byte {
+	key := []byte{}
 
-	switch v := rfv.Interface().(type) {
-	case uint64:
-		return serd.Append64BE(result, v), true
-	case string:
-		return append(result, []byte(v)...), true
-	case time.Time:
-		return serd.Append64BE(result, uint64(v.Second())), true
+	for _, kf := range s.keys[index][:n] {
+		key = kf.put(key, rfv.Field(kf.i))
 	}
-	return nil, false
+	return key
+}
+
+// schemaOf is the schema of an entity type registered already, it panics
+// on a type not registered, see Register.
+func schemaOf(entity EntityI) *schema {
+	s, ok := lookupSchema(reflect.ValueOf(entity).Elem().Type())
+	misc.Assert(ok)	// not registered
+	return s
+}
+
+func lookupSchema(rft reflect.Type) (*schema, bool) {
+	schemaMtx.RLock()
+	defer schemaMtx.RUnlock()
+
+	s, ok := schemas[rft]
+	return s, ok
+}
+
+func keyPutter(rft reflect.Type) func(dst []byte, rfv reflect.Value) []byte {
+	switch rft {
+	case reflect.TypeOf(uint64(0)):
+		return func(dst []byte, rfv reflect.Value) []byte {
+			return serd.Append64BE(dst, rfv.Uint())
+		}
+	case reflect.TypeOf(""):
+		return func(dst []byte, rfv reflect.Value) []byte {
+			return append(dst, rfv.String()...)
+		}
+	case reflect.TypeOf(time.Time{}):
+		return func(dst []byte, rfv reflect.Value) []byte {
+			return serd.Append64BE(dst, uint64(rfv.Interface().(time.Time).Second()))
+		}
+	}
+	return nil
 }
 
 func getEntityTable(entity EntityI) api.Table {
-	rft := reflect.ValueOf(entity).Elem().Type()
+	s := schemaOf(entity)
+	return s.tables[s.primary]
+}
 
-	str, ok := entityTable[rft]
-	misc.Assert(ok)
+// KeyCoder is implemented by the output of rubiks-orm-gen, the ORM takes
+// it over walking the entity by reflection.
+type KeyCoder interface {
+	RubiksPrimaryKK() api.RubiksKK
 
-	table, err := strconv.ParseUint(str, 10, 64)
-	misc.AssertNilError(err)
+	RubiksSecondaryKK(index string, pk *api.RubiksKK) api.RubiksKK
+}
 
-	return api.Table(table)
+// PKDecoder is implemented by the output of rubiks-orm-gen where the
+// primary key can be decoded, entities listed by index get their primary
+// fields from the key, so values may leave them out.
+type PKDecoder interface {
+	RubiksDecodePK(key []byte) error
 }
 
 func primaryIndex(entity EntityI) api.RubiksKK {
-	var key []byte
+	if kc, ok := entity.(KeyCoder); ok {
+		return kc.RubiksPrimaryKK()
+	}
+	return reflectPrimaryIndex(entity)
+}
 
-	rfv := reflect.ValueOf(entity).Elem()
-	rft := rfv.Type()
+func reflectPrimaryIndex(entity EntityI) api.RubiksKK {
+	s := schemaOf(entity)
 
-	for _, i := range entityIndex[rft][entityTable[rft]] {
-		key1, ok1 := encodeRfvForKey(rfv.Field(i))
-		misc.Assert(ok1)
-		key = append(key, key1...)
-	}
+	key := s.key(reflect.ValueOf(entity).Elem(), s.primary)
 	misc.Assert(len(key) > 0)
 
 	return api.RubiksKK{
-		Table: getEntityTable(entity),
+		Table: s.tables[s.primary],
 		Key:   key,
 	}
 }
 
+// secondaryKK builds the index entry of pk, or the cursor to list the
+// index from if pk is nil.
 func secondaryKK(entity EntityI, index string, pk *api.RubiksKK) api.RubiksKK {
-	var key []byte
+	if kc, ok := entity.(KeyCoder); ok {
+		return kc.RubiksSecondaryKK(index, pk)
+	}
+	return reflectSecondaryKK(entity, index, pk)
+}
 
-	rfv := reflect.ValueOf(entity).Elem()
-	rft := rfv.Type()
+func reflectSecondaryKK(entity EntityI, index string, pk *api.RubiksKK) api.RubiksKK {
+	s := schemaOf(entity)
 
-	for _, i := range entityIndex[rft][index] {
-		key1, ok1 := encodeRfvForKey(rfv.Field(i))
-		misc.Assert(ok1)
-		key = append(key, key1...)
-	}
-	misc.Assert(len(key) > 0)
+	table, ok := s.tables[index]
+	misc.Assert(ok && index != s.primary)
 
-	table0, err := strconv.ParseUint(index, 10, 64)
-	misc.AssertNilError(err)
+	key := s.key(reflect.ValueOf(entity).Elem(), index)
 
 	if pk != nil {
-		pk := primaryIndex(entity)
 		key = append(key, pk.Key...)
 		key = serd.Append24BE(key, len(pk.Key))
 	}
 
 	return api.RubiksKK{
-		Table: api.Table(table0),
+		Table: table,
 		Key:   key,
 	}
 }
 
 func pkInIndex(kk api.RubiksKK) ([]byte, error) {
 	key := kk.Key
+	if len(key) < 3 {
+		return nil, api.EIO
+	}
 
 	subsz, _, err := serd.Get64BE(3, key[len(key)-3:])
 	if err != nil {
 		return nil, err
+	} else if int(subsz) > len(key) - 3 {
+		return nil, api.EIO
 	}
 	return key[len(key) - 3 - int(subsz):len(key)-3], err
 }
 
 func secondaryKKs(entity EntityI, pk *api.RubiksKK) []api.RubiksKK {
-	rfv := reflect.ValueOf(entity).Elem()
 	var result []api.RubiksKK
 
-	for index, _ := range entityIndex[rfv.Type()] {
-		if index != entityTable[rfv.Type()] {
-			result = append(result, secondaryKK(entity, index, pk))
-		}
+	for _, index := range schemaOf(entity).indexes {
+		result = append(result, secondaryKK(entity, index, pk))
 	}
 	return result
 }
 
 func secondaryVVs(entity EntityI) []api.RubiksVV {
-	rfv := reflect.ValueOf(entity).Elem()
+	return secondaryVVs1(entity, entity.GetPresent())
+}
+
+func secondaryVVs1(entity EntityI, present bool) []api.RubiksVV {
 	var result []api.RubiksVV
 
-	for index, _ := range entityIndex[rfv.Type()] {
-		if index != entityTable[rfv.Type()] {
-			result = append(result, api.RubiksVV{
-				Present: entity.GetPresent(),
-				Seqnum:  api.SeqnumInf,	// don't check index seqnum
-				Val:     nil,
-			})
-		}
+	for range schemaOf(entity).indexes {
+		result = append(result, api.RubiksVV{
+			Present: present,
+			Seqnum:  api.SeqnumInf,	// don't check index seqnum
+			Val:     nil,
+		})
 	}
 	return result
 }
 
 func commitEntity(entity EntityI) (api.RubiksVV, error) {
-	if entity.GetPresent() {
-		val, err := json.Marshal(entity)
+	return commitEntity1(entity, entity.GetPresent(), entity.GetSeqnum())
+}
+
+func commitEntity1(entity EntityI, present bool, seqnum api.Seqnum) (api.RubiksVV, error) {
+	if present {
+		val, err := encodeValue(schemaOf(entity).codec, entity)
 		if err != nil {
 			return api.RubiksVV{}, err
 		}
 		return api.RubiksVV{
 			Present: true,
-			Seqnum:  entity.GetSeqnum(),
+			Seqnum:  seqnum,
 			Val:     val,
 		}, nil
 	} else {
 		return api.RubiksVV{
 			Present: false,
-			Seqnum:  entity.GetSeqnum(),
+			Seqnum:  seqnum,
 			Val:     nil,
 		}, nil
 	}
@@ -179,12 +367,16 @@ func confirmEntity(entity EntityI) (api.RubiksVV, error) {
 
 func decode(entity EntityI, vv api.RubiksVV) error {
 	if vv.Present {
-		err := json.Unmarshal(vv.Val, entity)
+		err := decodeValue(vv.Val, entity)
 		if err != nil {
 			return err
 		}
 	}
 	entity.SetPresent(vv.Present)
 	entity.SetSeqnum(vv.Seqnum)
+
+	if vv.Present {
+		return afterLoad(entity)
+	}
 	return nil
 }
\ No newline at end of file
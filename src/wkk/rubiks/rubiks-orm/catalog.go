@@ -0,0 +1,52 @@
+package rubiks_orm
+
+import (
+	"fmt"
+	"strconv"
+	"wkk/rubiks/api"
+)
+
+// the optional table catalog, `primary:"users"` instead of `primary:"100"`
+var catalog = make(map[string]api.Table)
+
+// DefineTable names a table for use in entity tags, define all names
+// before registering the entities referring to them.
+func DefineTable(name string, table api.Table) error {
+	schemaMtx.Lock()
+	defer schemaMtx.Unlock()
+
+	if _, err := strconv.ParseUint(name, 10, 64); err == nil {
+		return fmt.Errorf("table name %q is numeric", name)
+	}
+
+	for name0, table0 := range catalog {
+		if name0 == name && table0 != table {
+			return fmt.Errorf("table %q already defined as %d", name, table0)
+		}
+		if name0 != name && table0 == table {
+			return fmt.Errorf("table %d already named %q", table, name0)
+		}
+	}
+	catalog[name] = table
+	return nil
+}
+
+// LookupTable resolves an index tag, either a table number or a name
+// given to DefineTable.
+func LookupTable(tag string) (api.Table, error) {
+	schemaMtx.RLock()
+	defer schemaMtx.RUnlock()
+
+	return lookupTable(tag)
+}
+
+func lookupTable(tag string) (api.Table, error) {
+	if table, err := strconv.ParseUint(tag, 10, 64); err == nil {
+		return api.Table(table), nil
+	}
+
+	if table, ok := catalog[tag]; ok {
+		return table, nil
+	}
+	return 0, fmt.Errorf("table %q neither numeric nor defined", tag)
+}
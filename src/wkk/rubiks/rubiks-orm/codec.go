@@ -0,0 +1,220 @@
+package rubiks_orm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Codec turns an entity into the value stored under its primary key. The
+// stored value leads with the codec Id so entities written by different
+// codecs can be read back side by side, e.g. while migrating a table.
+type Codec interface {
+	Id() byte
+
+	Marshal(entity EntityI) ([]byte, error)
+
+	Unmarshal(src []byte, entity EntityI) error
+}
+
+const (
+	CodecIdJSON   = byte(0x01)
+	CodecIdBinary = byte(0x02)
+	CodecIdGob    = byte(0x03)
+	CodecIdProto  = byte(0x04)
+
+	// values written before codecs carry bare json
+	codecIdLegacy = byte('{')
+)
+
+var (
+	JSONCodec   Codec = jsonCodec{}
+	BinaryCodec Codec = binaryCodec{}
+	GobCodec    Codec = gobCodec{}
+	ProtoCodec  Codec = protoCodec{}
+)
+
+// codecs by Id, RegisterCodec may run while values are decoded
+var codecsMtx sync.RWMutex
+var codecs = map[byte]Codec{
+	CodecIdJSON:   JSONCodec,
+	CodecIdBinary: BinaryCodec,
+	CodecIdGob:    GobCodec,
+	CodecIdProto:  ProtoCodec,
+}
+
+// RegisterCodec makes a custom codec known for reading, call it before
+// Register1 of any entity using it.
+func RegisterCodec(codec Codec) error {
+	id := codec.Id()
+
+	if id == codecIdLegacy {
+		return fmt.Errorf("codec id 0x%02x is reserved", id)
+	}
+	codecsMtx.Lock()
+	defer codecsMtx.Unlock()
+
+	if existing, ok := codecs[id]; ok && !sameCodec(existing, codec) {
+		return fmt.Errorf("codec id 0x%02x already taken", id)
+	}
+	codecs[id] = codec
+	return nil
+}
+
+// sameCodec compares types, codecs holding maps or slices can't be ==
+func sameCodec(c0, c1 Codec) bool {
+	return reflect.TypeOf(c0) == reflect.TypeOf(c1)
+}
+
+func codecOf(id byte) (Codec, bool) {
+	codecsMtx.RLock()
+	defer codecsMtx.RUnlock()
+
+	codec, ok := codecs[id]
+	return codec, ok
+}
+
+func encodeValue(codec Codec, entity EntityI) ([]byte, error) {
+	val, err := codec.Marshal(entity)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Id()}, val...), nil
+}
+
+func decodeValue(src []byte, entity EntityI) error {
+	if len(src) == 0 {
+		return errors.New("empty value")
+	}
+
+	if src[0] == codecIdLegacy {
+		return json.Unmarshal(src, entity)
+	}
+
+	codec, ok := codecOf(src[0])
+	if !ok {
+		return fmt.Errorf("unknown codec 0x%02x", src[0])
+	}
+	return codec.Unmarshal(src[1:], entity)
+}
+
+/****** json ******/
+type jsonCodec struct{}
+
+func (jsonCodec) Id() byte {
+	return CodecIdJSON
+}
+
+func (jsonCodec) Marshal(entity EntityI) ([]byte, error) {
+	return json.Marshal(entity)
+}
+
+func (jsonCodec) Unmarshal(src []byte, entity EntityI) error {
+	return json.Unmarshal(src, entity)
+}
+
+/****** gob ******/
+
+// gob refuses EntityBase for lack of exported fields, so entities travel
+// as a shadow struct holding their exported fields only.
+type gobCodec struct{}
+
+var gobShadows sync.Map	// reflect.Type -> *gobShadow
+
+type gobShadow struct {
+	rft    reflect.Type
+	fields []int
+}
+
+func shadowOf(rft reflect.Type) *gobShadow {
+	if shadow, ok := gobShadows.Load(rft); ok {
+		return shadow.(*gobShadow)
+	}
+
+	var fields []reflect.StructField
+	shadow := &gobShadow{}
+
+	for i := 0; i < rft.NumField(); i += 1 {
+		f := rft.Field(i)
+		if !f.IsExported() || f.Type == reflect.TypeOf(EntityBase{}) {
+			continue
+		}
+		fields = append(fields, reflect.StructField{Name: f.Name, Type: f.Type})
+		shadow.fields = append(shadow.fields, i)
+	}
+	shadow.rft = reflect.StructOf(fields)
+
+	gobShadows.Store(rft, shadow)
+	return shadow
+}
+
+func (gobCodec) Id() byte {
+	return CodecIdGob
+}
+
+func (gobCodec) Marshal(entity EntityI) ([]byte, error) {
+	var buf bytes.Buffer
+
+	rfv := reflect.ValueOf(entity).Elem()
+	shadow := shadowOf(rfv.Type())
+	tmp := reflect.New(shadow.rft).Elem()
+
+	for j, i := range shadow.fields {
+		tmp.Field(j).Set(rfv.Field(i))
+	}
+
+	if err := gob.NewEncoder(&buf).EncodeValue(tmp); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(src []byte, entity EntityI) error {
+	rfv := reflect.ValueOf(entity).Elem()
+	shadow := shadowOf(rfv.Type())
+	tmp := reflect.New(shadow.rft)
+
+	if err := gob.NewDecoder(bytes.NewReader(src)).DecodeValue(tmp); err != nil {
+		return err
+	}
+
+	for j, i := range shadow.fields {
+		rfv.Field(i).Set(tmp.Elem().Field(j))
+	}
+	return nil
+}
+
+/****** protobuf ******/
+
+// ProtoMessage is met by gogo/protobuf style generated messages, entities
+// using ProtoCodec embed EntityBase next to such a message.
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(src []byte) error
+}
+
+type protoCodec struct{}
+
+func (protoCodec) Id() byte {
+	return CodecIdProto
+}
+
+func (protoCodec) Marshal(entity EntityI) ([]byte, error) {
+	msg, ok := entity.(ProtoMessage)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto message", entity)
+	}
+	return msg.Marshal()
+}
+
+func (protoCodec) Unmarshal(src []byte, entity EntityI) error {
+	msg, ok := entity.(ProtoMessage)
+	if !ok {
+		return fmt.Errorf("%T is not a proto message", entity)
+	}
+	return msg.Unmarshal(src)
+}
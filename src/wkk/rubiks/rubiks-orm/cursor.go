@@ -0,0 +1,140 @@
+package rubiks_orm
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"time"
+	"wkk/common/misc"
+	"wkk/rubiks/api"
+	"wkk/rubiks/client"
+)
+
+// Cursor walks the entities of one secondary index, see RubiksOrm.ListBy.
+// It is driven by the caller and runs no goroutine, so it can be dropped
+// at any point; Close just makes further Next calls return false.
+type Cursor struct {
+	ctx    context.Context
+	orm    *rubiksOrm
+	rft    reflect.Type
+	table  api.Table	// primary table
+	cursor api.RubiksKK
+	prefix []byte		// of the index keys walked, nil for all past cursor
+
+	batch  []EntityI
+	entity EntityI
+	err    error
+	done   bool
+}
+
+func (c *Cursor) Next() bool {
+	c.entity = nil
+
+	if err := c.ctx.Err(); err != nil && c.err == nil {
+		c.err, c.batch = err, nil
+	}
+
+	for len(c.batch) == 0 {
+		if c.done || c.err != nil {
+			return false
+		}
+		c.fetch()
+	}
+
+	c.entity, c.batch = c.batch[0], c.batch[1:]
+	return true
+}
+
+func (c *Cursor) Entity() EntityI {
+	return c.entity
+}
+
+// Err returns the terminal error, nil if the index was walked to its end.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+func (c *Cursor) Close() error {
+	c.batch, c.entity, c.done = nil, nil, true
+	return nil
+}
+
+func (c *Cursor) fetch() {
+	var primaryKKs []api.RubiksKK
+
+	rbr, rbr2 := client.AcquireRubiksR(), client.AcquireRubiksR()
+	defer client.ReleaseRubiksR(rbr)
+	defer client.ReleaseRubiksR(rbr2)
+
+	kks, _, err := c.orm.rubiks.RPCIterate(rbr,
+		ctxDeadline(c.ctx), c.cursor, api.MaxNPairs, 0 /*!hint*/)
+	if err == api.NONEXT {
+		c.done = true
+		return
+	}
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	// the walk ends past the prefix, or the index table
+	for i, kk := range kks {
+		if c.prefix != nil && (kk.Table != c.cursor.Table || !bytes.HasPrefix(kk.Key, c.prefix)) {
+			kks, c.done = kks[:i], true
+			break
+		}
+	}
+
+	// convert index to primary key
+	for _, kk := range kks {
+		pk, err := pkInIndex(kk)
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		primaryKKs = append(primaryKKs, api.RubiksKK{
+			Table: c.table,
+			Key:   pk,
+		})
+	}
+
+	if len(primaryKKs) == 0 {
+		c.done = true
+		return
+	}
+
+	// kks point into rbr which is poisoned on the next request
+	last := kks[len(kks) - 1]
+	c.cursor = api.RubiksKK{Table: last.Table, Key: append([]byte{}, last.Key...)}
+
+	vvs, err := c.orm.rubiks.RPCGet(rbr2, ctxDeadline(c.ctx), primaryKKs)
+	if err != nil {
+		c.err = err
+		return
+	}
+
+	for i, vv := range vvs {
+		if vv.Present { // may deleted after RPCIterate
+			entity := reflect.New(c.rft).Interface().(EntityI)
+			if pd, ok := entity.(PKDecoder); ok {
+				if err := pd.RubiksDecodePK(primaryKKs[i].Key); err != nil {
+					c.err = err
+					return
+				}
+			}
+			if err := decode(entity, vv); err != nil {
+				c.err = err
+				return
+			}
+			c.batch = append(c.batch, entity)
+		}
+	}
+}
+
+func ctxDeadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return misc.Bound(deadline(), d)
+	}
+	return deadline()
+}
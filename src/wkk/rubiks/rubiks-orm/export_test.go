@@ -0,0 +1,6 @@
+package rubiks_orm
+
+var (
+    ReflectPrimaryIndex = reflectPrimaryIndex
+    ReflectSecondaryKK  = reflectSecondaryKK
+)
@@ -0,0 +1,119 @@
+// Code generated by rubiks-orm-gen. DO NOT EDIT.
+
+package rubiks_orm_test
+
+import (
+	"context"
+	"time"
+	"wkk/common/serd"
+	"wkk/rubiks/api"
+	"wkk/rubiks/rubiks-orm"
+)
+
+const (
+	GenUserTable             = api.Table(200)
+	GenUserByEmailTable      = api.Table(201) // index "201"
+	GenUserByStreetTownTable = api.Table(202) // index "202"
+	GenUserByBirthTable      = api.Table(203) // index "203"
+)
+
+var _ rubiks_orm.KeyCoder = (*GenUser)(nil)
+
+func (e *GenUser) RubiksPrimaryKK() api.RubiksKK {
+	var key []byte
+	key = serd.Append64BE(key, e.Id)
+	return api.RubiksKK{Table: GenUserTable, Key: key}
+}
+
+func (e *GenUser) RubiksSecondaryKK(index string, pk *api.RubiksKK) api.RubiksKK {
+	var key []byte
+	var table api.Table
+
+	switch index {
+	case "201":
+		table = GenUserByEmailTable
+		key = append(key, e.Email...)
+	case "202":
+		table = GenUserByStreetTownTable
+		key = append(key, e.Street...)
+		key = append(key, e.Town...)
+	case "203":
+		table = GenUserByBirthTable
+		key = serd.Append64BE(key, uint64(e.Birth.Second()))
+	default:
+		return api.RubiksKK{}
+	}
+
+	if pk != nil {
+		key = append(key, pk.Key...)
+		key = serd.Append24BE(key, len(pk.Key))
+	}
+	return api.RubiksKK{Table: table, Key: key}
+}
+
+var _ rubiks_orm.PKDecoder = (*GenUser)(nil)
+
+// RubiksDecodePK fills the primary fields from a primary key.
+func (e *GenUser) RubiksDecodePK(key []byte) error {
+	if len(key) < 8 {
+		return api.EIO
+	}
+	e.Id, key, _ = serd.Get64BE(8, key)
+	if len(key) != 0 {
+		return api.EIO
+	}
+	return nil
+}
+
+func ListGenUserByEmail(ctx context.Context, orm rubiks_orm.RubiksOrm, email string) *rubiks_orm.Cursor {
+	probe := &GenUser{Email: email}
+	return orm.ListBy(ctx, probe, "201")
+}
+
+func ListGenUserByStreetTown(ctx context.Context, orm rubiks_orm.RubiksOrm, street string, town string) *rubiks_orm.Cursor {
+	probe := &GenUser{Street: street, Town: town}
+	return orm.ListBy(ctx, probe, "202")
+}
+
+func ListGenUserByBirth(ctx context.Context, orm rubiks_orm.RubiksOrm, birth time.Time) *rubiks_orm.Cursor {
+	probe := &GenUser{Birth: birth}
+	return orm.ListBy(ctx, probe, "203")
+}
+
+const (
+	GenEventTable       = api.Table(210)
+	GenEventByWhenTable = api.Table(211) // index "211"
+)
+
+var _ rubiks_orm.KeyCoder = (*GenEvent)(nil)
+
+func (e *GenEvent) RubiksPrimaryKK() api.RubiksKK {
+	var key []byte
+	key = append(key, e.Kind...)
+	key = serd.Append64BE(key, e.Seq)
+	return api.RubiksKK{Table: GenEventTable, Key: key}
+}
+
+func (e *GenEvent) RubiksSecondaryKK(index string, pk *api.RubiksKK) api.RubiksKK {
+	var key []byte
+	var table api.Table
+
+	switch index {
+	case "211":
+		table = GenEventByWhenTable
+		key = serd.Append64BE(key, uint64(e.When.Second()))
+	default:
+		return api.RubiksKK{}
+	}
+
+	if pk != nil {
+		key = append(key, pk.Key...)
+		key = serd.Append24BE(key, len(pk.Key))
+	}
+	return api.RubiksKK{Table: table, Key: key}
+}
+
+func ListGenEventByWhen(ctx context.Context, orm rubiks_orm.RubiksOrm, when time.Time) *rubiks_orm.Cursor {
+	probe := &GenEvent{When: when}
+	return orm.ListBy(ctx, probe, "211")
+}
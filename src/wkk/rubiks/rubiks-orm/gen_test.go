@@ -0,0 +1,104 @@
+package rubiks_orm_test
+
+import (
+    "bytes"
+    "context"
+    "testing"
+    "time"
+    "wkk/common/misc"
+    "wkk/rubiks/api"
+    "wkk/rubiks/rubiks-fake"
+    "wkk/rubiks/rubiks-orm"
+)
+
+//go:generate rubiks-orm-gen -type GenUser,GenEvent -tables events=210
+
+type GenUser struct {
+    rubiks_orm.EntityBase
+
+    Id     uint64 `primary:"200" json:"-"`	// from the key, see RubiksDecodePK
+    Email  string `index:"201"`
+
+    Street string `index:"202"`
+    Town   string `index:"202"`
+
+    Birth  time.Time `index:"203"`
+}
+
+type GenEvent struct {
+    rubiks_orm.EntityBase
+
+    Kind  string    `primary:"events"`
+    Seq   uint64    `primary:"events"`
+    When  time.Time `index:"211"`
+}
+
+func TestGen0(t *testing.T)  {
+    misc.AssertNilError(rubiks_orm.DefineTable("events", 210))
+    misc.AssertNilError(rubiks_orm.Register(&GenUser{}))
+    misc.AssertNilError(rubiks_orm.Register(&GenEvent{}))
+
+    users := []GenUser{
+        {},
+        {Id: 1, Email: "foo@gmail.com", Street: "111 WindsorRidge Dr", Town: "Westboro"},
+        {Id: ^uint64(0), Birth: time.Unix(1600000017, 0)},
+    }
+
+    for i := range users {
+        user := &users[i]
+        pk := rubiks_orm.ReflectPrimaryIndex(user)
+        misc.Assert(sameKK(pk, user.RubiksPrimaryKK()))
+
+        for _, index := range []string{"201", "202", "203"} {
+            misc.Assert(sameKK(rubiks_orm.ReflectSecondaryKK(user, index, nil),
+                user.RubiksSecondaryKK(index, nil)))
+            misc.Assert(sameKK(rubiks_orm.ReflectSecondaryKK(user, index, &pk),
+                user.RubiksSecondaryKK(index, &pk)))
+        }
+
+        decoded := GenUser{}
+        misc.AssertNilError(decoded.RubiksDecodePK(pk.Key))
+        misc.Assert(decoded.Id == user.Id)
+    }
+
+    event := &GenEvent{Kind: "login", Seq: 7, When: time.Unix(1600000017, 0)}
+    pk := rubiks_orm.ReflectPrimaryIndex(event)
+    misc.Assert(sameKK(pk, event.RubiksPrimaryKK()) && pk.Table == GenEventTable)
+    misc.Assert(sameKK(rubiks_orm.ReflectSecondaryKK(event, "211", &pk),
+        event.RubiksSecondaryKK("211", &pk)))
+
+    misc.Assert(GenUserByStreetTownTable == 202)
+
+    // the helpers list by index, Id is filled from the key
+    ctx := context.Background()
+    orm := rubiks_orm.NewRubiksOrm(rubiks_fake.New())
+    for _, user := range []*GenUser{&users[1],
+        {Id: 2, Email: "zoo@gmail.com", Street: "111 WindsorRidge Dr", Town: "Westboro"},
+        {Id: 3, Email: "bar@gmail.com", Street: "1 Main St", Town: "Acton", Birth: time.Unix(1600000017, 0)}} {
+        misc.AssertNilError(orm.Insert(user))
+    }
+
+    var ids []uint64
+    c := ListGenUserByEmail(ctx, orm, "foo@gmail.com")
+    for c.Next() {
+        ids = append(ids, c.Entity().(*GenUser).Id)
+    }
+    misc.Assert(c.Err() == nil && len(ids) == 2 && ids[0] == 1 && ids[1] == 2)
+
+    ids = nil
+    c = ListGenUserByStreetTown(ctx, orm, "111 WindsorRidge Dr", "Westboro")
+    for c.Next() {
+        user := c.Entity().(*GenUser)
+        misc.Assert(user.Town == "Westboro")
+        ids = append(ids, user.Id)
+    }
+    misc.Assert(c.Err() == nil && len(ids) == 2 && ids[0] == 1 && ids[1] == 2)
+
+    c = ListGenUserByBirth(ctx, orm, time.Unix(1600000017, 0))
+    misc.Assert(c.Next() && c.Entity().(*GenUser).Id == 3)
+    misc.Assert(!c.Next() && c.Err() == nil)
+}
+
+func sameKK(kk0, kk1 api.RubiksKK) bool {
+    return kk0.Table == kk1.Table && bytes.Equal(kk0.Key, kk1.Key)
+}
@@ -0,0 +1,64 @@
+package rubiks_orm
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Optional hooks of an entity. BeforeCommit runs ahead of Validate on
+// every write that keeps the entity present, before its keys are taken,
+// so it may normalize index fields. BeforeDelete runs on a write that
+// removes the entity instead. AfterLoad runs on every present entity
+// decoded, by Get, ListBy and the like. An error of any aborts the
+// operation.
+type BeforeCommitter interface {
+	BeforeCommit() error
+}
+
+type Validator interface {
+	Validate() error
+}
+
+type BeforeDeleter interface {
+	BeforeDelete() error
+}
+
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+func beforeWrite(entity EntityI, present bool) error {
+	if !present {
+		if h, ok := entity.(BeforeDeleter); ok {
+			if err := h.BeforeDelete(); err != nil {
+				return hookError(entity, "BeforeDelete", err)
+			}
+		}
+		return nil
+	}
+
+	if h, ok := entity.(BeforeCommitter); ok {
+		if err := h.BeforeCommit(); err != nil {
+			return hookError(entity, "BeforeCommit", err)
+		}
+	}
+	if h, ok := entity.(Validator); ok {
+		if err := h.Validate(); err != nil {
+			return hookError(entity, "Validate", err)
+		}
+	}
+	return nil
+}
+
+func afterLoad(entity EntityI) error {
+	if h, ok := entity.(AfterLoader); ok {
+		if err := h.AfterLoad(); err != nil {
+			return hookError(entity, "AfterLoad", err)
+		}
+	}
+	return nil
+}
+
+func hookError(entity EntityI, hook string, err error) error {
+	return fmt.Errorf("%v %s: %w", reflect.TypeOf(entity).Elem(), hook, err)
+}
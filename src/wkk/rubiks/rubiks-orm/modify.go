@@ -0,0 +1,123 @@
+package rubiks_orm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+	"wkk/rubiks/api"
+)
+
+var FavoredStaleRetry = &StaleRetry{
+	Attempts: 8,
+	Low:      2   * time.Millisecond,
+	High:     128 * time.Millisecond,
+}
+
+// StaleRetry paces Modify attempts, backoff doubles from Low up to High
+// and is jittered by half of itself either way.
+type StaleRetry struct {
+	Attempts int
+	Low      time.Duration
+	High     time.Duration
+}
+
+var errPrimaryChanged = errors.New("modify can't change primary fields")
+
+func (orm *rubiksOrm) Modify(ctx context.Context, entity EntityI, fn func(EntityI) error) error {
+	return orm.retryStale(ctx, func() error {
+		return orm.modify(ctx, entity, fn)
+	})
+}
+
+// retryStale calls fn until it fails other than STALE, paced by staleRetry
+func (orm *rubiksOrm) retryStale(ctx context.Context, fn func() error) error {
+	backoff := orm.staleRetry.Low
+
+	for attempt := 1; ; attempt += 1 {
+		err := fn()
+		if err != api.STALE || attempt >= orm.staleRetry.Attempts {
+			return err
+		}
+
+		jitter := time.Duration(rand.Int63n(int64(backoff) + 1)) - backoff / 2
+		select {
+		case <- time.After(backoff + jitter):
+		case <- ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > orm.staleRetry.High {
+			backoff = orm.staleRetry.High
+		}
+	}
+}
+
+func (orm *rubiksOrm) modify(ctx context.Context, entity EntityI, fn func(EntityI) error) error {
+	// a clean reload, decoding alone may leave fields of the last attempt
+	resetEntity(entity)
+
+	if err := orm.Get1(ctx, entity); err != nil {
+		return err
+	}
+
+	pk, seqnum, present := primaryIndex(entity), entity.GetSeqnum(), entity.GetPresent()
+
+	var before []api.RubiksKK
+	if present {
+		before = secondaryKKs(entity, &pk)
+	}
+
+	if err := fn(entity); err != nil {
+		return err
+	}
+
+	if pk1 := primaryIndex(entity); pk1.Table != pk.Table || !bytes.Equal(pk1.Key, pk.Key) {
+		return errPrimaryChanged
+	}
+
+	st, err := stage(entity, entity.GetPresent(), seqnum)
+	if err != nil {
+		return err
+	}
+
+	// drop index entries of the loaded fields which are gone now
+	st.drop(before)
+
+	if len(st.kks) > api.MaxNPairs || st.size > api.MaxCommitSize {
+		return fmt.Errorf("%v modify takes %d pairs of %d bytes, over %d pairs or %d bytes: %w",
+			reflect.TypeOf(entity).Elem(), len(st.kks), st.size, api.MaxNPairs, api.MaxCommitSize, ErrTooBig)
+	}
+
+	return orm.commitStaged(ctx, []EntityI{entity}, []bool{entity.GetPresent()}, []staged{st})
+}
+
+// resetEntity zeroes everything but the primary fields
+func resetEntity(entity EntityI) {
+	s := schemaOf(entity)
+	rfv := reflect.ValueOf(entity).Elem()
+	saved := make([]reflect.Value, len(s.keys[s.primary]))
+
+	for i, kf := range s.keys[s.primary] {
+		saved[i] = reflect.New(rfv.Field(kf.i).Type()).Elem()
+		saved[i].Set(rfv.Field(kf.i))
+	}
+
+	rfv.Set(reflect.Zero(rfv.Type()))
+
+	for i, kf := range s.keys[s.primary] {
+		rfv.Field(kf.i).Set(saved[i])
+	}
+}
+
+func containsKK(kks []api.RubiksKK, kk api.RubiksKK) bool {
+	for _, kk0 := range kks {
+		if kk0.Table == kk.Table && bytes.Equal(kk0.Key, kk.Key) {
+			return true
+		}
+	}
+	return false
+}
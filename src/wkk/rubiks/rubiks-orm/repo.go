@@ -0,0 +1,138 @@
+package rubiks_orm
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"reflect"
+)
+
+// Repo is RubiksOrm typed to one entity type T, PT is inferred from T:
+//
+//	users, err := rubiks_orm.NewRepo[User](orm)
+//	user, err := users.Get(ctx, uint64(10))
+type Repo[T any, PT interface { *T; EntityI }] struct {
+	orm    RubiksOrm
+	schema *schema
+}
+
+// NewRepo registers T with JSONCodec unless registered already.
+func NewRepo[T any, PT interface { *T; EntityI }](orm RubiksOrm) (*Repo[T, PT], error) {
+	rft := reflect.TypeOf((*T)(nil)).Elem()
+
+	s, ok := lookupSchema(rft)
+	if !ok {
+		if err := Register(PT(new(T))); err != nil {
+			return nil, err
+		}
+		s, _ = lookupSchema(rft)
+	}
+	return &Repo[T, PT]{orm: orm, schema: s}, nil
+}
+
+// Get loads the entity by its primary fields in order, ErrNotFound if
+// it isn't present.
+func (r *Repo[T, PT]) Get(ctx context.Context, id ...interface{}) (*T, error) {
+	entity := PT(new(T))
+
+	if err := r.schema.setKey(reflect.ValueOf(entity).Elem(), r.schema.primary, id, false); err != nil {
+		return nil, err
+	}
+
+	if err := r.orm.Get1(ctx, entity); err != nil {
+		return nil, err
+	}
+	if !entity.GetPresent() {
+		return nil, ErrNotFound
+	}
+	return (*T)(entity), nil
+}
+
+// ListBy walks the entities of the index whose leading index fields are
+// the given ones, trailing index fields may be left out. Key strings are
+// not terminated, a string given last matches longer ones as well. A
+// failure is yielded once, last.
+func (r *Repo[T, PT]) ListBy(ctx context.Context, index string, vals ...interface{}) iter.Seq2[*T, error] {
+	return func(yield func(*T, error) bool) {
+		probe := PT(new(T))
+
+		if err := r.schema.setKey(reflect.ValueOf(probe).Elem(), index, vals, true); err != nil {
+			yield(nil, err)
+			return
+		}
+
+		c := r.orm.ListBy(ctx, probe, index)
+		defer c.Close()
+		if c.err == nil {
+			c.prefix = r.schema.keyPrefix(reflect.ValueOf(probe).Elem(), index, len(vals))
+		}
+
+		for c.Next() {
+			if !yield((*T)(c.Entity().(PT)), nil) {
+				return
+			}
+		}
+		if err := c.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func (r *Repo[T, PT]) Commit(ctx context.Context, entities ...*T) error {
+	return r.orm.Commit1(ctx, r.entities(entities)...)
+}
+
+func (r *Repo[T, PT]) Insert(ctx context.Context, entities ...*T) error {
+	return r.orm.Insert1(ctx, r.entities(entities)...)
+}
+
+func (r *Repo[T, PT]) Update(ctx context.Context, entities ...*T) error {
+	return r.orm.Update1(ctx, r.entities(entities)...)
+}
+
+func (r *Repo[T, PT]) Upsert(ctx context.Context, entities ...*T) error {
+	return r.orm.Upsert1(ctx, r.entities(entities)...)
+}
+
+func (r *Repo[T, PT]) Delete(ctx context.Context, entities ...*T) error {
+	return r.orm.Delete1(ctx, r.entities(entities)...)
+}
+
+func (r *Repo[T, PT]) entities(entities []*T) []EntityI {
+	result := make([]EntityI, len(entities))
+
+	for i, ent := range entities {
+		result[i] = PT(ent)
+	}
+	return result
+}
+
+// setKey fills the key fields of index with vals, any number type goes
+// for a uint64 field.
+func (s *schema) setKey(rfv reflect.Value, index string, vals []interface{}, prefix bool) error {
+	keys, ok := s.keys[index]
+	if !ok {
+		return fmt.Errorf("%v has no index %q", s.rft, index)
+	}
+	if len(vals) > len(keys) || (!prefix && len(vals) != len(keys)) {
+		return fmt.Errorf("%v index %q has %d fields, %d given", s.rft, index, len(keys), len(vals))
+	}
+
+	for i, val := range vals {
+		field := rfv.Field(keys[i].i)
+		v := reflect.ValueOf(val)
+
+		switch {
+		case v.IsValid() && v.Type().AssignableTo(field.Type()):
+			field.Set(v)
+		case v.IsValid() && v.CanInt() && v.Int() >= 0 && field.CanUint():
+			field.SetUint(uint64(v.Int()))
+		case v.IsValid() && v.CanUint() && field.CanUint():
+			field.SetUint(v.Uint())
+		default:
+			return fmt.Errorf("%v index %q field %d: %T given for %v",
+				s.rft, index, i, val, field.Type())
+		}
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package rubiks_orm
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
 	"time"
 	"wkk/rubiks/api"
@@ -40,7 +43,17 @@ func deadline() time.Time {
 	return time.Now().Add(1 * time.Second)
 }
 
-// interface
+var (
+	ErrExists   = errors.New("entity exists")
+	ErrNotFound = errors.New("entity not found")
+	ErrConflict = errors.New("entity changed since loaded")
+
+	// beyond api.MaxNPairs or api.MaxCommitSize in one commit
+	ErrTooBig   = errors.New("commit too big")
+)
+
+// interface, calls without ctx are bound by a second, their 1 variants
+// by ctx and by a second at most
 type RubiksOrm interface {
 	Get(entities ...EntityI) error
 
@@ -48,34 +61,113 @@ type RubiksOrm interface {
 
 	Commit(entities ...EntityI) error
 
-	ListBy(entity EntityI, index string) (chan EntityI, chan error)
+	// Insert fails with ErrExists if any entity is present.
+	Insert(entities ...EntityI) error
+
+	// Update fails with ErrNotFound or ErrConflict unless every entity
+	// is present at its loaded seqnum.
+	Update(entities ...EntityI) error
+
+	// Upsert writes regardless of the stored seqnum.
+	Upsert(entities ...EntityI) error
+
+	// Delete removes the loaded entities along with their index entries,
+	// it fails like Update.
+	Delete(entities ...EntityI) error
+
+	Get1(ctx context.Context, entities ...EntityI) error
+
+	Confirm1(ctx context.Context, entities ...EntityI) error
+
+	Commit1(ctx context.Context, entities ...EntityI) error
+
+	Insert1(ctx context.Context, entities ...EntityI) error
+
+	Update1(ctx context.Context, entities ...EntityI) error
+
+	Upsert1(ctx context.Context, entities ...EntityI) error
+
+	Delete1(ctx context.Context, entities ...EntityI) error
+
+	// CommitBatched is Commit for more entities than fit one commit. It
+	// packs them into as few atomic commits as it can but isn't atomic as
+	// a whole, errs[i] is the outcome of entities[i].
+	CommitBatched(ctx context.Context, entities ...EntityI) (errs []error)
+
+	// Modify reloads entity, applies fn and commits under the loaded
+	// seqnum, all over again on STALE. fn may thus run several times, it
+	// aborts the modify with nothing committed by returning an error.
+	// Index entries fn moves away from are removed.
+	Modify(ctx context.Context, entity EntityI, fn func(EntityI) error) error
+
+	// ListBy walks the index from entity's index fields onwards, the
+	// cursor stops when ctx is done.
+	ListBy(ctx context.Context, entity EntityI, index string) *Cursor
+
+	ForEachBy(ctx context.Context, entity EntityI, index string, fn func(EntityI) error) error
 }
 
 func NewRubiksOrm(rubiks client.Rubiks) RubiksOrm {
+	return NewRubiksOrm1(rubiks, FavoredStaleRetry)
+}
+
+func NewRubiksOrm1(rubiks client.Rubiks, staleRetry *StaleRetry) RubiksOrm {
 	return &rubiksOrm{
-		rbr:    client.NewRubiksR(),
-		rbr2:   client.NewRubiksR(),
-		rubiks: rubiks,
+		rubiks:     client.Pooled(rubiks),
+		staleRetry: staleRetry,
 	}
 }
 
-// implementation
+// implementation, safe for concurrent use as RubiksR are drawn from
+// the client pool on every call
 type rubiksOrm struct {
-	// thread unsafe
-	rbr    *client.RubiksR
-	rbr2   *client.RubiksR	// for iterate and get
-
-	rubiks client.Rubiks
+	rubiks     client.PooledRubiks
+	staleRetry *StaleRetry
 }
 
 func (orm *rubiksOrm) Get(entities...EntityI) error {
+	return orm.Get1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Confirm(entities...EntityI) error {
+	return orm.Confirm1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Commit(entities...EntityI) error {
+	return orm.Commit1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Insert(entities...EntityI) error {
+	return orm.Insert1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Update(entities...EntityI) error {
+	return orm.Update1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Upsert(entities...EntityI) error {
+	return orm.Upsert1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Delete(entities...EntityI) error {
+	return orm.Delete1(context.Background(), entities...)
+}
+
+func (orm *rubiksOrm) Get1(ctx context.Context, entities...EntityI) error {
 	var kks []api.RubiksKK
 
 	for _, ent := range entities {
 		kks = append(kks, primaryIndex(ent))
 	}
 
-	vvs, err := orm.rubiks.RPCGet(orm.rbr, deadline(), kks)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rbr := client.AcquireRubiksR()
+	defer client.ReleaseRubiksR(rbr)
+
+	vvs, err := orm.rubiks.RPCGet(rbr, ctxDeadline(ctx), kks)
 	if err != nil {
 		return err
 	}
@@ -88,7 +180,7 @@ func (orm *rubiksOrm) Get(entities...EntityI) error {
 	return nil
 }
 
-func (orm *rubiksOrm) Confirm(entities...EntityI) error {
+func (orm *rubiksOrm) Confirm1(ctx context.Context, entities...EntityI) error {
 	var kks []api.RubiksKK
 	var vvs []api.RubiksVV
 
@@ -102,111 +194,235 @@ func (orm *rubiksOrm) Confirm(entities...EntityI) error {
 		vvs = append(vvs, vv)
 	}
 
-	return orm.rubiks.RPCConfirm(orm.rbr, deadline(), kks, vvs)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return orm.rubiks.Confirm(ctxDeadline(ctx), kks, vvs)
 }
 
-func (orm *rubiksOrm) Commit(entities...EntityI) error {
-	var kks []api.RubiksKK
-	var vvs []api.RubiksVV
+func (orm *rubiksOrm) Commit1(ctx context.Context, entities...EntityI) error {
+	present, seqnums := make([]bool, len(entities)), make([]api.Seqnum, len(entities))
 
-	// primary kk/vv
-	for _, ent := range entities {
-		kks = append(kks, primaryIndex(ent))
+	for i, ent := range entities {
+		present[i], seqnums[i] = ent.GetPresent(), ent.GetSeqnum()
+	}
+	return orm.write(ctx, entities, present, seqnums, nil)
+}
 
-		vv, err := commitEntity(ent)
-		if err != nil {
-			return err
+func (orm *rubiksOrm) Insert1(ctx context.Context, entities...EntityI) error {
+	present, seqnums := make([]bool, len(entities)), make([]api.Seqnum, len(entities))
+
+	for i, ent := range entities {
+		if ent.GetPresent() {
+			return ErrExists
 		}
-		vvs = append(vvs, vv)
+		// seqnum of a deleted entity if loaded, 0 otherwise
+		present[i], seqnums[i] = true, ent.GetSeqnum()
 	}
 
-	// collect index kk/vv
-	for k, ent := range entities {
-		kks = append(kks, secondaryKKs(ent, &kks[k])...)
-		vvs = append(vvs, secondaryVVs(ent)...)
+	err := orm.write(ctx, entities, present, seqnums, nil)
+	if err != api.STALE {
+		return err
 	}
 
-	vvs, err := orm.rubiks.RPCCommit(orm.rbr, deadline(), kks, vvs)
+	// a deleted key keeps its seqnum, insert at it unless present since
+	olds, err := orm.stored(ctx, entities)
 	if err != nil {
 		return err
 	}
+	for i, old := range olds {
+		if old.GetPresent() {
+			return ErrExists
+		}
+		seqnums[i] = old.GetSeqnum()
+	}
 
-	if len(vvs) != len(kks) {
-		return api.EIO
+	err = orm.write(ctx, entities, present, seqnums, nil)
+	if err == api.STALE {
+		return orm.whyStale(ctx, entities, true)
 	}
+	return err
+}
+
+func (orm *rubiksOrm) Update1(ctx context.Context, entities...EntityI) error {
+	present, seqnums := make([]bool, len(entities)), make([]api.Seqnum, len(entities))
 
 	for i, ent := range entities {
-		ent.SetSeqnum(vvs[i].Seqnum)
+		if !ent.GetPresent() {
+			return ErrNotFound
+		}
+		present[i], seqnums[i] = true, ent.GetSeqnum()
 	}
-	return nil
+
+	// index entries of the stored fields which are gone go too, a stored
+	// version other than the loaded one fails the commit STALE
+	olds, err := orm.stored(ctx, entities)
+	if err != nil {
+		return err
+	}
+
+	err = orm.write(ctx, entities, present, seqnums, olds)
+	if err == api.STALE {
+		return orm.whyStale(ctx, entities, false)
+	}
+	return err
 }
 
-func (orm *rubiksOrm) ListBy(entity EntityI, index string) (chan EntityI, chan error) {
-	rc, ec := make(chan EntityI), make(chan error)
-	cursor := secondaryKK(entity, index, nil /*=!pk*/)
+// Upsert overwrites whatever is stored, at the stored seqnum so that the
+// index entries of the version replaced are the ones removed.
+func (orm *rubiksOrm) Upsert1(ctx context.Context, entities...EntityI) error {
+	return orm.retryStale(ctx, func() error {
+		present, seqnums := make([]bool, len(entities)), make([]api.Seqnum, len(entities))
 
-	go func() {
-		defer close(rc)
-		defer close(ec)
+		olds, err := orm.stored(ctx, entities)
+		if err != nil {
+			return err
+		}
+		for i, old := range olds {
+			present[i], seqnums[i] = true, old.GetSeqnum()
+		}
+		return orm.write(ctx, entities, present, seqnums, olds)
+	})
+}
 
-		primaryTable := getEntityTable(entity)
+func (orm *rubiksOrm) Delete1(ctx context.Context, entities...EntityI) error {
+	present, seqnums := make([]bool, len(entities)), make([]api.Seqnum, len(entities))
 
-		// ptr
-		rft := reflect.ValueOf(entity).Elem().Type()
+	for i, ent := range entities {
+		if !ent.GetPresent() {
+			return ErrNotFound
+		}
+		present[i], seqnums[i] = false, ent.GetSeqnum()
+	}
 
-		for {
-			var primaryKKs []api.RubiksKK
+	// index entries are the ones of the stored fields, which may differ
+	// from the loaded ones changed since
+	olds, err := orm.stored(ctx, entities)
+	if err != nil {
+		return err
+	}
 
-			kks, vvs, err := orm.rubiks.RPCIterate(orm.rbr,
-				deadline(), cursor, api.MaxNPairs, 0 /*!hint*/)
-			if err == api.NONEXT {
-				break
-			}
+	err = orm.write(ctx, entities, present, seqnums, olds)
+	if err == api.STALE {
+		return orm.whyStale(ctx, entities, false)
+	}
+	return err
+}
 
-			if err != nil {
-				ec <- err
-				return
-			}
+// write commits the primary pair of every entity at the given seqnum
+// together with its index pairs, entities are updated only on success.
+// Index entries of olds, if any, not in the ones of entities are removed.
+func (orm *rubiksOrm) write(ctx context.Context, entities []EntityI, present []bool, seqnums []api.Seqnum,
+	olds []EntityI) error {
+	var sts []staged
+	npairs, size := 0, 0
 
-			// convert index to primary key
-			for _, kk := range kks {
-				pk, err := pkInIndex(kk)
-				if err != nil {
-					ec <- err
-					return
-				}
-
-				primaryKKs = append(primaryKKs, api.RubiksKK{
-					Table: primaryTable,
-					Key:   pk,
-				})
-			}
+	for i, ent := range entities {
+		st, err := stage(ent, present[i], seqnums[i])
+		if err != nil {
+			return err
+		}
+		if olds != nil && olds[i].GetPresent() {
+			pk := primaryIndex(ent)
+			st.drop(secondaryKKs(olds[i], &pk))
+		}
+		sts = append(sts, st)
+		npairs, size = npairs + len(st.kks), size + st.size
+	}
 
-			if len(primaryKKs) == 0 {
-				break
-			}
+	if npairs > api.MaxNPairs || size > api.MaxCommitSize {
+		return fmt.Errorf("%d entities take %d pairs of %d bytes, over %d pairs or %d bytes, see CommitBatched: %w",
+			len(entities), npairs, size, api.MaxNPairs, api.MaxCommitSize, ErrTooBig)
+	}
+	return orm.commitStaged(ctx, entities, present, sts)
+}
 
-			vvs, err = orm.rubiks.RPCGet(orm.rbr2, deadline(), primaryKKs)
-			if err != nil {
-				ec <- err
-				return
-			}
+// stored loads the stored version of entities into new ones of their
+// types, hooks are not called on them.
+func (orm *rubiksOrm) stored(ctx context.Context, entities []EntityI) ([]EntityI, error) {
+	var kks []api.RubiksKK
+
+	for _, ent := range entities {
+		kks = append(kks, primaryIndex(ent))
+	}
 
-			for _, vv := range vvs {
-				if vv.Present { // may deleted after RPCIterate
-					entity := reflect.New(rft).Interface().(EntityI)
-					err := decode(entity, vv)
-					if err != nil {
-						ec <- err
-						break
-					}
-					rc <- entity
-				}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	vvs, err := orm.rubiks.Get(ctxDeadline(ctx), kks)
+	if err != nil {
+		return nil, err
+	} else if len(vvs) != len(kks) {
+		return nil, api.EIO
+	}
+
+	olds := make([]EntityI, len(entities))
+	for i, vv := range vvs {
+		olds[i] = reflect.New(reflect.TypeOf(entities[i]).Elem()).Interface().(EntityI)
+
+		if vv.Present {
+			if err := decodeValue(vv.Val, olds[i]); err != nil {
+				return nil, err
 			}
+		}
+		olds[i].SetPresent(vv.Present)
+		olds[i].SetSeqnum(vv.Seqnum)
+	}
+	return olds, nil
+}
 
-			cursor = kks[len(primaryKKs) - 1]
+// whyStale tells ErrExists/ErrNotFound from ErrConflict after a STALE
+// commit by reloading the present bits.
+func (orm *rubiksOrm) whyStale(ctx context.Context, entities []EntityI, insert bool) error {
+	var kks []api.RubiksKK
+
+	for _, ent := range entities {
+		kks = append(kks, primaryIndex(ent))
+	}
+
+	vvs, err := orm.rubiks.Get(ctxDeadline(ctx), kks)
+	if err != nil {
+		return err
+	}
+
+	for _, vv := range vvs {
+		if insert && vv.Present {
+			return ErrExists
 		}
-	}()
+		if !insert && !vv.Present {
+			return ErrNotFound
+		}
+	}
+	return ErrConflict
+}
+
+func (orm *rubiksOrm) ListBy(ctx context.Context, entity EntityI, index string) *Cursor {
+	c := &Cursor{
+		ctx:   ctx,
+		orm:   orm,
+		rft:   reflect.ValueOf(entity).Elem().Type(),
+		table: getEntityTable(entity),
+	}
+
+	if !schemaOf(entity).isIndex(index) {
+		c.err = fmt.Errorf("%v has no index %q", c.rft, index)
+		return c
+	}
+	c.cursor = secondaryKK(entity, index, nil /*=!pk*/)
+	return c
+}
+
+func (orm *rubiksOrm) ForEachBy(ctx context.Context, entity EntityI, index string,
+	fn func(EntityI) error) error {
+
+	c := orm.ListBy(ctx, entity, index)
+	defer c.Close()
 
-	return rc, ec
-}
\ No newline at end of file
+	for c.Next() {
+		if err := fn(c.Entity()); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
@@ -1,9 +1,16 @@
 package rubiks_orm
 
 import (
+    "context"
+    "errors"
+    "strings"
+    "sync"
     "testing"
     "time"
     "wkk/common/misc"
+    "wkk/rubiks/api"
+    "wkk/rubiks/client"
+    "wkk/rubiks/rubiks-fake"
 )
 
 type TestUser struct {
@@ -24,17 +31,18 @@ func Test0(t *testing.T)  {
         Birth:     time.Now(),
     }
 
-    Register(&TestUser{})
+    misc.AssertNilError(Register(&TestUser{}))
 
     kk := primaryIndex(&user0)
     misc.Assert(kk.Table == 100 && len(kk.Key) == 8)
 
-    kk = secondaryKK(&user0, "101", false)
+    kk = secondaryKK(&user0, "101", nil)
     misc.Assert(kk.Table == 101 && len(kk.Key) == 6)
 
-    kk = secondaryKK(&user0, "102", false)
+    kk = secondaryKK(&user0, "102", nil)
     misc.Assert(kk.Table == 102 && len(kk.Key) == 8)
 
+    user0.SetPresent(true)
     vv, err := commitEntity(&user0)
     misc.AssertNilError(err)
 
@@ -47,4 +55,398 @@ func Test0(t *testing.T)  {
     misc.Assert(user0.LastName == user1.LastName)
     misc.Assert(user0.FirstName == user1.FirstName)
     misc.Assert(user0.Birth.Second() == user1.Birth.Second())
-}
\ No newline at end of file
+}
+
+type TestAddr struct {
+    Street string
+    Zip    uint32
+}
+
+type TestDoc struct {
+    EntityBase
+
+    Id    uint64            `primary:"110"`
+    Title string
+    Score float64
+    Tags  []string
+    Attrs map[string]int64
+    Addr  *TestAddr
+    When  time.Time
+}
+
+func Test1(t *testing.T)  {
+    doc0 := TestDoc{
+        Id:    7,
+        Title: "hello",
+        Score: 0.5,
+        Tags:  []string{"a", "bb"},
+        Attrs: map[string]int64{"x": -1, "y": 1 << 40},
+        Addr:  &TestAddr{Street: "111 WindsorRidge Dr", Zip: 1581},
+        When:  time.Unix(1600000000, 0).UTC(),
+    }
+
+    for _, codec := range []Codec{JSONCodec, BinaryCodec, GobCodec} {
+        misc.AssertNilError(Register1(&TestDoc{}, codec))
+
+        doc0.SetPresent(true)
+        vv, err := commitEntity(&doc0)
+        misc.AssertNilError(err)
+        misc.Assert(vv.Val[0] == codec.Id())
+
+        doc1 := TestDoc{}
+        misc.AssertNilError(decode(&doc1, vv))
+        misc.Assert(doc1.Id == doc0.Id && doc1.Title == doc0.Title && doc1.Score == doc0.Score)
+        misc.Assert(len(doc1.Tags) == 2 && doc1.Tags[1] == "bb")
+        misc.Assert(doc1.Attrs["x"] == -1 && doc1.Attrs["y"] == 1 << 40)
+        misc.Assert(doc1.Addr.Zip == 1581 && doc1.When.Equal(doc0.When))
+    }
+
+    // values written before codecs existed
+    doc1 := TestDoc{}
+    err := decode(&doc1, api.RubiksVV{Present: true, Val: []byte(`{"Id":9,"Title":"old"}`)})
+    misc.AssertNilError(err)
+    misc.Assert(doc1.Id == 9 && doc1.Title == "old")
+
+    // fields appended after the value was written
+    val, err := BinaryCodec.Marshal(&TestDoc{Id: 3, Title: "short"})
+    misc.AssertNilError(err)
+    err = decode(&doc1, api.RubiksVV{Present: true, Val: append([]byte{CodecIdBinary}, val[:1+1+5]...)})
+    misc.AssertNilError(err)
+    misc.Assert(doc1.Id == 3 && doc1.Title == "short")
+}
+
+type TestBad struct {
+    EntityBase
+
+    Name  string    `index:"users"`
+    Score float64   `index:"abc"`
+    Birth time.Time `index:"101"`
+}
+
+type TestNamed struct {
+    EntityBase
+
+    Id    uint64 `primary:"users"`
+    Email string `index:"emails"`
+}
+
+func Test2(t *testing.T)  {
+    misc.AssertNilError(Register(&TestUser{}))
+    misc.AssertNilError(DefineTable("users", 120))
+    misc.AssertNilError(DefineTable("emails", 121))
+    misc.Assert(DefineTable("people", 120) != nil)
+    misc.Assert(DefineTable("users", 122) != nil)
+
+    err := Register(&TestBad{})
+    misc.Assert(err != nil && len(err.(*SchemaError).Problems) == 4)
+
+    misc.AssertNilError(Register(&TestNamed{}))
+    kk := secondaryKK(&TestNamed{Id: 1, Email: "a@b"}, "emails", nil)
+    misc.Assert(kk.Table == 121 && string(kk.Key) == "a@b")
+
+    // codecs need not be comparable
+    misc.AssertNilError(RegisterCodec(testMapCodec{opts: map[string]bool{}}))
+    misc.AssertNilError(RegisterCodec(testMapCodec{opts: map[string]bool{"x": true}}))
+    misc.Assert(RegisterCodec(testOtherCodec{}) != nil)
+    misc.AssertNilError(Register1(&TestNamed{}, testMapCodec{opts: map[string]bool{}}))
+    misc.AssertNilError(Register(&TestNamed{}))
+}
+
+type testMapCodec struct {
+    jsonCodec
+    opts map[string]bool
+}
+
+func (testMapCodec) Id() byte {
+    return 0x10
+}
+
+type testOtherCodec struct {
+    jsonCodec
+}
+
+func (testOtherCodec) Id() byte {
+    return 0x10
+}
+
+func Test3(t *testing.T)  {
+    ctx := context.Background()
+    orm := NewRubiksOrm(rubiks_fake.New())
+
+    users, err := NewRepo[TestUser](orm)
+    misc.AssertNilError(err)
+
+    _, err = users.Get(ctx, 1)
+    misc.Assert(err == ErrNotFound)
+
+    kyle := &TestUser{Id: 1, FirstName: "Kyle", LastName: "Xu"}
+    misc.AssertNilError(users.Insert(ctx, kyle))
+    misc.Assert(users.Insert(ctx, &TestUser{Id: 1}) == ErrExists)
+    misc.AssertNilError(users.Insert(ctx, &TestUser{Id: 2, FirstName: "Kyle", LastName: "Yu"}))
+    misc.AssertNilError(users.Insert(ctx, &TestUser{Id: 3, FirstName: "Lee"}))
+
+    stale, err := users.Get(ctx, uint64(1))
+    misc.AssertNilError(err)
+    misc.AssertNilError(users.Update(ctx, kyle))
+    misc.Assert(users.Update(ctx, stale) == ErrConflict)
+
+    var ids []uint64
+    for user, err := range users.ListBy(ctx, "101", "Kyle") {
+        misc.AssertNilError(err)
+        ids = append(ids, user.Id)
+    }
+    misc.Assert(len(ids) == 2 && ids[0] == 1 && ids[1] == 2)
+
+    ids = nil
+    for user, err := range users.ListBy(ctx, "101", "Kyle", "Xu") {
+        misc.AssertNilError(err)
+        ids = append(ids, user.Id)
+    }
+    misc.Assert(len(ids) == 1 && ids[0] == 1)
+
+    misc.AssertNilError(users.Delete(ctx, kyle))
+    misc.Assert(users.Delete(ctx, stale) == ErrNotFound)
+
+    ids = nil
+    for user, err := range users.ListBy(ctx, "101") {
+        misc.AssertNilError(err)
+        ids = append(ids, user.Id)
+    }
+    misc.Assert(len(ids) == 2 && ids[0] == 2 && ids[1] == 3)
+
+    // the calls without ctx see the same
+    lee := &TestUser{Id: 3}
+    misc.Assert(orm.Get(lee) == nil && lee.GetPresent() && lee.FirstName == "Lee")
+    misc.AssertNilError(orm.Delete(lee))
+    misc.Assert(orm.Update(lee) == ErrNotFound)
+
+    // the cursor stops on cancel and stays stopped
+    ctx1, cancel := context.WithCancel(ctx)
+    c := orm.ListBy(ctx1, &TestUser{}, "101")
+    misc.Assert(c.Next())
+    cancel()
+    misc.Assert(!c.Next() && c.Err() == context.Canceled && !c.Next())
+}
+
+func Test4(t *testing.T)  {
+    ctx := context.Background()
+    fake := rubiks_fake.New()
+    orm := NewRubiksOrm(fake)
+    misc.AssertNilError(Register(&TestUser{}))
+
+    var users []EntityI
+    for i := 0; i < 5; i += 1 {
+        users = append(users, &TestUser{Id: uint64(20 + i), FirstName: "Batch"})
+        users[i].SetPresent(true)
+    }
+
+    // 3 pairs per user
+    misc.AssertNilError(orm.Commit1(ctx, users[:2]...))
+    misc.Assert(errors.Is(orm.Commit1(ctx, users[:3]...), ErrTooBig))
+
+    users[3].SetSeqnum(42)    // stale
+    fake.NRPC = 0
+    errs := orm.CommitBatched(ctx, users...)
+    misc.Assert(fake.NRPC == 3 + 2)
+    misc.Assert(errs[0] == nil && errs[1] == nil && errs[2] == nil && errs[4] == nil)
+    misc.Assert(errs[3] == api.STALE)
+    misc.Assert(users[2].GetSeqnum() == 1 && users[0].GetSeqnum() == 2)
+
+    huge := &TestUser{Id: 30, FirstName: string(make([]byte, api.MaxPairSize))}
+    huge.SetPresent(true)
+    misc.Assert(errors.Is(orm.Commit1(ctx, huge), ErrTooBig))
+}
+
+func Test5(t *testing.T)  {
+    ctx := context.Background()
+    fake := rubiks_fake.New()
+    orm := NewRubiksOrm1(fake, &StaleRetry{Attempts: 1000, Low: time.Microsecond, High: time.Millisecond})
+    misc.AssertNilError(Register(&TestDoc{}))
+    misc.AssertNilError(Register(&TestUser{}))
+
+    // concurrent increments, none lost
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i += 1 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for j := 0; j < 10; j += 1 {
+                misc.AssertNilError(orm.Modify(ctx, &TestDoc{Id: 1}, func(e EntityI) error {
+                    e.(*TestDoc).Score += 1
+                    e.SetPresent(true)
+                    return nil
+                }))
+            }
+        }()
+    }
+    wg.Wait()
+
+    doc := &TestDoc{Id: 1}
+    misc.AssertNilError(orm.Get1(ctx, doc))
+    misc.Assert(doc.Score == 80 && doc.GetSeqnum() == 80)
+
+    // fn failing commits nothing, primary fields stay
+    oops := errors.New("oops")
+    misc.Assert(orm.Modify(ctx, doc, func(e EntityI) error { return oops }) == oops)
+    misc.Assert(orm.Modify(ctx, doc, func(e EntityI) error {
+        e.(*TestDoc).Id = 2
+        return nil
+    }) == errPrimaryChanged)
+    doc = &TestDoc{Id: 1}
+    misc.AssertNilError(orm.Get1(ctx, doc))
+    misc.Assert(doc.GetSeqnum() == 80)
+
+    // the index entry of the old name goes away
+    user := &TestUser{Id: 40, FirstName: "Old"}
+    misc.AssertNilError(orm.Insert1(ctx, user))
+    misc.AssertNilError(orm.Modify(ctx, &TestUser{Id: 40}, func(e EntityI) error {
+        e.(*TestUser).FirstName = "New"
+        return nil
+    }))
+
+    n := 0
+    misc.AssertNilError(orm.ForEachBy(ctx, &TestUser{FirstName: "New"}, "101", func(e EntityI) error {
+        misc.Assert(e.(*TestUser).Id == 40 && e.(*TestUser).FirstName == "New")
+        n += 1
+        return nil
+    }))
+    misc.Assert(n == 1)
+    misc.Assert(!fake.Lookup(secondaryKK(&TestUser{Id: 40, FirstName: "Old"}, "101",
+        &api.RubiksKK{Table: 100, Key: primaryIndex(user).Key})).Present)
+}
+
+type TestAccount struct {
+    EntityBase
+
+    Id     uint64 `primary:"130"`
+    Email  string `index:"131"`
+    Loaded int    `json:"-"`
+    Locked bool
+}
+
+var errNoEmail = errors.New("no email")
+var errLocked = errors.New("locked")
+
+func (a *TestAccount) BeforeCommit() error {
+    a.Email = strings.ToLower(a.Email)
+    return nil
+}
+
+func (a *TestAccount) Validate() error {
+    if a.Email == "" {
+        return errNoEmail
+    }
+    return nil
+}
+
+func (a *TestAccount) AfterLoad() error {
+    a.Loaded += 1
+    return nil
+}
+
+func (a *TestAccount) BeforeDelete() error {
+    if a.Locked {
+        return errLocked
+    }
+    return nil
+}
+
+func Test6(t *testing.T)  {
+    ctx := context.Background()
+    fake := rubiks_fake.New()
+    orm := NewRubiksOrm(fake)
+    misc.AssertNilError(Register(&TestAccount{}))
+
+    acct := &TestAccount{Id: 1}
+    misc.Assert(errors.Is(orm.Insert1(ctx, acct), errNoEmail))
+    misc.Assert(!acct.GetPresent() && fake.NPresent(130) == 0 && fake.NPresent(131) == 0)
+
+    acct.Email, acct.Locked = "Kyle@Example.COM", true
+    misc.AssertNilError(orm.Insert1(ctx, acct))
+    misc.Assert(acct.Email == "kyle@example.com")
+
+    acct = &TestAccount{Id: 1}
+    misc.AssertNilError(orm.Get1(ctx, acct))
+    misc.Assert(acct.Loaded == 1 && acct.Email == "kyle@example.com")
+
+    n := 0
+    misc.AssertNilError(orm.ForEachBy(ctx, &TestAccount{Email: "kyle@"}, "131", func(e EntityI) error {
+        misc.Assert(e.(*TestAccount).Loaded == 1)
+        n += 1
+        return nil
+    }))
+    misc.Assert(n == 1)
+
+    misc.Assert(errors.Is(orm.Delete1(ctx, acct), errLocked))
+    misc.Assert(acct.GetPresent())
+
+    acct.Locked = false
+    misc.AssertNilError(orm.Delete1(ctx, acct))
+    misc.Assert(!acct.GetPresent())
+}
+
+func Test7(t *testing.T)  {
+    ctx := context.Background()
+    fake := rubiks_fake.New()
+    orm := NewRubiksOrm(fake)
+    misc.AssertNilError(Register(&TestUser{}))
+
+    // first names as found by index 101
+    names := func() string {
+        var result []string
+        misc.AssertNilError(orm.ForEachBy(ctx, &TestUser{}, "101", func(e EntityI) error {
+            result = append(result, e.(*TestUser).FirstName)
+            return nil
+        }))
+        return strings.Join(result, ",")
+    }
+
+    // update replaces the index entries of the changed fields
+    user := &TestUser{Id: 50, FirstName: "Aa"}
+    misc.AssertNilError(orm.Insert1(ctx, user))
+    user.FirstName = "Bb"
+    misc.AssertNilError(orm.Update1(ctx, user))
+    misc.Assert(names() == "Bb" && fake.NPresent(101) == 1)
+
+    // delete goes by the stored fields, not the changed ones
+    user.FirstName = "Cc"
+    misc.AssertNilError(orm.Delete1(ctx, user))
+    misc.Assert(fake.NPresent(100) == 0 && fake.NPresent(101) == 0 && fake.NPresent(102) == 0)
+
+    // upsert over a stored version drops its index entries
+    misc.AssertNilError(orm.Upsert1(ctx, &TestUser{Id: 51, FirstName: "Dd"}))
+    misc.AssertNilError(orm.Upsert1(ctx, &TestUser{Id: 51, FirstName: "Ee"}))
+    misc.Assert(names() == "Ee" && fake.NPresent(101) == 1)
+
+    // and over a deleted one
+    misc.AssertNilError(orm.Upsert1(ctx, &TestUser{Id: 50, FirstName: "Ff"}))
+    misc.Assert(names() == "Ee,Ff" && fake.NPresent(100) == 2 && fake.NPresent(102) == 2)
+
+    // insert over a deleted one, of a new entity
+    user = &TestUser{Id: 51}
+    misc.AssertNilError(orm.Get1(ctx, user))
+    misc.AssertNilError(orm.Delete1(ctx, user))
+    misc.AssertNilError(orm.Insert1(ctx, &TestUser{Id: 51, FirstName: "Gg"}))
+    misc.Assert(names() == "Ff,Gg")
+    misc.Assert(orm.Insert1(ctx, &TestUser{Id: 51}) == ErrExists)
+}
+
+// iterates nothing, with no NONEXT either
+type emptyIterate struct {
+    client.Rubiks
+}
+
+func (emptyIterate) RPCIterate(rbr *client.RubiksR, deadline time.Time,
+    cursor api.RubiksKK, npairs int, hint api.IterateHint) ([]api.RubiksKK, []api.RubiksVV, error) {
+    return nil, nil, nil
+}
+
+func Test8(t *testing.T)  {
+    ctx := context.Background()
+    orm := NewRubiksOrm(emptyIterate{rubiks_fake.New()})
+    misc.AssertNilError(Register(&TestUser{}))
+
+    c := orm.ListBy(ctx, &TestUser{}, "101")
+    defer c.Close()
+    misc.Assert(!c.Next() && c.Err() == nil && !c.Next())
+}